@@ -0,0 +1,291 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ============================================================================================================================
+// Owner Activity
+//
+// Every event that involves an owner also appends an activity record for that owner under
+// owner~time~txid~activity -> [owner id, time, tx id, activity], and an entry in the
+// owner~activity~time~txid index so one kind of activity can be walked on its own. The time is the tx timestamp,
+// zero padded so keys sort in time order, and a time range is read by starting the first page at its from time.
+// Records are never changed or removed.
+// The activity is the event type (see events.go), the role says which side of it the owner was on.
+//
+// Records from before the time was in the key are under owner~activity~txid, migrate() moves them.
+// ============================================================================================================================
+const owner_activity_index = "owner~time~txid~activity"
+const owner_activity_type_index = "owner~activity~time~txid"
+const legacy_owner_activity_index = "owner~activity~txid"
+
+const activity_role_from = "from"   //the marble's owner - seller, giver or the owner of a deleted marble
+const activity_role_to = "to"       //who the marble went or would go to - buyer, receiver
+const activity_role_owner = "owner" //the owner themselves, for owner_* events and marked_for_sale
+
+// ----- Activity ----- //
+type OwnerActivity struct {
+	ObjectType    string `json:"docType"`       //field for couchdb
+	SchemaVersion int    `json:"schemaVersion"` //see schema.go
+	OwnerId       string `json:"ownerId"`
+	Activity      string `json:"activity"`               //event type, e.g. marble_transferred
+	Role          string `json:"role"`                   //from, to or owner
+	MarbleId      string `json:"marbleId,omitempty"`     //marble involved, if any
+	OfferId       string `json:"offerId,omitempty"`      //offer involved, if any
+	Counterparty  string `json:"counterparty,omitempty"` //owner on the other side, if any
+	Price         int    `json:"price,omitempty"`
+	TxId          string `json:"txId"`
+	Timestamp     int64  `json:"timestamp"` //tx timestamp in ms since epoch
+}
+
+// ============================================================================================================================
+// Record Owner Activity - append an activity record for each owner an event involves
+//
+// seq is how many events of this type the tx already emitted, past the first the tx id in the key gets a ".seq"
+// suffix so they don't overwrite each other (a tx can't read its own writes to check)
+// ============================================================================================================================
+func record_owner_activity(stub shim.ChaincodeStubInterface, event MarbleEvent, timestamp int64, seq int) error {
+	type Party struct {
+		OwnerId      string
+		Role         string
+		Counterparty string
+	}
+	parties := []Party{
+		{event.OwnerId, activity_role_owner, ""},
+		{event.OldOwner, activity_role_from, event.NewOwner},
+		{event.NewOwner, activity_role_to, event.OldOwner},
+	}
+
+	for _, party := range parties {
+		if len(party.OwnerId) == 0 {
+			continue
+		}
+
+		var activity OwnerActivity
+		activity.ObjectType = "owner_activity"
+		activity.OwnerId = party.OwnerId
+		activity.Activity = event.Type
+		activity.Role = party.Role
+		activity.MarbleId = event.MarbleId
+		activity.OfferId = event.OfferId
+		activity.Counterparty = party.Counterparty
+		activity.Price = event.Price
+		activity.TxId = event.TxId
+		activity.Timestamp = timestamp
+
+		txId := activity.TxId
+		if seq > 0 {
+			txId += "." + strconv.Itoa(seq)
+		}
+		err := put_owner_activity(stub, activity, txId)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// Put Owner Activity - store an activity record and its activity index entry
+//
+// txId is the record's tx id plus its ".seq" suffix, if it has one
+// ============================================================================================================================
+func put_owner_activity(stub shim.ChaincodeStubInterface, activity OwnerActivity, txId string) error {
+	time := activity_time(activity.Timestamp)
+	key, err := stub.CreateCompositeKey(owner_activity_index, []string{activity.OwnerId, time, txId, activity.Activity})
+	if err != nil {
+		return err
+	}
+	activity.SchemaVersion = schema_version
+	activityAsBytes, err := marshal_record(activity.OwnerId+"/"+time+"/"+txId+"/"+activity.Activity, activity) //convert to array of bytes
+	if err != nil {
+		return err
+	}
+	err = stub.PutState(key, activityAsBytes)
+	if err != nil {
+		return err
+	}
+
+	indexKey, err := stub.CreateCompositeKey(owner_activity_type_index, []string{activity.OwnerId, activity.Activity, time, txId})
+	if err != nil {
+		return err
+	}
+	value := []byte{0x00} //the key is all we need
+	return stub.PutState(indexKey, value)
+}
+
+// tx timestamp as it goes in activity keys, padded so keys sort by time
+func activity_time(timestamp int64) string {
+	return fmt.Sprintf("%016d", timestamp)
+}
+
+// ============================================================================================================================
+// Get Owner Activity - everything that happened to an owner, a page at a time, oldest first
+//
+// The first page starts at the from time, and the last page is the one that reaches past the to time, its
+// bookmark comes back empty. Filter by activity to walk one kind at a time.
+//
+// Inputs - Array of strings
+//         0        ,       1         ,       2        ,       3        ,    4     ,    5
+//      owner id    ,    activity     ,   from (ms)    ,    to (ms)     , pageSize , bookmark
+// "o9999999999999" , "offer_made"    , "1500000000000", "1600000000000",   "25"   ,    ""
+//
+// Leave the activity, from and to empty for everything
+// ============================================================================================================================
+func getOwnerActivity(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting getOwnerActivity")
+
+	if len(args) != 6 {
+		return new_error_response(code_invalid_argument, "Incorrect number of arguments. Expecting 6")
+	}
+
+	owner_id := args[0]
+	activity_type := args[1]
+	options, err := parse_history_options(args[2:4])
+	if err != nil {
+		return error_response(err, code_invalid_argument)
+	}
+	pageSize, bookmark, err := parse_page_args(args[4:])
+	if err != nil {
+		return error_response(err, code_invalid_argument)
+	}
+
+	namespace := owner_activity_index
+	attributes := []string{owner_id}
+	if len(activity_type) > 0 {
+		namespace = owner_activity_type_index
+		attributes = append(attributes, activity_type)
+	}
+	if len(bookmark) == 0 && options.From > 0 {
+		//the peer starts a paginated range at the bookmark when there is one (handleGetStateByRange() in
+		//fabric's core/chaincode/handler.go), and a composite key can't be the start of a plain range query,
+		//so the first page gets the key of the earliest possible entry at from as its bookmark
+		bookmark, err = stub.CreateCompositeKey(namespace, append(attributes, activity_time(options.From)))
+		if err != nil {
+			return error_response(err, code_invalid_argument)
+		}
+	}
+	resultsIterator, metadata, err := stub.GetStateByPartialCompositeKeyWithPagination(namespace, attributes, pageSize, bookmark)
+	if err != nil {
+		return error_response(err, code_ledger_error)
+	}
+	defer resultsIterator.Close()
+
+	activities := []OwnerActivity{}
+	for resultsIterator.HasNext() {
+		aKeyValue, err := resultsIterator.Next()
+		if err != nil {
+			return error_response(err, code_ledger_error)
+		}
+
+		key := aKeyValue.Key
+		valAsBytes := aKeyValue.Value
+		if namespace == owner_activity_type_index { //look the record up
+			key, err = activity_key_for_index(stub, aKeyValue.Key)
+			if err != nil {
+				return error_response(err, code_ledger_error)
+			}
+			valAsBytes, err = stub.GetState(key)
+			if err != nil {
+				return error_response(err, code_ledger_error)
+			}
+		}
+
+		var activity OwnerActivity
+		err = unmarshal_record(key, valAsBytes, &activity) //un stringify it aka JSON.parse()
+		if err != nil {
+			return error_response(err, code_record_invalid)
+		}
+		if options.To > 0 && activity.Timestamp > options.To {
+			if metadata != nil {
+				metadata.Bookmark = "" //past the end of the range, nothing later is wanted
+			}
+			break
+		}
+		activities = append(activities, activity)
+	}
+	if options.To > 0 && metadata != nil && len(metadata.Bookmark) > 0 {
+		next, err := activity_key_time(stub, metadata.Bookmark)
+		if err == nil && next > activity_time(options.To) {
+			metadata.Bookmark = "" //the next page would start past the end of the range
+		}
+	}
+
+	fmt.Println("- end getOwnerActivity")
+	return page_response(activities, metadata)
+}
+
+// ============================================================================================================================
+// Activity Key Time - the padded time in an owner~time~txid~activity or owner~activity~time~txid key
+// ============================================================================================================================
+func activity_key_time(stub shim.ChaincodeStubInterface, key string) (string, error) {
+	namespace, attributes, err := stub.SplitCompositeKey(key)
+	if err != nil || len(attributes) != 4 {
+		return "", new_error(code_invalid_argument, "Not an activity key")
+	}
+	if namespace == owner_activity_type_index {
+		return attributes[2], nil
+	}
+	return attributes[1], nil
+}
+
+// ============================================================================================================================
+// Activity Key For Index - the owner~time~txid~activity key an owner~activity~time~txid index entry points to
+// ============================================================================================================================
+func activity_key_for_index(stub shim.ChaincodeStubInterface, indexKey string) (string, error) {
+	_, attributes, err := stub.SplitCompositeKey(indexKey)
+	if err != nil {
+		return "", err
+	}
+	if len(attributes) != 4 {
+		return "", new_error(code_record_invalid, "Activity index key has "+strconv.Itoa(len(attributes))+" attributes, expecting 4")
+	}
+	return stub.CreateCompositeKey(owner_activity_index, []string{attributes[0], attributes[2], attributes[3], attributes[1]})
+}
+
+// ============================================================================================================================
+// Move Legacy Activity - store an owner~activity~txid record under its owner~time~txid~activity key, for migrate()
+// ============================================================================================================================
+func move_legacy_activity(stub shim.ChaincodeStubInterface, legacyKey string, valAsBytes []byte) error {
+	_, attributes, err := stub.SplitCompositeKey(legacyKey)
+	if err != nil {
+		return err
+	}
+	if len(attributes) != 3 {
+		return new_error(code_record_invalid, "Activity key has "+strconv.Itoa(len(attributes))+" attributes, expecting 3")
+	}
+	var activity OwnerActivity
+	err = unmarshal_record(legacyKey, valAsBytes, &activity) //un stringify it aka JSON.parse()
+	if err != nil {
+		return err
+	}
+	err = put_owner_activity(stub, activity, attributes[2]) //keep the ".seq" suffix the tx id had in the key
+	if err != nil {
+		return err
+	}
+	return stub.DelState(legacyKey)
+}
@@ -0,0 +1,128 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+)
+
+// walk getOwnerActivity a page at a time, returns the offer id of each record and how many pages it took
+func (stub *TestStub) activity_pages(owner_id string, activity string, from string, to string) ([]string, int) {
+	stub.t.Helper()
+	offers := []string{}
+	bookmark := ""
+	for pages := 1; pages < 50; pages++ {
+		res := stub.must("getOwnerActivity", owner_id, activity, from, to, "1", bookmark)
+		var page struct {
+			Records  []OwnerActivity `json:"records"`
+			Bookmark string          `json:"bookmark"`
+		}
+		json.Unmarshal(res.Payload, &page)
+		if len(page.Records) == 0 {
+			stub.t.Fatalf("Page %d of %s activity came back empty", pages, owner_id)
+		}
+		for _, record := range page.Records {
+			offers = append(offers, record.OfferId)
+		}
+		if bookmark = page.Bookmark; len(bookmark) == 0 {
+			return offers, pages
+		}
+	}
+	stub.t.Fatal("Activity pages never ended")
+	return nil, 0
+}
+
+func TestOwnerActivityTimeRange(t *testing.T) {
+	stub := new_market(t)
+	times := []int64{}
+	for i, marble_id := range []string{"m1", "m2", "m1", "m2"} {
+		offer_id := "offer" + strconv.Itoa(i+1)
+		stub.offer_for(marble_id, offer_id, false)
+		times = append(times, stub.offer(offer_id).UpdatedAt)
+	}
+	stub.as_buyer()
+	stub.must("withdraw_offer", "offer1", buyer_company)
+
+	// only the records in the range are read, a page at a time and in time order
+	offers, pages := stub.activity_pages("o2", "offer_made", strconv.FormatInt(times[1], 10), strconv.FormatInt(times[2], 10))
+	if len(offers) != 2 || offers[0] != "offer2" || offers[1] != "offer3" || pages != 2 {
+		t.Fatalf("Expected offer2 and offer3 in 2 pages, got %v in %d", offers, pages)
+	}
+	offers, _ = stub.activity_pages("o2", "", strconv.FormatInt(times[2], 10), "")
+	if len(offers) != 3 || offers[0] != "offer3" || offers[1] != "offer4" || offers[2] != "offer1" {
+		t.Fatalf("Expected offer3, offer4 and the offer1 withdrawal, got %v", offers)
+	}
+	offers, _ = stub.activity_pages("o2", "", "", strconv.FormatInt(times[0], 10))
+	if len(offers) != 2 || offers[0] != "" || offers[1] != "offer1" {
+		t.Fatalf("Expected o2 being created and offer1, got %v", offers)
+	}
+
+	// the seller sees the same offers from the other side
+	offers, _ = stub.activity_pages("o1", "offer_made", "", "")
+	if len(offers) != 4 {
+		t.Fatalf("Expected the 4 offers made to o1, got %v", offers)
+	}
+}
+
+func TestOwnerActivityLegacyKeysAreMoved(t *testing.T) {
+	stub := new_market(t)
+	legacyKey, _ := stub.CreateCompositeKey(legacy_owner_activity_index, []string{"o2", "offer_made", "tx0.1"})
+	stub.put_fixture(legacyKey, `{"docType":"owner_activity","ownerId":"o2","activity":"offer_made","role":"to","offerId":"offer0","txId":"tx0","timestamp":1000}`)
+	stub.offer_for("m1", "offer1", false)
+
+	stub.as(seller_company, role_admin)
+	stub.migrate_all(max_migration_batch)
+	if value, _ := stub.GetState(legacyKey); value != nil {
+		t.Fatalf("Legacy activity should be removed, got %s", value)
+	}
+	offers, _ := stub.activity_pages("o2", "offer_made", "", "")
+	if len(offers) != 2 || offers[0] != "offer0" || offers[1] != "offer1" {
+		t.Fatalf("Expected the legacy offer0 before offer1, got %v", offers)
+	}
+}
+
+func TestOwnerActivityStartsReadingAtFrom(t *testing.T) {
+	stub := new_market(t)
+	times := []int64{}
+	for i := 1; i <= 6; i++ {
+		offer_id := "offer" + strconv.Itoa(i)
+		stub.offer_for("m1", offer_id, false)
+		times = append(times, stub.offer(offer_id).UpdatedAt)
+	}
+
+	// the first page starts at the first entry at from, nothing earlier is read
+	stub.scanned = 0
+	offers, _ := stub.activity_pages("o2", "offer_made", strconv.FormatInt(times[4], 10), "")
+	if len(offers) != 2 || offers[0] != "offer5" || stub.scanned != 2 {
+		t.Fatalf("Expected offer5 and offer6 from reading 2 keys, got %v from %d", offers, stub.scanned)
+	}
+	stub.scanned = 0
+	offers, _ = stub.activity_pages("o2", "", strconv.FormatInt(times[5], 10), "")
+	if len(offers) != 1 || offers[0] != "offer6" || stub.scanned != 1 {
+		t.Fatalf("Expected offer6 from reading 1 key, got %v from %d", offers, stub.scanned)
+	}
+
+	// a broken record is reported, not skipped
+	key, _ := stub.CreateCompositeKey(owner_activity_index, []string{"o2", activity_time(times[5]), "tx0", "offer_made"})
+	stub.put_fixture(key, `{"docType":"owner_activity","ownerId":"o2","timestamp":"noon"}`)
+	stub.expect_code(code_record_invalid, "getOwnerActivity", "o2", "", strconv.FormatInt(times[5], 10), "", "25", "")
+}
@@ -0,0 +1,152 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ============================================================================================================================
+// Responses
+//
+// Every function answers with the same JSON envelope so clients can branch on the code instead of the message -
+//
+//	{"status": "error", "code": "MARBLE_NOT_FOUND", "message": "Marble does not exist - m999999999"}
+//
+// Errors are sent with shim.Error(), the envelope is the error message. Writes succeed with the envelope as the
+// payload, status "ok" and code "OK". Reads succeed with the document they read as the payload, unwrapped - reads
+// are the exception so their payloads stay the plain documents clients already parse, describe() lists which
+// functions are which under "returns". Helpers return errors made with new_error() so the code survives to the
+// response, wrap a helper's error with error_message() to keep its code out of the new message.
+//
+// Error Code Catalogue - codes are never renamed or reused, add new ones at the end of their group
+// ============================================================================================================================
+const code_ok = "OK" //success
+
+// request problems
+const code_invalid_argument = "INVALID_ARGUMENT" //wrong number of arguments or an argument failed validation
+const code_unknown_function = "UNKNOWN_FUNCTION" //no chaincode function by that name
+const code_not_authorized = "NOT_AUTHORIZED"     //caller's company cannot act on this asset, or caller is not an admin
+
+// marbles and owners
+const code_marble_not_found = "MARBLE_NOT_FOUND"         //no marble with that id
+const code_marble_exists = "MARBLE_EXISTS"               //a marble with that id already exists
+const code_marble_not_for_sale = "MARBLE_NOT_FOR_SALE"   //marble was never passed through mark_for_sale
+const code_marble_in_escrow = "MARBLE_IN_ESCROW"         //marble is locked by an accepted offer
+const code_price_below_minimum = "PRICE_BELOW_MIN_PRICE" //offer price is under the marble's minPrice
+const code_owner_not_found = "OWNER_NOT_FOUND"           //no owner with that id
+const code_owner_exists = "OWNER_EXISTS"                 //an owner with that id already exists
+const code_owner_disabled = "OWNER_DISABLED"             //owner has been disabled
+const code_buyer_is_owner = "BUYER_IS_OWNER"             //owners can't bid on their own marbles
+
+// offers and payments
+const code_offer_exists = "OFFER_ID_TAKEN"                       //offer id is already in use
+const code_offer_not_found = "OFFER_NOT_FOUND"                   //no offer with that id
+const code_offer_state_invalid = "OFFER_STATE_INVALID"           //offer's status doesn't allow this, see offers.go
+const code_payment_not_verified = "PAYMENT_NOT_VERIFIED"         //payment wasn't found or doesn't match the offer
+const code_payment_already_used = "PAYMENT_ALREADY_USED"         //payment already settled an offer
+const code_payment_not_found = "PAYMENT_NOT_FOUND"               //payment never settled an offer
+const code_payment_rail_unavailable = "PAYMENT_RAIL_UNAVAILABLE" //rail isn't registered or couldn't be reached
+const code_oracle_not_found = "ORACLE_NOT_FOUND"                 //no payment oracle with that id
+const code_attestation_invalid = "ATTESTATION_INVALID"           //attestation signature or contents don't check out
+
+// everything else
+const code_ledger_error = "LEDGER_ERROR"     //reading or writing state failed
+const code_record_invalid = "RECORD_INVALID" //a stored document is corrupt, incomplete or from a newer schema, see schema.go
+
+const status_ok = "ok"
+const status_error = "error"
+
+// ----- Responses ----- //
+type ResponseEnvelope struct {
+	Status  string `json:"status"` //ok or error
+	Code    string `json:"code"`   //code_ok or an error code
+	Message string `json:"message"`
+}
+
+// ----- Errors ----- //
+type ChaincodeError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *ChaincodeError) Error() string {
+	return e.Code + " - " + e.Message
+}
+
+// ============================================================================================================================
+// New Error - make an error that carries an error code
+// ============================================================================================================================
+func new_error(code string, message string) error {
+	return &ChaincodeError{Code: code, Message: message}
+}
+
+// ============================================================================================================================
+// Error Code - the code an error carries, empty if it has none
+// ============================================================================================================================
+func error_code(err error) string {
+	if ccErr, ok := err.(*ChaincodeError); ok {
+		return ccErr.Code
+	}
+	return ""
+}
+
+// ============================================================================================================================
+// Error Message - the message an error carries, without its code, for wrapping it in another error
+// ============================================================================================================================
+func error_message(err error) string {
+	if ccErr, ok := err.(*ChaincodeError); ok {
+		return ccErr.Message
+	}
+	return err.Error()
+}
+
+// ============================================================================================================================
+// Error Response - shim.Error with the JSON envelope as the message
+//
+// Errors without a code are sent with the fallback code
+// ============================================================================================================================
+func error_response(err error, fallback_code string) pb.Response {
+	envelope := ResponseEnvelope{Status: status_error, Code: fallback_code, Message: err.Error()}
+	if ccErr, ok := err.(*ChaincodeError); ok {
+		envelope.Code = ccErr.Code
+		envelope.Message = ccErr.Message
+	}
+	envelopeAsBytes, _ := json.Marshal(envelope) //convert to array of bytes
+	return shim.Error(string(envelopeAsBytes))
+}
+
+// ============================================================================================================================
+// New Error Response - error_response() for a new error
+// ============================================================================================================================
+func new_error_response(code string, message string) pb.Response {
+	return error_response(new_error(code, message), code)
+}
+
+// ============================================================================================================================
+// Success Response - shim.Success with the JSON envelope as the payload, for writes
+// ============================================================================================================================
+func success_response(message string) pb.Response {
+	envelopeAsBytes, _ := json.Marshal(ResponseEnvelope{Status: status_ok, Code: code_ok, Message: message}) //convert to array of bytes
+	return shim.Success(envelopeAsBytes)
+}
@@ -0,0 +1,95 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"testing"
+)
+
+// ============================================================================================================================
+// Escrow
+// ============================================================================================================================
+func TestEscrowLockAndRelease(t *testing.T) {
+	stub := new_market(t)
+	stub.offer_for("m1", "offer1", true)
+	stub.as(buyer_company, "")
+	stub.must("make_offer", "m1", "o3", buyer_company, "200", "offer2")
+
+	marble := stub.marble("m1")
+	if marble.Escrow == nil || marble.Escrow.OfferId != "offer1" {
+		t.Fatalf("Accepting should lock the marble to offer1, got %+v", marble.Escrow)
+	}
+
+	// nothing else can happen to a marble in escrow
+	stub.as_seller()
+	stub.expect_code(code_marble_in_escrow, "accept_offer", "offer2", seller_company)
+	stub.expect_code(code_marble_in_escrow, "set_owner", "m1", "o1", seller_company)
+	stub.expect_code(code_marble_in_escrow, "delete_marble", "m1", seller_company)
+	stub.expect_code(code_marble_in_escrow, "mark_for_sale", "m1", seller_company, "500")
+	stub.expect_status("offer2", offer_proposed)
+
+	// withdrawing releases it and the next offer can be accepted
+	stub.as_buyer()
+	stub.must("withdraw_offer", "offer1", buyer_company)
+	if marble := stub.marble("m1"); marble.Escrow != nil {
+		t.Fatalf("Withdrawing should release the escrow, got %+v", marble.Escrow)
+	}
+	stub.as_seller()
+	stub.must("accept_offer", "offer2", seller_company)
+	if marble := stub.marble("m1"); marble.Escrow == nil || marble.Escrow.OfferId != "offer2" {
+		t.Fatalf("The marble should be locked to offer2, got %+v", marble.Escrow)
+	}
+}
+
+func TestOfferAcceptRechecksTheMarble(t *testing.T) {
+	stub := new_market(t)
+	stub.offer_for("m1", "offer1", false)
+	stub.offer_for("m2", "offer2", false)
+
+	// transferring a marble turns down the offers made to the old owner
+	stub.as_seller()
+	stub.must("init_owner", "o4", "dave", seller_company, test_account(4))
+	stub.must("set_owner", "m1", "o4", seller_company)
+	stub.expect_status("offer1", offer_rejected)
+
+	// offers older chaincode left open are caught when they are accepted
+	stub.offer_for("m2", "offer3", false)
+	marble := stub.marble("m2")
+	marble.Owner.Id = "o4"
+	stub.rewrite_marble(marble)
+	stub.as_seller()
+	stub.expect_code(code_offer_state_invalid, "accept_offer", "offer2", seller_company)
+	marble.Owner.Id = "o1"
+	marble.IsForSale = false
+	stub.rewrite_marble(marble)
+	stub.expect_code(code_marble_not_for_sale, "accept_offer", "offer3", seller_company)
+}
+
+// store a marble without going through the chaincode functions
+func (stub *TestStub) rewrite_marble(marble Marble) {
+	stub.t.Helper()
+	stub.writes = map[string][]byte{}
+	err := put_marble(stub, marble)
+	if err != nil {
+		stub.t.Fatal(err)
+	}
+	stub.commit()
+	stub.writes = nil
+}
@@ -0,0 +1,135 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// ============================================================================================================================
+// Chaincode Events
+//
+// Every state change emits a typed event so apps can listen instead of polling read_everything.
+// Fabric keeps only one event per transaction (a second SetEvent() replaces the first), so the events of a
+// transaction are collected into one envelope on the EventStub that Invoke() passes down, and Invoke() sets
+// the envelope as the transaction's event once the function has succeeded.
+//
+// The event name is the event's type, or "batch" when the transaction made more than one change.
+// The payload is always the envelope - {"txId": "...", "timestamp": 1500000000000, "events": [...]}
+// ============================================================================================================================
+const event_marble_created = "marble_created"
+const event_marble_transferred = "marble_transferred"
+const event_marble_deleted = "marble_deleted"
+const event_marked_for_sale = "marked_for_sale"
+const event_offer_made = "offer_made"
+const event_offer_accepted = "offer_accepted"
+const event_offer_rejected = "offer_rejected"
+const event_offer_withdrawn = "offer_withdrawn"
+const event_offer_expired = "offer_expired"
+const event_payment_settled = "payment_settled"
+const event_owner_created = "owner_created"
+const event_owner_disabled = "owner_disabled"
+const event_batch = "batch"
+
+// ----- Events ----- //
+type MarbleEvent struct {
+	Type     string `json:"type"`
+	MarbleId string `json:"marbleId,omitempty"`
+	OfferId  string `json:"offerId,omitempty"`
+	OwnerId  string `json:"ownerId,omitempty"`  //owner the event is about, for owner_* events
+	OldOwner string `json:"oldOwner,omitempty"` //owner id before a transfer
+	NewOwner string `json:"newOwner,omitempty"` //owner id after a transfer
+	Price    int    `json:"price,omitempty"`    //min price or offer price
+	TxId     string `json:"txId"`
+}
+
+type EventEnvelope struct {
+	TxId      string        `json:"txId"`
+	Timestamp int64         `json:"timestamp"` //tx timestamp in ms since epoch
+	Events    []MarbleEvent `json:"events"`
+}
+
+// ----- Event Stub ----- //
+type EventStub struct {
+	shim.ChaincodeStubInterface                //the stub of this invocation, everything else is passed through
+	envelope                    *EventEnvelope //events emitted so far, nil until the first one
+}
+
+// ============================================================================================================================
+// New Event Stub - wrap an invocation's stub so the functions it calls can emit events
+// ============================================================================================================================
+func new_event_stub(stub shim.ChaincodeStubInterface) *EventStub {
+	return &EventStub{ChaincodeStubInterface: stub}
+}
+
+// ============================================================================================================================
+// Emit Event - add an event to this transaction's envelope
+//
+// Also appends the owner activity records for the event, see activity.go
+// ============================================================================================================================
+func emit_event(stub shim.ChaincodeStubInterface, event MarbleEvent) error {
+	eventStub, ok := stub.(*EventStub)
+	if !ok {
+		return new_error(code_ledger_error, "Events can only be emitted by functions called from Invoke()")
+	}
+	timestamp, err := get_tx_timestamp(stub)
+	if err != nil {
+		return err
+	}
+	event.TxId = stub.GetTxID()
+
+	envelope := eventStub.envelope
+	if envelope == nil {
+		envelope = &EventEnvelope{TxId: stub.GetTxID(), Timestamp: timestamp}
+		eventStub.envelope = envelope
+	}
+
+	// owners get an activity record too, see activity.go
+	seq := 0 //events of this type already in the tx
+	for _, previous := range envelope.Events {
+		if previous.Type == event.Type {
+			seq++
+		}
+	}
+	err = record_owner_activity(stub, event, timestamp, seq)
+	if err != nil {
+		return err
+	}
+	envelope.Events = append(envelope.Events, event)
+	return nil
+}
+
+// ============================================================================================================================
+// Set Events - set the envelope as the transaction's event, Invoke() calls this when the function succeeded
+// ============================================================================================================================
+func set_events(stub *EventStub) error {
+	if stub.envelope == nil {
+		return nil //nothing happened
+	}
+
+	name := stub.envelope.Events[0].Type
+	if len(stub.envelope.Events) > 1 {
+		name = event_batch
+	}
+	envelopeAsBytes, _ := json.Marshal(stub.envelope) //convert to array of bytes
+	return stub.SetEvent(name, envelopeAsBytes)
+}
@@ -0,0 +1,63 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestEventsAreSetOncePerTransaction(t *testing.T) {
+	stub := new_market(t)
+	stub.offer_for("m1", "offer1", false)
+	if stub.eventName != event_offer_made || stub.eventsSet != 1 {
+		t.Fatalf("A single change should set its own event once, got %s set %d times", stub.eventName, stub.eventsSet)
+	}
+
+	// transferring the marble turns down its offer in the same transaction
+	stub.as_seller()
+	stub.must("set_owner", "m1", "o1", seller_company)
+	var envelope EventEnvelope
+	json.Unmarshal(stub.eventPayload, &envelope)
+	if stub.eventName != event_batch || stub.eventsSet != 1 || len(envelope.Events) != 2 || envelope.TxId != stub.txId {
+		t.Fatalf("Expected one batch event with 2 events, got %s set %d times - %s", stub.eventName, stub.eventsSet, stub.eventPayload)
+	}
+
+	// nothing is set by a transaction that failed
+	stub.expect_code(code_owner_not_found, "set_owner", "m2", "o9", seller_company)
+	stub.expect_code(code_not_authorized, "delete_marble", "m2", buyer_company)
+	if stub.eventsSet != 0 {
+		t.Fatalf("A failed transaction should not set an event, got %s", stub.eventName)
+	}
+
+	// nor by a read
+	stub.must("read_everything")
+	if stub.eventsSet != 0 {
+		t.Fatalf("A read should not set an event, got %s", stub.eventName)
+	}
+}
+
+func TestEventsNeedAnInvocation(t *testing.T) {
+	stub := new_test_stub(t)
+	stub.writes = map[string][]byte{}
+	if err := emit_event(stub, MarbleEvent{Type: event_marble_created}); err == nil {
+		t.Fatal("Events emitted outside Invoke() would never be set")
+	}
+}
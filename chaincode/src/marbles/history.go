@@ -0,0 +1,347 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// ============================================================================================================================
+// History
+//
+// GetHistoryForKey() gives every write of a key, deletes included. The helpers here read that into
+// entries with the tx timestamp and delete flag, oldest first, and apply the caller's time range, order and view.
+// ============================================================================================================================
+const history_view_full = "full"           //every write
+const history_view_ownership = "ownership" //only the writes that changed who owns it
+
+// ----- History Entries ----- //
+type KeyModification struct {
+	TxId      string          `json:"txId"`
+	Timestamp int64           `json:"timestamp"` //tx timestamp in ms since epoch
+	IsDelete  bool            `json:"isDelete"`
+	Value     json.RawMessage `json:"value"` //null for deletes
+}
+
+type HistoryOptions struct {
+	From       int64  //only entries at or after this time, ms since epoch, 0 for no limit
+	To         int64  //only entries at or before this time, ms since epoch, 0 for no limit
+	Descending bool   //newest first
+	View       string //history_view_full or history_view_ownership
+}
+
+// ============================================================================================================================
+// Parse History Options - parse the optional time range, order and view arguments, empty strings take the default
+//
+// Inputs - Array of strings (any trailing ones may be left off)
+//        0       ,       1       ,   2   ,     3
+//  from (ms)     ,  to (ms)      , order , view
+// "1500000000000", "1600000000000", "desc", "ownership"
+// ============================================================================================================================
+func parse_history_options(args []string) (HistoryOptions, error) {
+	options := HistoryOptions{View: history_view_full}
+	if len(args) > 4 {
+		return options, new_error(code_invalid_argument, "Expecting at most from, to, order and view after the id")
+	}
+	args = append(args, "", "", "", "")[:4] //fill in the defaults
+
+	var err error
+	if len(args[0]) > 0 {
+		options.From, err = strconv.ParseInt(args[0], 10, 64)
+		if err != nil || options.From < 0 {
+			return options, new_error(code_invalid_argument, "From must be a time in ms since epoch")
+		}
+	}
+	if len(args[1]) > 0 {
+		options.To, err = strconv.ParseInt(args[1], 10, 64)
+		if err != nil || options.To < 0 {
+			return options, new_error(code_invalid_argument, "To must be a time in ms since epoch")
+		}
+	}
+	if options.To > 0 && options.To < options.From {
+		return options, new_error(code_invalid_argument, "To cannot be before from")
+	}
+	switch args[2] {
+	case "", "asc":
+	case "desc":
+		options.Descending = true
+	default:
+		return options, new_error(code_invalid_argument, "Order must be 'asc' or 'desc'")
+	}
+	switch args[3] {
+	case "", history_view_full:
+	case history_view_ownership:
+		options.View = history_view_ownership
+	default:
+		return options, new_error(code_invalid_argument, "View must be '"+history_view_full+"' or '"+history_view_ownership+"'")
+	}
+	return options, nil
+}
+
+// ============================================================================================================================
+// In Range - true if a time falls inside the options' time range
+// ============================================================================================================================
+func (options HistoryOptions) in_range(timestamp int64) bool {
+	if options.From > 0 && timestamp < options.From {
+		return false
+	}
+	if options.To > 0 && timestamp > options.To {
+		return false
+	}
+	return true
+}
+
+// ============================================================================================================================
+// Get Key History - every write of a key, oldest first
+// ============================================================================================================================
+func get_key_history(stub shim.ChaincodeStubInterface, key string) ([]KeyModification, error) {
+	history := []KeyModification{}
+	resultsIterator, err := stub.GetHistoryForKey(key)
+	if err != nil {
+		return history, err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		historyData, err := resultsIterator.Next()
+		if err != nil {
+			return history, err
+		}
+
+		var entry KeyModification
+		entry.TxId = historyData.TxId
+		entry.IsDelete = historyData.IsDelete || historyData.Value == nil
+		if historyData.Timestamp != nil {
+			entry.Timestamp = historyData.Timestamp.Seconds*1000 + int64(historyData.Timestamp.Nanos)/1000000
+		}
+		if !entry.IsDelete {
+			entry.Value = json.RawMessage(historyData.Value)
+		}
+		history = append(history, entry)
+	}
+
+	// peers have not always agreed on the order, make it oldest first
+	if len(history) > 1 && history[0].Timestamp > history[len(history)-1].Timestamp {
+		reverse_history(history)
+	}
+	return history, nil
+}
+
+// ============================================================================================================================
+// Reverse History - flip a history list in place
+// ============================================================================================================================
+func reverse_history(history []KeyModification) {
+	for i, j := 0, len(history)-1; i < j; i, j = i+1, j-1 {
+		history[i], history[j] = history[j], history[i]
+	}
+}
+
+// ============================================================================================================================
+// Get Record History - history of a marble, owner or offer by id, and the record's docType
+//
+// Offers live under the offer namespace, offers made before it existed also have writes under their plain id.
+// Those writes are merged in, the delete that ends them is the move into the namespace so it is dropped.
+// ============================================================================================================================
+func get_record_history(stub shim.ChaincodeStubInterface, id string) (string, []KeyModification, error) {
+	modifications, err := get_key_history(stub, id)
+	if err != nil {
+		return "", modifications, err
+	}
+
+	key, err := offer_key(stub, id)
+	if err != nil {
+		return "", modifications, err
+	}
+	offerModifications, err := get_key_history(stub, key)
+	if err != nil {
+		return "", modifications, err
+	}
+	if len(offerModifications) > 0 {
+		merged := []KeyModification{}
+		for _, modification := range modifications {
+			if !modification.IsDelete {
+				merged = append(merged, modification)
+			}
+		}
+		merged = append(merged, offerModifications...)
+		sort.SliceStable(merged, func(i, j int) bool { return merged[i].Timestamp < merged[j].Timestamp })
+		return "marble_offer", merged, nil
+	}
+
+	return get_doc_type(modifications), modifications, nil
+}
+
+// ============================================================================================================================
+// Get Doc Type - docType of the latest value in a history, offers from before offers had a docType are found by status
+// ============================================================================================================================
+func get_doc_type(modifications []KeyModification) string {
+	for i := len(modifications) - 1; i >= 0; i-- {
+		if modifications[i].IsDelete {
+			continue
+		}
+		var probe struct {
+			ObjectType string `json:"docType"`
+			Status     string `json:"status"`
+		}
+		json.Unmarshal(modifications[i].Value, &probe) //un stringify it aka JSON.parse()
+		if len(probe.ObjectType) == 0 && len(probe.Status) > 0 {
+			return "marble_offer"
+		}
+		return probe.ObjectType
+	}
+	return ""
+}
+
+// ============================================================================================================================
+// Marble History - each write with who owned the marble before it
+// ============================================================================================================================
+func marble_history(modifications []KeyModification, options HistoryOptions) ([]interface{}, error) {
+	type MarbleHistory struct {
+		TxId          string         `json:"txId"`
+		Timestamp     int64          `json:"timestamp"` //tx timestamp in ms since epoch
+		IsDelete      bool           `json:"isDelete"`
+		Value         *Marble        `json:"value,omitempty"` //left out for the ownership view and deletes
+		Owner         *OwnerRelation `json:"owner"`           //owner after the tx, null once deleted
+		PreviousOwner *OwnerRelation `json:"previousOwner"`   //owner before the tx, null when created
+	}
+	history := []interface{}{}
+
+	var previousOwner *OwnerRelation
+	for _, modification := range modifications {
+		var tx MarbleHistory
+		tx.TxId = modification.TxId
+		tx.Timestamp = modification.Timestamp
+		tx.IsDelete = modification.IsDelete
+		tx.PreviousOwner = previousOwner
+		if !modification.IsDelete {
+			var marble Marble                           //fresh each time so a tx never shows an older tx's fields
+			json.Unmarshal(modification.Value, &marble) //un stringify it aka JSON.parse()
+			tx.Value = &marble
+			tx.Owner = &marble.Owner
+		}
+
+		ownerChanged := tx.Owner == nil || previousOwner == nil || tx.Owner.Id != previousOwner.Id
+		previousOwner = tx.Owner
+
+		if !options.in_range(tx.Timestamp) {
+			continue
+		}
+		if options.View == history_view_ownership {
+			if !ownerChanged {
+				continue
+			}
+			tx.Value = nil
+		}
+		history = append(history, tx)
+	}
+	return history, nil
+}
+
+// ============================================================================================================================
+// Owner History - each write with the fields it changed (username, company, enabled, accountId)
+// ============================================================================================================================
+func owner_history(modifications []KeyModification, options HistoryOptions) ([]interface{}, error) {
+	type OwnerHistory struct {
+		TxId      string   `json:"txId"`
+		Timestamp int64    `json:"timestamp"` //tx timestamp in ms since epoch
+		IsDelete  bool     `json:"isDelete"`
+		Value     *Owner   `json:"value"`   //null for deletes
+		Changed   []string `json:"changed"` //fields that differ from the previous write, all of them when created
+	}
+	history := []interface{}{}
+	if options.View == history_view_ownership {
+		return history, new_error(code_invalid_argument, "The ownership view is only for marbles")
+	}
+
+	var previous *Owner
+	for _, modification := range modifications {
+		var tx OwnerHistory
+		tx.TxId = modification.TxId
+		tx.Timestamp = modification.Timestamp
+		tx.IsDelete = modification.IsDelete
+		tx.Changed = []string{}
+		if !modification.IsDelete {
+			var owner Owner
+			json.Unmarshal(modification.Value, &owner) //un stringify it aka JSON.parse()
+			tx.Value = &owner
+			if previous == nil || previous.Username != owner.Username {
+				tx.Changed = append(tx.Changed, "username")
+			}
+			if previous == nil || previous.Company != owner.Company {
+				tx.Changed = append(tx.Changed, "company")
+			}
+			if previous == nil || previous.Enabled != owner.Enabled {
+				tx.Changed = append(tx.Changed, "enabled")
+			}
+			if previous == nil || previous.AccountId != owner.AccountId {
+				tx.Changed = append(tx.Changed, "accountId")
+			}
+		}
+		previous = tx.Value
+
+		if options.in_range(tx.Timestamp) {
+			history = append(history, tx)
+		}
+	}
+	return history, nil
+}
+
+// ============================================================================================================================
+// Offer History - each write with the status it moved the offer from and to
+// ============================================================================================================================
+func offer_history(modifications []KeyModification, options HistoryOptions) ([]interface{}, error) {
+	type OfferHistory struct {
+		TxId           string `json:"txId"`
+		Timestamp      int64  `json:"timestamp"` //tx timestamp in ms since epoch
+		IsDelete       bool   `json:"isDelete"`
+		Value          *Offer `json:"value"`          //null for deletes
+		Status         string `json:"status"`         //status after the tx
+		PreviousStatus string `json:"previousStatus"` //status before the tx, empty when made
+	}
+	history := []interface{}{}
+	if options.View == history_view_ownership {
+		return history, new_error(code_invalid_argument, "The ownership view is only for marbles")
+	}
+
+	previousStatus := ""
+	for _, modification := range modifications {
+		var tx OfferHistory
+		tx.TxId = modification.TxId
+		tx.Timestamp = modification.Timestamp
+		tx.IsDelete = modification.IsDelete
+		tx.PreviousStatus = previousStatus
+		if !modification.IsDelete {
+			var offer Offer
+			json.Unmarshal(modification.Value, &offer) //un stringify it aka JSON.parse()
+			tx.Value = &offer
+			tx.Status = offer.Status
+		}
+		previousStatus = tx.Status
+
+		if options.in_range(tx.Timestamp) {
+			history = append(history, tx)
+		}
+	}
+	return history, nil
+}
@@ -0,0 +1,251 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// enrollment certificate attributes we understand (add them with fabric-ca "--id.attrs")
+const company_attribute = "marbles.company" //company the caller acts for, e.g. "United Marbles"
+const role_attribute = "marbles.role"       //"admin" lets the caller change chaincode settings
+
+// roles, the value of the role attribute
+const role_admin = "admin"
+
+// ledger keys for identity settings
+const auth_mode_key = "auth_mode"             //see auth modes below
+const msp_company_map_key = "msp_company_map" //json map of MSP ID -> company name
+
+// auth modes
+const auth_mode_migration = "migration" //certificate company wins, fall back to the authed_by_company argument if cert has none
+const auth_mode_strict = "strict"       //certificate company only, the authed_by_company argument is ignored
+
+// ----- Caller ----- //
+type CallerIdentity struct {
+	MspId   string `json:"mspId"`
+	Company string `json:"company"` //empty if the certificate does not map to a company
+	Role    string `json:"role"`
+}
+
+// ============================================================================================================================
+// Get Caller Identity - read the invoker's MSP ID and enrollment attributes from the client identity
+//
+// The company comes from the "marbles.company" attribute, if the cert does not have one
+// we try the MSP ID -> company map stored on the ledger by set_msp_company()
+// ============================================================================================================================
+func get_caller_identity(stub shim.ChaincodeStubInterface) (CallerIdentity, error) {
+	var identity CallerIdentity
+	var err error
+
+	identity.MspId, err = cid.GetMSPID(stub)
+	if err != nil {
+		return identity, new_error(code_not_authorized, "Failed to get the caller's MSP ID - "+err.Error())
+	}
+
+	company, found, err := cid.GetAttributeValue(stub, company_attribute)
+	if err != nil {
+		return identity, new_error(code_not_authorized, "Failed to read attribute '"+company_attribute+"' - "+err.Error())
+	}
+	if found && len(company) > 0 {
+		identity.Company = company
+	} else {
+		companies, err := get_msp_companies(stub)
+		if err != nil {
+			return identity, err
+		}
+		identity.Company = companies[identity.MspId]
+	}
+
+	role, found, err := cid.GetAttributeValue(stub, role_attribute)
+	if err != nil {
+		return identity, new_error(code_not_authorized, "Failed to read attribute '"+role_attribute+"' - "+err.Error())
+	}
+	if found {
+		identity.Role = role
+	}
+
+	return identity, nil
+}
+
+// ============================================================================================================================
+// Get Auth Mode - get the auth mode from ledger, an unset mode means we are still in the migration window
+// ============================================================================================================================
+func get_auth_mode(stub shim.ChaincodeStubInterface) (string, error) {
+	modeAsBytes, err := stub.GetState(auth_mode_key)
+	if err != nil {
+		return "", new_error(code_ledger_error, "Failed to get auth mode")
+	}
+	if len(modeAsBytes) == 0 {
+		return auth_mode_migration, nil
+	}
+	return string(modeAsBytes), nil
+}
+
+// ============================================================================================================================
+// Get MSP Companies - get the MSP ID -> company map from ledger
+// ============================================================================================================================
+func get_msp_companies(stub shim.ChaincodeStubInterface) (map[string]string, error) {
+	companies := map[string]string{}
+	mapAsBytes, err := stub.GetState(msp_company_map_key)
+	if err != nil {
+		return companies, new_error(code_ledger_error, "Failed to get the MSP company map")
+	}
+	if len(mapAsBytes) > 0 {
+		err = json.Unmarshal(mapAsBytes, &companies) //un stringify it aka JSON.parse()
+		if err != nil {
+			return companies, new_error(code_record_invalid, "The MSP company map is corrupt - "+err.Error())
+		}
+	}
+	return companies, nil
+}
+
+// ============================================================================================================================
+// Get Caller Company - figure out which company the caller is acting for
+//
+// During the migration window the authed_by_company argument from older clients is still accepted,
+// but if the certificate carries a company the argument has to agree with it.
+// In strict mode the argument is ignored and only the certificate counts.
+// ============================================================================================================================
+func get_caller_company(stub shim.ChaincodeStubInterface, authed_by_company string) (string, error) {
+	identity, err := get_caller_identity(stub)
+	if err != nil {
+		return "", err
+	}
+
+	mode, err := get_auth_mode(stub)
+	if err != nil {
+		return "", err
+	}
+
+	if mode == auth_mode_strict {
+		if len(identity.Company) == 0 {
+			return "", new_error(code_not_authorized, "The caller's certificate (MSP '"+identity.MspId+"') is not mapped to a company")
+		}
+		return identity.Company, nil
+	}
+
+	// migration mode
+	if len(identity.Company) == 0 {
+		fmt.Println("- caller's certificate has no company, trusting argument '" + authed_by_company + "'")
+		return authed_by_company, nil
+	}
+	if len(authed_by_company) > 0 && authed_by_company != identity.Company {
+		return "", new_error(code_not_authorized, "The company '"+authed_by_company+"' does not match the caller's certificate company '"+identity.Company+"'")
+	}
+	return identity.Company, nil
+}
+
+// ============================================================================================================================
+// Check Company - make sure the caller acts for the company that owns the asset
+//
+// Inputs - authed_by_company argument (legacy), company the asset belongs to, action for the error message
+// ============================================================================================================================
+func check_company(stub shim.ChaincodeStubInterface, authed_by_company string, required_company string, action string) error {
+	company, err := get_caller_company(stub, authed_by_company)
+	if err != nil {
+		return err
+	}
+	if company != required_company {
+		return new_error(code_not_authorized, "The company '"+company+"' cannot authorize "+action+" for '"+required_company+"'.")
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// Check Role - error unless the caller's certificate has this role
+// ============================================================================================================================
+func check_role(stub shim.ChaincodeStubInterface, role string) error {
+	identity, err := get_caller_identity(stub)
+	if err != nil {
+		return err
+	}
+	if identity.Role != role {
+		return new_error(code_not_authorized, "This operation requires the '"+role_attribute+"="+role+"' certificate attribute")
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// Set Auth Mode - switch between the migration window and strict certificate checks (admin only)
+//
+// Inputs - Array of Strings
+//       0
+//     mode
+//  "strict"
+// ============================================================================================================================
+func set_auth_mode(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting set_auth_mode")
+
+	if len(args) != 1 {
+		return new_error_response(code_invalid_argument, "Incorrect number of arguments. Expecting 1")
+	}
+
+	mode := args[0]
+	if mode != auth_mode_migration && mode != auth_mode_strict {
+		return new_error_response(code_invalid_argument, "Auth mode must be '"+auth_mode_migration+"' or '"+auth_mode_strict+"'")
+	}
+
+	err = stub.PutState(auth_mode_key, []byte(mode))
+	if err != nil {
+		return error_response(err, code_ledger_error)
+	}
+
+	fmt.Println("- end set_auth_mode")
+	return success_response("Auth mode is " + mode)
+}
+
+// ============================================================================================================================
+// Set MSP Company - map an MSP ID to a company for certificates without the company attribute (admin only)
+//
+// Inputs - Array of Strings
+//       0     ,        1
+//    msp id   ,     company
+//  "Org1MSP"  , "United Marbles"
+// ============================================================================================================================
+func set_msp_company(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting set_msp_company")
+
+	if len(args) != 2 {
+		return new_error_response(code_invalid_argument, "Incorrect number of arguments. Expecting 2")
+	}
+
+	companies, err := get_msp_companies(stub)
+	if err != nil {
+		return error_response(err, code_ledger_error)
+	}
+	companies[args[0]] = args[1]
+
+	mapAsBytes, _ := json.Marshal(companies) //convert to array of bytes
+	err = stub.PutState(msp_company_map_key, mapAsBytes)
+	if err != nil {
+		return error_response(err, code_ledger_error)
+	}
+
+	fmt.Println("- end set_msp_company")
+	return success_response("Mapped MSP " + args[0] + " to " + args[1])
+}
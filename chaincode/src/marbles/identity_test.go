@@ -0,0 +1,53 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"testing"
+)
+
+func TestInitOwnerNeedsTheCompany(t *testing.T) {
+	stub := new_test_stub(t)
+	stub.as(seller_company, "")
+	stub.expect_code(code_not_authorized, "init_owner", "o2", "bob", buyer_company, test_account(2))
+	stub.must("init_owner", "o1", "alice", seller_company, test_account(1))
+
+	// a certificate without a company still falls back to the argument during the migration window
+	stub.as("", "")
+	stub.must("init_owner", "o2", "bob", buyer_company, test_account(2))
+}
+
+func TestStrictModeIgnoresTheCompanyArgument(t *testing.T) {
+	stub := new_market(t)
+	stub.must("set_auth_mode", auth_mode_strict)
+
+	// the certificate decides, the argument can be left empty
+	stub.as_seller()
+	stub.must("mark_for_sale", "m1", "", "120")
+	stub.as_buyer()
+	stub.expect_code(code_not_authorized, "mark_for_sale", "m1", seller_company, "130")
+
+	// a certificate without a company can't act at all
+	stub.as("", "")
+	stub.expect_code(code_not_authorized, "mark_for_sale", "m1", seller_company, "130")
+	if marble := stub.marble("m1"); marble.MinPrice != 120 {
+		t.Fatalf("Only the seller's change should stick, got %+v", marble)
+	}
+}
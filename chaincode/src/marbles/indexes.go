@@ -0,0 +1,225 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ============================================================================================================================
+// Marble Indexes
+//
+// Composite keys like "owner~marble" + [owner id, marble id] let us find marbles with a partial key lookup
+// instead of scanning every marble. The index entry's value is never read, only its key matters.
+// Any writer that changes a marble's owner, company or color has to remove the old entries and add the new ones.
+// ============================================================================================================================
+const owner_marble_index = "owner~marble"
+const company_marble_index = "company~marble"
+const color_marble_index = "color~marble"
+
+// ============================================================================================================================
+// Marble Index Keys - the composite keys that index this marble
+// ============================================================================================================================
+func marble_index_keys(stub shim.ChaincodeStubInterface, marble Marble) ([]string, error) {
+	var keys []string
+	attributes := map[string]string{
+		owner_marble_index:   marble.Owner.Id,
+		company_marble_index: marble.Owner.Company,
+		color_marble_index:   marble.Color,
+	}
+	for _, index := range []string{owner_marble_index, company_marble_index, color_marble_index} {
+		key, err := stub.CreateCompositeKey(index, []string{attributes[index], marble.Id})
+		if err != nil {
+			return keys, new_error(code_ledger_error, "Failed to create "+index+" key for marble "+marble.Id+" - "+err.Error())
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// ============================================================================================================================
+// Add Marble Indexes - write the index entries for a marble
+// ============================================================================================================================
+func add_marble_indexes(stub shim.ChaincodeStubInterface, marble Marble) error {
+	keys, err := marble_index_keys(stub, marble)
+	if err != nil {
+		return err
+	}
+	value := []byte{0x00} //couchdb can't store a nil value
+	for _, key := range keys {
+		err = stub.PutState(key, value)
+		if err != nil {
+			return new_error(code_ledger_error, "Failed to index marble "+marble.Id)
+		}
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// Remove Marble Indexes - delete the index entries for a marble, pass the marble as it was before the change
+// ============================================================================================================================
+func remove_marble_indexes(stub shim.ChaincodeStubInterface, marble Marble) error {
+	keys, err := marble_index_keys(stub, marble)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		err = stub.DelState(key)
+		if err != nil {
+			return new_error(code_ledger_error, "Failed to remove index for marble "+marble.Id)
+		}
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// Get Marbles By Index - get the marbles under one value of an index, e.g. every marble of owner "o123"
+// ============================================================================================================================
+func get_marbles_by_index(stub shim.ChaincodeStubInterface, index string, value string) ([]Marble, error) {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(index, []string{value})
+	if err != nil {
+		return []Marble{}, err
+	}
+	defer resultsIterator.Close()
+	return collect_indexed_marbles(stub, resultsIterator, index)
+}
+
+// ============================================================================================================================
+// Get Marbles By Index With Pagination - one page of get_marbles_by_index()
+// ============================================================================================================================
+func get_marbles_by_index_with_pagination(stub shim.ChaincodeStubInterface, index string, value string, pageSize int32, bookmark string) ([]Marble, *pb.QueryResponseMetadata, error) {
+	resultsIterator, metadata, err := stub.GetStateByPartialCompositeKeyWithPagination(index, []string{value}, pageSize, bookmark)
+	if err != nil {
+		return []Marble{}, nil, err
+	}
+	defer resultsIterator.Close()
+	marbles, err := collect_indexed_marbles(stub, resultsIterator, index)
+	return marbles, metadata, err
+}
+
+// ============================================================================================================================
+// Collect Indexed Marbles - read the marbles an iterator over index entries points at
+// ============================================================================================================================
+func collect_indexed_marbles(stub shim.ChaincodeStubInterface, resultsIterator shim.StateQueryIteratorInterface, index string) ([]Marble, error) {
+	marbles := []Marble{}
+	for resultsIterator.HasNext() {
+		aKeyValue, err := resultsIterator.Next()
+		if err != nil {
+			return marbles, err
+		}
+		_, attributes, err := stub.SplitCompositeKey(aKeyValue.Key)
+		if err != nil || len(attributes) != 2 {
+			return marbles, new_error(code_record_invalid, "Bad "+index+" index entry - "+aKeyValue.Key)
+		}
+		marble, err := get_marble(stub, attributes[1])
+		if err != nil {
+			fmt.Println("- skipping stale " + index + " entry for " + attributes[1])
+			continue
+		}
+		marbles = append(marbles, marble)
+	}
+	return marbles, nil
+}
+
+// most marbles one reindex_marbles() call visits, like a migrate() batch
+const max_reindex_batch = max_migration_batch
+
+// ----- Reindex Report ----- //
+type ReindexReport struct {
+	ResponseEnvelope        //status, code and message like any other write
+	Scanned          int    `json:"scanned"`   //marbles visited in this batch
+	Reindexed        int    `json:"reindexed"` //marbles whose index entries were written
+	Bookmark         string `json:"bookmark"`  //pass to the next batch, empty once every marble was visited
+}
+
+// ============================================================================================================================
+// Reindex Marbles - (re)build the index entries for a batch of marbles, for marbles created before the indexes existed (admin only)
+//
+// Call it again with the bookmark it returns until the bookmark comes back empty. Pagination queries can't be
+// used in a transaction that writes, so a batch is a plain range query from the bookmark that stops after
+// batch size marbles, the bookmark is the marble the next batch starts at.
+//
+// Inputs - Array of strings
+//      0     ,    1
+//  batch size, bookmark
+//     "50"   ,    ""
+// ============================================================================================================================
+func reindex_marbles(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting reindex_marbles")
+
+	batchSize, bookmark, err := parse_page_args(args)
+	if err != nil {
+		return error_response(err, code_invalid_argument)
+	}
+	if batchSize > max_reindex_batch {
+		return new_error_response(code_invalid_argument, "Batch size must be at most "+strconv.Itoa(max_reindex_batch))
+	}
+
+	startKey := "m0"
+	endKey := "m9999999999999999999"
+	if len(bookmark) > 0 {
+		if bookmark < startKey || bookmark >= endKey {
+			return new_error_response(code_invalid_argument, "Bookmark is not from reindex_marbles")
+		}
+		startKey = bookmark
+	}
+
+	resultsIterator, err := stub.GetStateByRange(startKey, endKey)
+	if err != nil {
+		return error_response(err, code_ledger_error)
+	}
+	defer resultsIterator.Close()
+
+	var report ReindexReport
+	for resultsIterator.HasNext() {
+		aKeyValue, err := resultsIterator.Next()
+		if err != nil {
+			return error_response(err, code_ledger_error)
+		}
+		if report.Scanned == int(batchSize) {
+			report.Bookmark = aKeyValue.Key //the next batch starts here
+			break
+		}
+		report.Scanned++
+
+		marble, err := get_marble(stub, aKeyValue.Key)
+		if err != nil {
+			fmt.Println("- skipping " + aKeyValue.Key + " - " + err.Error())
+			continue
+		}
+		err = add_marble_indexes(stub, marble)
+		if err != nil {
+			return error_response(err, code_ledger_error)
+		}
+		report.Reindexed++
+	}
+
+	report.Status = status_ok
+	report.Code = code_ok
+	report.Message = "Reindexed " + strconv.Itoa(report.Reindexed) + " of " + strconv.Itoa(report.Scanned) + " marbles"
+	fmt.Println("- end reindex_marbles, " + report.Message)
+	reportAsBytes, _ := json.Marshal(report) //convert to array of bytes
+	return shim.Success(reportAsBytes)
+}
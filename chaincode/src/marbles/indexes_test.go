@@ -0,0 +1,63 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"testing"
+)
+
+func TestReindexMarblesInBatches(t *testing.T) {
+	stub := new_test_stub(t)
+	for i := 10; i < 22; i++ {
+		stub.put_fixture("m"+strconv.Itoa(i), fmt.Sprintf(`{"docType":"marble","schemaVersion":%d,"id":"m%d","color":"blue","size":35,"owner":{"id":"o1","username":"alice","company":"United Marbles"}}`, schema_version, i))
+	}
+	stub.expect_code(code_invalid_argument, "reindex_marbles", strconv.Itoa(max_reindex_batch+1), "")
+	stub.expect_code(code_invalid_argument, "reindex_marbles", "5", "m99999999999999999999")
+
+	// each batch carries on where the last one stopped
+	batches, reindexed := 0, 0
+	bookmark := ""
+	for batches < 10 {
+		var report ReindexReport
+		json.Unmarshal(stub.must("reindex_marbles", "5", bookmark).Payload, &report)
+		batches++
+		reindexed += report.Reindexed
+		if report.Scanned > 5 {
+			t.Fatalf("Batch %d visited %d marbles, expected at most 5", batches, report.Scanned)
+		}
+		if bookmark = report.Bookmark; len(bookmark) == 0 {
+			break
+		}
+	}
+	if batches != 3 || reindexed != 12 {
+		t.Fatalf("Expected 12 marbles reindexed in 3 batches, got %d in %d", reindexed, batches)
+	}
+
+	var page struct {
+		Records []Marble `json:"records"`
+	}
+	json.Unmarshal(stub.must("getMarblesByOwnerWithPagination", "o1", "25", "").Payload, &page)
+	if len(page.Records) != 12 {
+		t.Fatalf("Every marble should be found by its owner, got %d", len(page.Records))
+	}
+}
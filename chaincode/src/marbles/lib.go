@@ -20,19 +20,9 @@ under the License.
 package main
 
 import (
-	"encoding/json"
-	"errors"
-	"net/http"
-	"strconv"
-
-	"github.com/stellar/go/clients/horizon"
-	hProtocol "github.com/stellar/go/protocols/horizon"
-
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 )
 
-const stellar_base_URL = "https://horizon-testnet.stellar.org/transactions/"
-
 // ============================================================================================================================
 // Get Marble - get a marble asset from ledger
 // ============================================================================================================================
@@ -40,15 +30,50 @@ func get_marble(stub shim.ChaincodeStubInterface, id string) (Marble, error) {
 	var marble Marble
 	marbleAsBytes, err := stub.GetState(id) //getState retreives a key/value from the ledger
 	if err != nil {                         //this seems to always succeed, even if key didn't exist
-		return marble, errors.New("Failed to find marble - " + id)
+		return marble, new_error(code_ledger_error, "Failed to find marble - "+id)
+	}
+	if len(marbleAsBytes) == 0 {
+		return marble, new_error(code_marble_not_found, "Marble does not exist - "+id)
+	}
+	err = unmarshal_record(id, marbleAsBytes, &marble)
+	if err != nil {
+		return marble, err
 	}
-	json.Unmarshal(marbleAsBytes, &marble) //un stringify it aka JSON.parse()
 
-	if marble.Id != id { //test if marble is actually here or just nil
-		return marble, errors.New("Marble does not exist - " + id)
+	if marble.Id != id || marble.ObjectType != "marble" { //test if marble is actually here or something else is
+		return marble, new_error(code_marble_not_found, "Marble does not exist - "+id)
+	}
+
+	return marble, check_record(id, marble)
+}
+
+// ============================================================================================================================
+// Put Marble - store a marble in ledger
+// ============================================================================================================================
+func put_marble(stub shim.ChaincodeStubInterface, marble Marble) error {
+	marble.SchemaVersion = schema_version
+	marbleAsBytes, err := marshal_record(marble.Id, marble) //convert to array of bytes
+	if err != nil {
+		return err
 	}
+	err = stub.PutState(marble.Id, marbleAsBytes)
+	if err != nil {
+		return new_error(code_ledger_error, "Could not store marble - "+marble.Id)
+	}
+	return nil
+}
 
-	return marble, nil
+// ============================================================================================================================
+// Transfer Marble - give the marble to a new owner, a marble that changes hands is no longer for sale
+//
+// Does not write the marble, use put_marble() after
+// ============================================================================================================================
+func transfer_marble(marble *Marble, owner Owner) {
+	marble.Owner.Id = owner.Id
+	marble.Owner.Username = owner.Username
+	marble.Owner.Company = owner.Company
+	marble.IsForSale = false
+	marble.MinPrice = 0
 }
 
 // ============================================================================================================================
@@ -58,82 +83,109 @@ func get_owner(stub shim.ChaincodeStubInterface, id string) (Owner, error) {
 	var owner Owner
 	ownerAsBytes, err := stub.GetState(id) //getState retreives a key/value from the ledger
 	if err != nil {                        //this seems to always succeed, even if key didn't exist
-		return owner, errors.New("Failed to get owner - " + id)
+		return owner, new_error(code_ledger_error, "Failed to get owner - "+id)
+	}
+	if len(ownerAsBytes) == 0 {
+		return owner, new_error(code_owner_not_found, "Owner does not exist - "+id)
+	}
+	err = unmarshal_record(id, ownerAsBytes, &owner)
+	if err != nil {
+		return owner, err
 	}
-	json.Unmarshal(ownerAsBytes, &owner) //un stringify it aka JSON.parse()
 
-	if len(owner.Username) == 0 { //test if owner is actually here or just nil
-		return owner, errors.New("Owner does not exist - " + id + ", '" + owner.Username + "' '" + owner.Company + "'")
+	if owner.Id != id || owner.ObjectType != "marble_owner" { //test if owner is actually here or something else is
+		return owner, new_error(code_owner_not_found, "Owner does not exist - "+id)
 	}
 
-	return owner, nil
+	return owner, check_record(id, owner)
 }
 
-// ========================================================
-// Input Sanitation - dumb input checking, look for empty strings
-// ========================================================
-func sanitize_arguments(strs []string) error {
-	for i, val := range strs {
-		if len(val) <= 0 {
-			return errors.New("Argument " + strconv.Itoa(i) + " must be a non-empty string")
-		}
-		if len(val) > 32 {
-			return errors.New("Argument " + strconv.Itoa(i) + " must be <= 32 characters")
-		}
+// ============================================================================================================================
+// Put Owner - store an owner in ledger
+// ============================================================================================================================
+func put_owner(stub shim.ChaincodeStubInterface, owner Owner) error {
+	owner.SchemaVersion = schema_version
+	ownerAsBytes, err := marshal_record(owner.Id, owner) //convert to array of bytes
+	if err != nil {
+		return err
+	}
+	err = stub.PutState(owner.Id, ownerAsBytes)
+	if err != nil {
+		return new_error(code_ledger_error, "Could not store owner - "+owner.Id)
 	}
 	return nil
 }
 
-// Invoke Stellar APIs to check if payment has been made
-func is_payment_done_for_offer(offer *Offer, accountId, stellar_transaction_id string) (bool, error) {
-
-	var payment horizon.Payment
+// ============================================================================================================================
+// Offer Key - offers live in their own "offer" composite key namespace so they can never overwrite a marble or owner
+// ============================================================================================================================
+func offer_key(stub shim.ChaincodeStubInterface, id string) (string, error) {
+	return stub.CreateCompositeKey("offer", []string{id})
+}
 
-	resp, err := http.Get(stellar_base_URL + stellar_transaction_id + "/payments?limit=1")
+// ============================================================================================================================
+// Get Offer - get an offer asset from ledger
+//
+// Offers made before the offer namespace existed were stored under their plain id, we still read those
+// ============================================================================================================================
+func get_offer(stub shim.ChaincodeStubInterface, id string) (Offer, error) {
+	var offer Offer
+	key, err := offer_key(stub, id)
 	if err != nil {
-		return false, errors.New(" error getting payment details from stellar. Please try again later")
+		return offer, err
 	}
-
-	decodeResponse(resp, &payment)
-	paymentAmount, err := strconv.Atoi(payment.Amount) // payment has from, to and amount details
-	if err != nil {
-		return false, errors.New("Unable to parse amount in payment")
+	offerAsBytes, err := stub.GetState(key) //getState retreives a key/value from the ledger
+	if err != nil {                         //this seems to always succeed, even if key didn't exist
+		return offer, new_error(code_ledger_error, "Failed to find offer - "+id)
 	}
-
-	resp, err = http.Get(stellar_base_URL + stellar_transaction_id)
+	if len(offerAsBytes) == 0 { //try the legacy key
+		offerAsBytes, err = stub.GetState(id)
+		if err != nil {
+			return offer, new_error(code_ledger_error, "Failed to find offer - "+id)
+		}
+	}
+	if len(offerAsBytes) == 0 {
+		return offer, new_error(code_offer_not_found, "Offer does not exist - "+id)
+	}
+	err = unmarshal_record(id, offerAsBytes, &offer)
 	if err != nil {
-		return false, errors.New(" error getting transaction details from stellar. Please try again later")
+		return offer, err
 	}
 
-	var transaction hProtocol.Transaction
-	decodeResponse(resp, &transaction) // transaction has Memo. Memo is set to offerId so that payment can be linked to offer.
-
-	if payment.To == accountId && paymentAmount == offer.OfferPrice && transaction.MemoType == "text" && transaction.Memo == offer.Id {
-		return true, nil
-	} else {
-		return false, nil
+	if offer.Id != id || len(offer.Status) == 0 { //test if offer is actually here or something else is
+		return offer, new_error(code_offer_not_found, "Offer does not exist - "+id)
 	}
 
+	return offer, check_record(id, offer)
 }
 
-func decodeResponse(resp *http.Response, object interface{}) (err error) {
-	defer resp.Body.Close()
-	decoder := json.NewDecoder(resp.Body)
-
-	if !(resp.StatusCode >= 200 && resp.StatusCode < 300) {
-		horizonError := &horizon.Error{
-			Response: resp,
+// ============================================================================================================================
+// Check Offer Id Unused - error if an offer, or any other asset, already has this id
+// ============================================================================================================================
+func check_offer_id_unused(stub shim.ChaincodeStubInterface, id string) error {
+	key, err := offer_key(stub, id)
+	if err != nil {
+		return err
+	}
+	for _, k := range []string{key, id} {
+		valAsBytes, err := stub.GetState(k)
+		if err != nil {
+			return new_error(code_ledger_error, "Failed to check offer id - "+id)
 		}
-		decodeError := decoder.Decode(&horizonError.Problem)
-		if decodeError != nil {
-			return decodeError
+		if len(valAsBytes) > 0 {
+			return new_error(code_offer_exists, "This id is already in use - "+id)
 		}
-		return horizonError
 	}
+	return nil
+}
 
-	err = decoder.Decode(&object)
+// ============================================================================================================================
+// Get Tx Timestamp - get the proposal's timestamp in ms since epoch, it is the same on every endorsing peer
+// ============================================================================================================================
+func get_tx_timestamp(stub shim.ChaincodeStubInterface) (int64, error) {
+	timestamp, err := stub.GetTxTimestamp()
 	if err != nil {
-		return
+		return 0, new_error(code_ledger_error, "Failed to get tx timestamp - "+err.Error())
 	}
-	return
+	return timestamp.Seconds*1000 + int64(timestamp.Nanos)/1000000, nil
 }
@@ -37,23 +37,32 @@ type SimpleChaincode struct {
 
 // ----- Marbles ----- //
 type Marble struct {
-	ObjectType string        `json:"docType"` //field for couchdb
-	Id         string        `json:"id"`      //the fieldtags are needed to keep case from bouncing around
-	Color      string        `json:"color"`
-	Size       int           `json:"size"` //size in mm of marble
-	Owner      OwnerRelation `json:"owner"`
-	MinPrice   int           `json:"minPrice"`
-	IsForSale  bool          `json:"isForSale"`
+	ObjectType    string        `json:"docType"`       //field for couchdb
+	SchemaVersion int           `json:"schemaVersion"` //see schema.go
+	Id            string        `json:"id"`            //the fieldtags are needed to keep case from bouncing around
+	Color         string        `json:"color"`
+	Size          int           `json:"size"` //size in mm of marble
+	Owner         OwnerRelation `json:"owner"`
+	MinPrice      int           `json:"minPrice"`
+	IsForSale     bool          `json:"isForSale"`
+	Escrow        *EscrowLock   `json:"escrow,omitempty"` //set while an accepted offer is waiting on payment
+}
+
+type EscrowLock struct {
+	OfferId  string `json:"offerId"`  //the accepted offer holding the lock
+	TxId     string `json:"txId"`     //tx that took the lock
+	LockedAt int64  `json:"lockedAt"` //tx timestamp in ms since epoch
 }
 
 // ----- Owners ----- //
 type Owner struct {
-	ObjectType string `json:"docType"` //field for couchdb
-	Id         string `json:"id"`
-	Username   string `json:"username"`
-	Company    string `json:"company"`
-	Enabled    bool   `json:"enabled"`  //disabled owners will not be visible to the application
-	AccountId  string `json:"accountId` //stellar account address
+	ObjectType    string `json:"docType"`       //field for couchdb
+	SchemaVersion int    `json:"schemaVersion"` //see schema.go
+	Id            string `json:"id"`
+	Username      string `json:"username"`
+	Company       string `json:"company"`
+	Enabled       bool   `json:"enabled"`   //disabled owners will not be visible to the application
+	AccountId     string `json:"accountId"` //stellar account address
 }
 
 type OwnerRelation struct {
@@ -63,11 +72,19 @@ type OwnerRelation struct {
 }
 
 type Offer struct {
-	Id         string `json:"id"`
-	Marble     Marble `json:"marble"`     //marble
-	OfferPrice int    `json:"offerPrice"` //
-	Buyer      Owner  `json:"buyer"`
-	Status     string `json:"status"`
+	ObjectType    string              `json:"docType"`       //field for couchdb
+	SchemaVersion int                 `json:"schemaVersion"` //see schema.go
+	Id            string              `json:"id"`
+	Marble        Marble              `json:"marble"`     //marble
+	OfferPrice    int                 `json:"offerPrice"` //whole units of Asset
+	Asset         PaymentAsset        `json:"asset"`      //stellar asset the buyer has to pay in
+	Buyer         Owner               `json:"buyer"`
+	Status        string              `json:"status"`        //see offers.go for the lifecycle
+	TxId          string              `json:"txId"`          //tx of the last status change
+	UpdatedAt     int64               `json:"updatedAt"`     //tx timestamp of the last status change, ms since epoch
+	ExpiresAt     int64               `json:"expiresAt"`     //ms since epoch, it can be expired from then on
+	StatusHistory []OfferStatusChange `json:"statusHistory"` //every status the offer went through
+	PaymentRef    string              `json:"paymentRef"`    //stellar tx hash that paid for it, once settled
 }
 
 // ============================================================================================================================
@@ -90,7 +107,8 @@ func main() {
 // Shows off GetTxID() to get the transaction ID of the proposal
 //
 // Inputs - Array of strings
-//  ["314"]
+//
+//	["314"]
 //
 // Returns - shim.Success or error
 // ============================================================================================================================
@@ -120,14 +138,14 @@ func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 			// convert numeric string to integer
 			number, err = strconv.Atoi(args[0])
 			if err != nil {
-				return shim.Error("Expecting a numeric string argument to Init() for instantiate")
+				return new_error_response(code_invalid_argument, "Expecting a numeric string argument to Init() for instantiate")
 			}
 
 			// this is a very simple test. let's write to the ledger and error out on any errors
 			// it's handy to read this right away to verify network is healthy if it wrote the correct value
 			err = stub.PutState("selftest", []byte(strconv.Itoa(number)))
 			if err != nil {
-				return shim.Error(err.Error()) //self-test fail
+				return error_response(err, code_ledger_error) //self-test fail
 			}
 		}
 	}
@@ -140,7 +158,23 @@ func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 	// store compatible marbles application version
 	err = stub.PutState("marbles_ui", []byte("4.0.1"))
 	if err != nil {
-		return shim.Error(err.Error())
+		return error_response(err, code_ledger_error)
+	}
+
+	// store our schema version, documents are not touched here - old ones are upgraded when read or by migrate()
+	// (see migrations.go), so this is safe on a channel full of marbles. Going back to an older schema is not.
+	storedAsBytes, err := stub.GetState(schema_version_key)
+	if err != nil {
+		return error_response(err, code_ledger_error)
+	}
+	stored, _ := strconv.Atoi(string(storedAsBytes))
+	if stored > schema_version {
+		return new_error_response(code_record_invalid, "The channel is at schema version "+string(storedAsBytes)+", this chaincode only reads up to "+strconv.Itoa(schema_version))
+	}
+	fmt.Println("  schema version", stored, "->", schema_version)
+	err = stub.PutState(schema_version_key, []byte(strconv.Itoa(schema_version)))
+	if err != nil {
+		return error_response(err, code_ledger_error)
 	}
 
 	fmt.Println("Ready for action") //self-test pass
@@ -149,53 +183,29 @@ func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 
 // ============================================================================================================================
 // Invoke - Our entry point for Invocations
+//
+// Functions are looked up in the function registry, call "describe" for the list
 // ============================================================================================================================
 func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 	function, args := stub.GetFunctionAndParameters()
 	fmt.Println(" ")
 	fmt.Println("starting invoke, for - " + function)
-
-	// Handle different functions
-	if function == "init" { //initialize the chaincode state, used as reset
-		return t.Init(stub)
-	} else if function == "read" { //generic read ledger
-		return read(stub, args)
-	} else if function == "write" { //generic writes to ledger
-		return write(stub, args)
-	} else if function == "delete_marble" { //deletes a marble from state
-		return delete_marble(stub, args)
-	} else if function == "init_marble" { //create a new marble
-		return init_marble(stub, args)
-	} else if function == "set_owner" { //change owner of a marble
-		return set_owner(stub, args)
-	} else if function == "init_owner" { //create a new marble owner
-		return init_owner(stub, args)
-	} else if function == "read_everything" { //read everything, (owners + marbles + companies)
-		return read_everything(stub)
-	} else if function == "getHistory" { //read history of a marble (audit)
-		return getHistory(stub, args)
-	} else if function == "getMarblesByRange" { //read a bunch of marbles by start and stop id
-		return getMarblesByRange(stub, args)
-	} else if function == "disable_owner" { //disable a marble owner from appearing on the UI
-		return disable_owner(stub, args)
-	} else if function == "mark_for_sale" {
-		return mark_for_sale(stub, args)
-	} else if function == "make_offer" {
-		return make_offer(stub, args)
-	} else if function == "accept_offer" {
-		return accept_offer(stub, args)
-	} else if function == "payment_complete_against_offer" {
-		return payment_complete_against_offer(stub, args)
+	eventStub := new_event_stub(stub) //collects this invocation's events, see events.go
+
+	// Handle different functions, see registry.go
+	res := call_function(eventStub, function, args)
+	if res.Status < shim.ERRORTHRESHOLD {
+		err := set_events(eventStub)
+		if err != nil {
+			return error_response(err, code_ledger_error)
+		}
 	}
-
-	// error out
-	fmt.Println("Received unknown invoke function name - " + function)
-	return shim.Error("Received unknown invoke function name - '" + function + "'")
+	return res
 }
 
 // ============================================================================================================================
 // Query - legacy function
 // ============================================================================================================================
 func (t *SimpleChaincode) Query(stub shim.ChaincodeStubInterface) pb.Response {
-	return shim.Error("Unknown supported call - Query()")
+	return new_error_response(code_unknown_function, "Unknown supported call - Query()")
 }
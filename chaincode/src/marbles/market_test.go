@@ -0,0 +1,106 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+const seller_company = "United Marbles"
+const buyer_company = "Marble Mart"
+const test_rail = "memory_test"
+
+var test_payments = &MemoryPaymentVerifier{Payments: map[string]MemoryPayment{}}
+
+func init() {
+	register_payment_verifier(test_rail, test_payments)
+}
+
+// ============================================================================================================================
+// New Market - seller o1 of United Marbles has marbles m1 and m2 on sale from 100, buyers o2 and o3 are with Marble Mart
+// ============================================================================================================================
+func new_market(t *testing.T) *TestStub {
+	stub := new_test_stub(t)
+	stub.must("set_payment_rail", test_rail)
+	stub.must("init_owner", "o1", "alice", seller_company, test_account(1))
+	stub.as_buyer()
+	stub.must("init_owner", "o2", "bob", buyer_company, test_account(2))
+	stub.must("init_owner", "o3", "carol", buyer_company, test_account(3))
+	stub.as(seller_company, role_admin)
+	for _, id := range []string{"m1", "m2"} {
+		stub.must("init_marble", id, "blue", "35", "o1", seller_company)
+		stub.must("mark_for_sale", id, seller_company, "100")
+	}
+	return stub
+}
+
+func (stub *TestStub) as_seller() {
+	stub.as(seller_company, "")
+}
+
+func (stub *TestStub) as_buyer() {
+	stub.as(buyer_company, "")
+}
+
+// the offer as committed
+func (stub *TestStub) offer(id string) Offer {
+	stub.t.Helper()
+	offer, err := get_offer(stub, id)
+	if err != nil {
+		stub.t.Fatalf("Could not read offer %s - %s", id, err)
+	}
+	return offer
+}
+
+// the marble as committed
+func (stub *TestStub) marble(id string) Marble {
+	stub.t.Helper()
+	marble, err := get_marble(stub, id)
+	if err != nil {
+		stub.t.Fatalf("Could not read marble %s - %s", id, err)
+	}
+	return marble
+}
+
+func (stub *TestStub) expect_status(offer_id string, status string) {
+	stub.t.Helper()
+	if offer := stub.offer(offer_id); offer.Status != status {
+		stub.t.Fatalf("Offer %s is %s, expected %s", offer_id, offer.Status, status)
+	}
+}
+
+// make offer id for marble_id by buyer o2, accept it when the seller should
+func (stub *TestStub) offer_for(marble_id string, offer_id string, accept bool) {
+	stub.t.Helper()
+	stub.as_buyer()
+	stub.must("make_offer", marble_id, "o2", buyer_company, "150", offer_id)
+	if accept {
+		stub.as_seller()
+		stub.must("accept_offer", offer_id, seller_company)
+	}
+}
+
+// a payment from the buyer to seller o1 for the offer, returns its reference
+func pay(offer_id string, amount int) string {
+	ref := fmt.Sprintf("ab%062x", len(test_payments.Payments)) //64 hex characters, never all digits
+	test_payments.Payments[ref] = MemoryPayment{To: test_account(1), Amount: amount, OfferId: offer_id}
+	return ref
+}
@@ -0,0 +1,515 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ============================================================================================================================
+// Migrations
+//
+// A migration step upgrades a document from one schema version to the next. Steps work on the raw JSON object
+// instead of the structs because an old document may not fit the current struct. Documents are upgraded -
+//   - lazily, every time they are read (see unmarshal_record()), and stored upgraded the next time they are written
+//   - in bulk, by the admin migrate() function, a batch per transaction - migration_plan() pages through the
+//     documents and lists the ones a batch has to upgrade, migrate() upgrades them
+//
+// Upgrading the chaincode is safe on a populated channel - Init() does not touch documents, old documents read as
+// the current version straight away, and migrate() can be run afterwards at any pace so CouchDB queries on new
+// fields (e.g. isForSale) find the old documents too.
+//
+// To change a document layout bump schema_version and register a step from the old version in init() below.
+// ============================================================================================================================
+
+// ----- Migrations ----- //
+type Document map[string]interface{} //a document as a raw JSON object
+
+type MigrationStep struct {
+	FromVersion int
+	Description string
+	Upgrade     func(doc Document) error //changes doc in place, the schemaVersion is bumped for it
+}
+
+// from version -> step to the next version
+var migration_steps = map[int]MigrationStep{}
+
+// ledger key Init() stores the schema version of the running chaincode under
+const schema_version_key = "schema_version"
+
+// ============================================================================================================================
+// Register Migration - add a step, one per version
+// ============================================================================================================================
+func register_migration(step MigrationStep) {
+	migration_steps[step.FromVersion] = step
+}
+
+func init() {
+	register_migration(MigrationStep{
+		FromVersion: 0,
+		Description: "documents from before schemaVersion - fill in fields that used to be left out",
+		Upgrade: func(doc Document) error {
+			if doc["docType"] == nil && doc["status"] != nil { //offers had no docType at first
+				doc["docType"] = "marble_offer"
+			}
+			switch doc["docType"] {
+			case "marble":
+				set_default(doc, "isForSale", false) //init_marble used to leave these out
+				set_default(doc, "minPrice", 0)
+			case "marble_owner":
+				if doc["AccountId"] != nil { //the accountId field tag was broken, it was stored under the field name
+					set_default(doc, "accountId", doc["AccountId"])
+					delete(doc, "AccountId")
+				}
+				set_default(doc, "accountId", "")
+			case "marble_offer":
+				set_default(doc, "asset", map[string]interface{}{"code": "native", "issuer": ""}) //offers were priced in lumens
+				set_default(doc, "statusHistory", []interface{}{})
+			}
+			return nil
+		},
+	})
+	register_migration(MigrationStep{
+		FromVersion: 1,
+		Description: "offers get an expiresAt, counted from their last status change",
+		Upgrade: func(doc Document) error {
+			if doc["docType"] != "marble_offer" {
+				return nil
+			}
+			updatedAt, err := document_int(doc, "updatedAt")
+			if err != nil {
+				return err
+			}
+			ttl := int64(offer_ttl_ms)
+			if doc["status"] == offer_accepted {
+				ttl = offer_payment_window_ms
+			}
+			set_default(doc, "expiresAt", updatedAt+ttl)
+			return nil
+		},
+	})
+}
+
+// ============================================================================================================================
+// Set Default - set a field only if the document doesn't have it
+// ============================================================================================================================
+func set_default(doc Document, field string, value interface{}) {
+	if _, found := doc[field]; !found {
+		doc[field] = value
+	}
+}
+
+// ============================================================================================================================
+// Document Version - the schemaVersion of a raw document, 0 if it has none
+// ============================================================================================================================
+func document_version(doc Document) (int, error) {
+	version, err := document_int(doc, "schemaVersion")
+	return int(version), err
+}
+
+// ============================================================================================================================
+// Document Int - a whole number field of a raw document, 0 if it has none
+// ============================================================================================================================
+func document_int(doc Document, field string) (int64, error) {
+	number, ok := doc[field].(json.Number)
+	if !ok {
+		if doc[field] == nil {
+			return 0, nil
+		}
+		return 0, new_error(code_record_invalid, field+" is not a number")
+	}
+	value, err := strconv.ParseInt(number.String(), 10, 64)
+	if err != nil {
+		return 0, new_error(code_record_invalid, field+" is not a whole number")
+	}
+	return value, nil
+}
+
+// ============================================================================================================================
+// Upgrade Document - run a document through the migration steps up to schema_version
+//
+// Returns the upgraded document and the version it was at. Documents that are already current, or from a newer
+// chaincode, come back exactly as they were.
+// ============================================================================================================================
+func upgrade_document(valAsBytes []byte) ([]byte, int, error) {
+	var doc Document
+	decoder := json.NewDecoder(bytes.NewReader(valAsBytes))
+	decoder.UseNumber() //keep numbers as they were written
+	err := decoder.Decode(&doc)
+	if err != nil {
+		return valAsBytes, 0, new_error(code_record_invalid, "is not a JSON object - "+err.Error())
+	}
+	version, err := document_version(doc)
+	if err != nil {
+		return valAsBytes, 0, err
+	}
+	if version >= schema_version {
+		return valAsBytes, version, nil
+	}
+	if doc["docType"] == nil && doc["status"] == nil { //settings and anything else that isn't one of our documents
+		return valAsBytes, version, new_error(code_record_invalid, "is not a document, it has no docType")
+	}
+
+	for v := version; v < schema_version; v++ {
+		step, found := migration_steps[v]
+		if !found {
+			return valAsBytes, version, new_error(code_record_invalid, "has no migration step from version "+strconv.Itoa(v))
+		}
+		err = step.Upgrade(doc)
+		if err != nil {
+			return valAsBytes, version, new_error(code_record_invalid, "could not be upgraded from version "+strconv.Itoa(v)+" - "+error_message(err))
+		}
+		doc["schemaVersion"] = v + 1
+	}
+
+	upgradedAsBytes, _ := json.Marshal(doc) //convert to array of bytes
+	return upgradedAsBytes, version, nil
+}
+
+// ============================================================================================================================
+// Upgraded Or Raw - the upgraded document, or the value untouched if it isn't a document we can upgrade
+//
+// For reads that hand back the stored bytes
+// ============================================================================================================================
+func upgraded_or_raw(valAsBytes []byte) []byte {
+	upgradedAsBytes, _, err := upgrade_document(valAsBytes)
+	if err != nil {
+		return valAsBytes
+	}
+	return upgradedAsBytes
+}
+
+// ----- Migration Plan ----- //
+type MigrationPlan struct {
+	SchemaVersion int             `json:"schemaVersion"` //version documents will be upgraded to
+	Scanned       int             `json:"scanned"`       //documents visited for this plan
+	Keys          []string        `json:"keys"`          //documents that need migrate(), pass them to it as they are
+	Failed        []InvalidRecord `json:"failed"`        //documents that could not be upgraded, run validate_ledger for details
+	Bookmark      string          `json:"bookmark"`      //pass to the next plan, empty once every document was visited
+}
+
+// ----- Migration Report ----- //
+type MigrationReport struct {
+	ResponseEnvelope                 //status, code and message like any other write
+	SchemaVersion    int             `json:"schemaVersion"` //version documents were upgraded to
+	Scanned          int             `json:"scanned"`       //documents visited in this batch
+	Migrated         int             `json:"migrated"`      //documents rewritten in this batch
+	Failed           []InvalidRecord `json:"failed"`        //documents that could not be upgraded, run validate_ledger for details
+}
+
+// most documents a plan visits, so its keys fit in migrate()'s argument
+const max_migration_batch = 50
+
+// composite keys start with this, plain keys can't
+const composite_key_namespace = "\x00"
+
+// ============================================================================================================================
+// Migration Bookmark - "<namespace>|<hex of the namespace's page bookmark>", namespace is empty for plain keys
+// ============================================================================================================================
+func migration_bookmark(namespace string, pageBookmark string) string {
+	return namespace + "|" + hex.EncodeToString([]byte(pageBookmark))
+}
+
+func parse_migration_bookmark(bookmark string) (string, string, error) {
+	if len(bookmark) == 0 {
+		return "", "", nil
+	}
+	parts := strings.SplitN(bookmark, "|", 2)
+	if len(parts) != 2 {
+		return "", "", new_error(code_invalid_argument, "Bookmark is not from migration_plan")
+	}
+	pageBookmark, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return "", "", new_error(code_invalid_argument, "Bookmark is not from migration_plan")
+	}
+	if len(parts[0]) > 0 {
+		if _, found := record_namespaces[parts[0]]; !found {
+			return "", "", new_error(code_invalid_argument, "Bookmark is not from migration_plan")
+		}
+	}
+	return parts[0], string(pageBookmark), nil
+}
+
+// ============================================================================================================================
+// Migration Plan - find the documents in a batch that need migrate() (admin only)
+//
+// Visits plain keys (marbles, owners, legacy offers) first, then each composite key namespace, a page at a time.
+// Call it again with the bookmark it returns until the bookmark comes back empty, and pass the keys of each plan
+// to migrate(). Pagination queries can't be used in a transaction that writes, so finding the documents is
+// this query's job and migrate() only writes. Settings are skipped but take up room in the page.
+//
+// Inputs - Array of strings
+//      0    ,      1
+//  page size,  bookmark
+//    "50"   ,     ""
+// ============================================================================================================================
+func migration_plan(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting migration_plan")
+
+	pageSize, bookmark, err := parse_page_args(args)
+	if err != nil {
+		return error_response(err, code_invalid_argument)
+	}
+	if pageSize > max_migration_batch {
+		return new_error_response(code_invalid_argument, "Page size must be at most "+strconv.Itoa(max_migration_batch))
+	}
+	namespace, pageBookmark, err := parse_migration_bookmark(bookmark)
+	if err != nil {
+		return error_response(err, code_invalid_argument)
+	}
+
+	plan := MigrationPlan{SchemaVersion: schema_version, Keys: []string{}, Failed: []InvalidRecord{}}
+	settings := map[string]bool{}
+	for _, key := range settings_keys {
+		settings[key] = true
+	}
+
+	namespaces := append([]string{""}, record_namespace_order...)
+	for len(namespaces) > 0 && namespaces[0] != namespace { //skip the namespaces the earlier plans finished
+		namespaces = namespaces[1:]
+	}
+
+	left := pageSize
+	for _, ns := range namespaces {
+		if left == 0 {
+			plan.Bookmark = migration_bookmark(ns, "") //the next plan starts on this namespace
+			break
+		}
+
+		var resultsIterator shim.StateQueryIteratorInterface
+		var metadata *pb.QueryResponseMetadata
+		if len(ns) == 0 {
+			resultsIterator, metadata, err = stub.GetStateByRangeWithPagination("", "", left, pageBookmark)
+		} else {
+			resultsIterator, metadata, err = stub.GetStateByPartialCompositeKeyWithPagination(ns, []string{}, left, pageBookmark)
+		}
+		if err != nil {
+			return error_response(err, code_ledger_error)
+		}
+		defer resultsIterator.Close()
+
+		for resultsIterator.HasNext() {
+			aKeyValue, err := resultsIterator.Next()
+			if err != nil {
+				return error_response(err, code_ledger_error)
+			}
+			if len(ns) == 0 && settings[aKeyValue.Key] {
+				continue
+			}
+			plan.Scanned++
+			needed, err := needs_migration(stub, ns, aKeyValue.Value)
+			if err != nil {
+				plan.Failed = append(plan.Failed, InvalidRecord{Namespace: ns, Key: display_key(stub, ns, aKeyValue.Key), Problems: []string{error_message(err)}})
+				continue
+			}
+			if needed {
+				plan.Keys = append(plan.Keys, aKeyValue.Key)
+			}
+		}
+
+		left -= metadata.FetchedRecordsCount
+		if len(metadata.Bookmark) > 0 {
+			plan.Bookmark = migration_bookmark(ns, metadata.Bookmark)
+			break
+		}
+		pageBookmark = "" //on to the next namespace from its start
+	}
+
+	fmt.Println("- end migration_plan, " + strconv.Itoa(len(plan.Keys)) + " of " + strconv.Itoa(plan.Scanned) + " documents to migrate")
+	planAsBytes, _ := json.Marshal(plan) //convert to array of bytes
+	return shim.Success(planAsBytes)
+}
+
+// ============================================================================================================================
+// Needs Migration - true if migrate() has something to do for a document
+// ============================================================================================================================
+func needs_migration(stub shim.ChaincodeStubInterface, namespace string, valAsBytes []byte) (bool, error) {
+	upgradedAsBytes, version, err := upgrade_document(valAsBytes)
+	if err != nil {
+		return false, err
+	}
+	if version < schema_version || namespace == legacy_owner_activity_index {
+		return true, nil
+	}
+	return needs_reindex(stub, upgradedAsBytes)
+}
+
+// ============================================================================================================================
+// Migrate - upgrade the documents a migration plan found to the current schema version and store them (admin only)
+//
+// Each document is read again, one that was deleted or upgraded since the plan is left alone. Open offers also get
+// their marble~offer index entry, offers made before the index existed don't have one, and owner activity is moved
+// from owner~activity~txid to the keys getOwnerActivity() reads (see activity.go).
+//
+// Inputs - Array of strings
+//                       0
+//        keys from migration_plan, as JSON
+//  ["m1490898165086", "o1490898165087", ...]
+// ============================================================================================================================
+func migrate(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting migrate")
+
+	if len(args) != 1 {
+		return new_error_response(code_invalid_argument, "Incorrect number of arguments. Expecting 1")
+	}
+	var keys []string
+	err := json.Unmarshal([]byte(args[0]), &keys) //un stringify it aka JSON.parse()
+	if err != nil {
+		return new_error_response(code_invalid_argument, "Keys must be a JSON array of strings")
+	}
+	if len(keys) > max_migration_batch {
+		return new_error_response(code_invalid_argument, "At most "+strconv.Itoa(max_migration_batch)+" keys per batch")
+	}
+
+	report := MigrationReport{SchemaVersion: schema_version, Failed: []InvalidRecord{}}
+	for _, key := range keys {
+		ns, err := migration_namespace(stub, key)
+		if err != nil {
+			return error_response(err, code_invalid_argument)
+		}
+		valAsBytes, err := stub.GetState(key)
+		if err != nil {
+			return error_response(err, code_ledger_error)
+		}
+		if len(valAsBytes) == 0 {
+			continue //deleted since the plan
+		}
+		report.Scanned++
+
+		upgradedAsBytes, version, err := upgrade_document(valAsBytes)
+		if err != nil {
+			report.Failed = append(report.Failed, InvalidRecord{Namespace: ns, Key: display_key(stub, ns, key), Problems: []string{error_message(err)}})
+			continue
+		}
+		if ns == legacy_owner_activity_index { //activity moves to a key with its time in it
+			err = move_legacy_activity(stub, key, upgradedAsBytes)
+			if err != nil {
+				report.Failed = append(report.Failed, InvalidRecord{Namespace: ns, Key: display_key(stub, ns, key), Problems: []string{error_message(err)}})
+				continue
+			}
+			report.Migrated++
+			continue
+		}
+		err = reindex_document(stub, upgradedAsBytes)
+		if err != nil {
+			return error_response(err, code_ledger_error)
+		}
+		if version >= schema_version {
+			continue //already current
+		}
+		err = stub.PutState(key, upgradedAsBytes)
+		if err != nil {
+			return error_response(err, code_ledger_error)
+		}
+		report.Migrated++
+	}
+
+	return migration_response(report)
+}
+
+// ============================================================================================================================
+// Migration Namespace - the namespace of a key migrate() was given, error if it isn't a document's key
+// ============================================================================================================================
+func migration_namespace(stub shim.ChaincodeStubInterface, key string) (string, error) {
+	notDocument := new_error(code_invalid_argument, "Key "+strconv.Quote(key)+" is not a document's key")
+	if !strings.HasPrefix(key, composite_key_namespace) {
+		for _, setting := range settings_keys {
+			if key == setting {
+				return "", notDocument
+			}
+		}
+		if len(key) == 0 {
+			return "", notDocument
+		}
+		return "", nil
+	}
+	namespace, _, err := stub.SplitCompositeKey(key)
+	if err != nil {
+		return "", notDocument
+	}
+	if _, found := record_namespaces[namespace]; !found {
+		return "", notDocument
+	}
+	return namespace, nil
+}
+
+// ============================================================================================================================
+// Reindex Document - write the index entries a document needs that older chaincode didn't write
+// ============================================================================================================================
+func reindex_document(stub shim.ChaincodeStubInterface, valAsBytes []byte) error {
+	var offer Offer
+	err := json.Unmarshal(valAsBytes, &offer)
+	if err != nil || offer.ObjectType != "marble_offer" || !offer_is_open(offer) {
+		return nil //only open offers are indexed so far
+	}
+	return index_offer(stub, offer)
+}
+
+// true if reindex_document() would add an index entry the document doesn't have
+func needs_reindex(stub shim.ChaincodeStubInterface, valAsBytes []byte) (bool, error) {
+	var offer Offer
+	err := json.Unmarshal(valAsBytes, &offer)
+	if err != nil || offer.ObjectType != "marble_offer" || !offer_is_open(offer) {
+		return false, nil
+	}
+	key, err := stub.CreateCompositeKey(marble_offer_index, []string{offer.Marble.Id, offer.Id})
+	if err != nil {
+		return false, new_error(code_ledger_error, "Failed to create "+marble_offer_index+" key for offer "+offer.Id+" - "+err.Error())
+	}
+	indexAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return false, new_error(code_ledger_error, "Failed to check the index of offer "+offer.Id)
+	}
+	return len(indexAsBytes) == 0, nil
+}
+
+// ============================================================================================================================
+// Display Key - a plain key as is, a composite key's attributes joined with "/"
+// ============================================================================================================================
+func display_key(stub shim.ChaincodeStubInterface, namespace string, key string) string {
+	if len(namespace) == 0 {
+		return key
+	}
+	_, attributes, err := stub.SplitCompositeKey(key)
+	if err != nil {
+		return key
+	}
+	return strings.Join(attributes, "/")
+}
+
+// ============================================================================================================================
+// Migration Response - send the batch report back, it is a write so it carries the usual envelope fields
+// ============================================================================================================================
+func migration_response(report MigrationReport) pb.Response {
+	report.Status = status_ok
+	report.Code = code_ok
+	report.Message = "Migrated " + strconv.Itoa(report.Migrated) + " of " + strconv.Itoa(report.Scanned) + " documents"
+	fmt.Println("- end migrate, " + report.Message)
+	reportAsBytes, _ := json.Marshal(report) //convert to array of bytes
+	return shim.Success(reportAsBytes)
+}
@@ -0,0 +1,145 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"testing"
+)
+
+// documents as the first chaincode versions wrote them, before schemaVersion
+func put_v0_fixtures(stub *TestStub) int {
+	for i, id := range []string{"o1", "o2", "o3"} {
+		stub.put_fixture(id, fmt.Sprintf(`{"docType":"marble_owner","id":"%s","username":"user%d","company":"United Marbles","enabled":true,"AccountId":"%s"}`, id, i, test_account(byte(i))))
+	}
+	for i := 1; i <= 5; i++ {
+		stub.put_fixture("m"+strconv.Itoa(i), fmt.Sprintf(`{"docType":"marble","id":"m%d","color":"blue","size":35,"owner":{"id":"o1","username":"user0","company":"United Marbles"}}`, i))
+	}
+	offer := `{"id":"%s","marble":{"docType":"marble","id":"m%d","color":"blue","size":35,"owner":{"id":"o1","username":"user0","company":"United Marbles"}},` +
+		`"offerPrice":150,"buyer":{"id":"o2","username":"user1","company":"United Marbles"},"status":"%s","txId":"tx0","updatedAt":1000}`
+	stub.put_fixture("offer1", fmt.Sprintf(offer, "offer1", 1, offer_proposed)) //offers were plain keys at first
+	key, _ := stub.CreateCompositeKey("offer", []string{"offer2"})
+	stub.put_fixture(key, fmt.Sprintf(offer, "offer2", 2, offer_accepted))
+	key, _ = stub.CreateCompositeKey("offer", []string{"offer3"})
+	stub.put_fixture(key, fmt.Sprintf(offer, "offer3", 3, offer_rejected))
+	key, _ = stub.CreateCompositeKey(legacy_owner_activity_index, []string{"o2", "offer_made", "tx0"})
+	stub.put_fixture(key, `{"docType":"owner_activity","ownerId":"o2","activity":"offer_made","role":"to","offerId":"offer1","txId":"tx0","timestamp":1000}`)
+	return 3 + 5 + 3 + 1
+}
+
+// run migration plans and migrate until the plan's bookmark comes back empty, returns the plans
+func (stub *TestStub) migrate_all(pageSize int) []MigrationPlan {
+	stub.t.Helper()
+	plans := []MigrationPlan{}
+	bookmark := ""
+	for len(plans) < 100 {
+		var plan MigrationPlan
+		json.Unmarshal(stub.must("migration_plan", strconv.Itoa(pageSize), bookmark).Payload, &plan)
+		plans = append(plans, plan)
+
+		keysAsBytes, _ := json.Marshal(plan.Keys)
+		var report MigrationReport
+		json.Unmarshal(stub.must("migrate", string(keysAsBytes)).Payload, &report)
+		if report.Scanned != len(plan.Keys) || len(report.Failed) > 0 {
+			stub.t.Fatalf("migrate should upgrade the %d planned documents, got %+v", len(plan.Keys), report)
+		}
+		if bookmark = plan.Bookmark; len(bookmark) == 0 {
+			return plans
+		}
+	}
+	stub.t.Fatal("Migration plans never ended")
+	return nil
+}
+
+func TestMigrateV0DocumentsInBatches(t *testing.T) {
+	stub := new_test_stub(t)
+	documents := put_v0_fixtures(stub)
+	stub.as("United Marbles", role_admin)
+	settings := 0
+	for _, key := range settings_keys {
+		if stub.state[key] != nil {
+			settings++
+		}
+	}
+
+	stub.scanned = 0
+	plans := stub.migrate_all(2)
+	scanned, planned := 0, 0
+	for _, plan := range plans {
+		scanned += plan.Scanned
+		planned += len(plan.Keys)
+		if len(plan.Failed) > 0 {
+			t.Fatalf("Every fixture should upgrade, got %+v", plan.Failed)
+		}
+	}
+	if len(plans) < documents/2 || scanned != documents || planned != documents {
+		t.Fatalf("Each of the %d documents should be visited once, across batches - %d plans scanned %d and planned %d", documents, len(plans), scanned, planned)
+	}
+	if stub.scanned != documents+settings {
+		t.Fatalf("Batches should carry on where the last one stopped, %d documents and %d settings took %d reads", documents, settings, stub.scanned)
+	}
+
+	// everything is current and reads as it should
+	var report LedgerReport
+	json.Unmarshal(stub.must("validate_ledger").Payload, &report)
+	if len(report.Invalid) > 0 || report.Versions[strconv.Itoa(schema_version)] != report.Scanned || report.Scanned != documents {
+		t.Fatalf("Every document should be at version %d, got %+v", schema_version, report)
+	}
+	stub.as_seller()
+	if owner, _ := get_owner(stub, "o2"); owner.AccountId != test_account(1) {
+		t.Fatalf("Owner accountId should be moved from AccountId, got %+v", owner)
+	}
+	if offer := stub.offer("offer2"); offer.ExpiresAt != 1000+offer_payment_window_ms || offer.Asset.Code != "native" {
+		t.Fatalf("Accepted offer should expire after the payment window and be priced in lumens, got %+v", offer)
+	}
+	for offer_id, indexed := range map[string]bool{"offer1": true, "offer2": true, "offer3": false} {
+		key, _ := stub.CreateCompositeKey(marble_offer_index, []string{"m" + offer_id[5:], offer_id})
+		if value, _ := stub.GetState(key); (value != nil) != indexed {
+			t.Errorf("%s should be indexed under its marble: %v", offer_id, indexed)
+		}
+	}
+
+	// once migrated there is nothing left to do
+	stub.as("United Marbles", role_admin)
+	for _, plan := range stub.migrate_all(max_migration_batch) {
+		if len(plan.Keys) > 0 {
+			t.Fatalf("A migrated ledger should have nothing planned, got %v", plan.Keys)
+		}
+	}
+}
+
+func TestMigrateRefusesOtherKeys(t *testing.T) {
+	stub := new_test_stub(t)
+	put_v0_fixtures(stub)
+	stub.as("United Marbles", role_admin)
+	indexKey, _ := stub.CreateCompositeKey(owner_marble_index, []string{"o1", "m1"})
+	withIndexKey, _ := json.Marshal([]string{"m1", indexKey})
+	for _, keys := range []string{`["marbles_ui"]`, `[""]`, string(withIndexKey), `"m1"`} {
+		stub.expect_code(code_invalid_argument, "migrate", keys)
+	}
+	stub.expect_code(code_invalid_argument, "migration_plan", strconv.Itoa(max_migration_batch+1), "")
+	stub.expect_code(code_invalid_argument, "migration_plan", "10", "not a bookmark")
+
+	stub.as_seller()
+	stub.expect_code(code_not_authorized, "migrate", `["m1"]`)
+	stub.expect_code(code_not_authorized, "migration_plan", "10", "")
+}
@@ -0,0 +1,433 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// ============================================================================================================================
+// Offer Lifecycle
+//
+//  PROPOSED --> ACCEPTED --> PAID --> COMPLETED
+//     |            |
+//     |            +--> WITHDRAWN / EXPIRED
+//     +--> REJECTED / WITHDRAWN / EXPIRED
+//
+// An offer can only be EXPIRED once its expiresAt has passed.
+// ============================================================================================================================
+const offer_proposed = "PROPOSED"
+const offer_accepted = "ACCEPTED"
+const offer_rejected = "REJECTED"
+const offer_withdrawn = "WITHDRAWN"
+const offer_expired = "EXPIRED"
+const offer_paid = "PAID"
+const offer_completed = "COMPLETED"
+
+// rule table - status -> statuses it may move to, anything not listed is an illegal transition
+var offer_transitions = map[string][]string{
+	"":              {offer_proposed}, //brand new offer
+	offer_proposed:  {offer_accepted, offer_rejected, offer_withdrawn, offer_expired},
+	offer_accepted:  {offer_paid, offer_withdrawn, offer_expired},
+	offer_paid:      {offer_completed},
+	offer_rejected:  {},
+	offer_withdrawn: {},
+	offer_expired:   {},
+	offer_completed: {},
+}
+
+// how long an offer stays open before either side may expire it, ms
+const offer_ttl_ms = 7 * 24 * 60 * 60 * 1000            //default for a new offer, make_offer can ask for another
+const max_offer_ttl_ms = 90 * 24 * 60 * 60 * 1000       //longest make_offer can ask for
+const offer_payment_window_ms = 3 * 24 * 60 * 60 * 1000 //buyer's time to pay once the seller accepted
+
+// index of the open (PROPOSED or ACCEPTED) offers on each marble, marble id + offer id, see index_offer()
+const marble_offer_index = "marble~offer"
+
+// ----- Offer Status Changes ----- //
+type OfferStatusChange struct {
+	Status    string `json:"status"`
+	TxId      string `json:"txId"`      //tx that made the change
+	Timestamp int64  `json:"timestamp"` //tx timestamp in ms since epoch
+}
+
+// ============================================================================================================================
+// Can Transition Offer - true if the rule table allows an offer to go from one status to another
+// ============================================================================================================================
+func can_transition_offer(from string, to string) bool {
+	for _, allowed := range offer_transitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// ============================================================================================================================
+// Transition Offer - move an offer to a new status, recording the tx ID and tx timestamp on the offer
+//
+// PROPOSED and ACCEPTED restart the expiry clock, see offer_ttl_ms and offer_payment_window_ms.
+// Does not write the offer, use put_offer() after
+// ============================================================================================================================
+func transition_offer(stub shim.ChaincodeStubInterface, offer *Offer, to string) error {
+	if !can_transition_offer(offer.Status, to) {
+		from := offer.Status
+		if len(from) == 0 {
+			from = "NEW"
+		}
+		allowed := strings.Join(offer_transitions[offer.Status], ", ")
+		if len(allowed) == 0 {
+			allowed = "none, offer is closed"
+		}
+		return new_error(code_offer_state_invalid, "Offer "+offer.Id+" cannot move from "+from+" to "+to+" (allowed: "+allowed+")")
+	}
+
+	timestamp, err := get_tx_timestamp(stub)
+	if err != nil {
+		return err
+	}
+
+	change := OfferStatusChange{
+		Status:    to,
+		TxId:      stub.GetTxID(),
+		Timestamp: timestamp,
+	}
+	offer.Status = to
+	offer.TxId = change.TxId
+	offer.UpdatedAt = change.Timestamp
+	if to == offer_proposed {
+		offer.ExpiresAt = timestamp + offer_ttl_ms
+	}
+	if to == offer_accepted {
+		offer.ExpiresAt = timestamp + offer_payment_window_ms //the buyer gets the whole window to pay
+	}
+	offer.StatusHistory = append(offer.StatusHistory, change)
+	return nil
+}
+
+// ============================================================================================================================
+// Offer Past Deadline - true once the tx timestamp has reached the offer's expiresAt
+// ============================================================================================================================
+func offer_past_deadline(offer Offer, timestamp int64) bool {
+	return timestamp >= offer.ExpiresAt
+}
+
+// ============================================================================================================================
+// Put Offer - store an offer in ledger
+// ============================================================================================================================
+func put_offer(stub shim.ChaincodeStubInterface, offer Offer) error {
+	key, err := offer_key(stub, offer.Id)
+	if err != nil {
+		return err
+	}
+	offer.SchemaVersion = schema_version
+	offerAsBytes, err := marshal_record(offer.Id, offer) //convert to array of bytes
+	if err != nil {
+		return err
+	}
+	err = stub.PutState(key, offerAsBytes)
+	if err != nil {
+		return new_error(code_ledger_error, "Could not store offer - "+offer.Id)
+	}
+	err = index_offer(stub, offer)
+	if err != nil {
+		return err
+	}
+
+	// an offer from before the offer namespace now lives in the namespace, drop the old copy
+	legacyAsBytes, err := stub.GetState(offer.Id)
+	if err != nil {
+		return new_error(code_ledger_error, "Failed to check legacy offer - "+offer.Id)
+	}
+	var legacy Offer
+	if len(legacyAsBytes) > 0 && json.Unmarshal(legacyAsBytes, &legacy) == nil && legacy.Id == offer.Id && len(legacy.Status) > 0 {
+		return stub.DelState(offer.Id)
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// Offer Is Open - true while the offer can still go through
+// ============================================================================================================================
+func offer_is_open(offer Offer) bool {
+	return offer.Status == offer_proposed || offer.Status == offer_accepted
+}
+
+// ============================================================================================================================
+// Index Offer - list an open offer under its marble, drop the entry once the offer is closed
+// ============================================================================================================================
+func index_offer(stub shim.ChaincodeStubInterface, offer Offer) error {
+	key, err := stub.CreateCompositeKey(marble_offer_index, []string{offer.Marble.Id, offer.Id})
+	if err != nil {
+		return new_error(code_ledger_error, "Failed to create "+marble_offer_index+" key for offer "+offer.Id+" - "+err.Error())
+	}
+	if offer_is_open(offer) {
+		err = stub.PutState(key, []byte{0x00}) //couchdb can't store a nil value
+	} else {
+		err = stub.DelState(key)
+	}
+	if err != nil {
+		return new_error(code_ledger_error, "Failed to index offer "+offer.Id)
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// Close Open Offers - move every other open offer on a marble to REJECTED or EXPIRED
+//
+// For when the marble is sold, transferred or deleted, the offers on it can't go through anymore.
+// seller_id is the owner the offers were made to, for the events.
+// ============================================================================================================================
+func close_open_offers(stub shim.ChaincodeStubInterface, marble_id string, seller_id string, except_offer_id string, to string) error {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(marble_offer_index, []string{marble_id})
+	if err != nil {
+		return err
+	}
+	defer resultsIterator.Close()
+
+	var offer_ids []string
+	for resultsIterator.HasNext() {
+		aKeyValue, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		_, attributes, err := stub.SplitCompositeKey(aKeyValue.Key)
+		if err != nil || len(attributes) != 2 {
+			return new_error(code_record_invalid, "Bad "+marble_offer_index+" key for marble "+marble_id)
+		}
+		if attributes[1] != except_offer_id {
+			offer_ids = append(offer_ids, attributes[1])
+		}
+	}
+
+	event_type := event_offer_rejected
+	if to == offer_expired {
+		event_type = event_offer_expired
+	}
+	for _, offer_id := range offer_ids {
+		offer, err := get_offer(stub, offer_id)
+		if err != nil {
+			return err
+		}
+		if !offer_is_open(offer) {
+			continue
+		}
+		err = transition_offer(stub, &offer, to)
+		if err != nil {
+			return err
+		}
+		err = put_offer(stub, offer)
+		if err != nil {
+			return err
+		}
+		err = emit_event(stub, offer_event(event_type, offer, seller_id))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// Escrow
+//
+// accept_offer() locks the marble to the offer so it cannot be sold twice, transferred or deleted while
+// payment is in flight. Only payment completion, withdrawing or expiring the offer releases it.
+// ============================================================================================================================
+
+// ============================================================================================================================
+// Check Not In Escrow - error if the marble is locked by an accepted offer
+// ============================================================================================================================
+func check_not_in_escrow(marble Marble) error {
+	if marble.Escrow != nil {
+		return new_error(code_marble_in_escrow, "Marble "+marble.Id+" is in escrow for accepted offer "+marble.Escrow.OfferId)
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// Lock Marble - put the marble in escrow for an offer
+//
+// Does not write the marble, use put_marble() after
+// ============================================================================================================================
+func lock_marble(stub shim.ChaincodeStubInterface, marble *Marble, offer Offer) error {
+	err := check_not_in_escrow(*marble)
+	if err != nil {
+		return err
+	}
+
+	timestamp, err := get_tx_timestamp(stub)
+	if err != nil {
+		return err
+	}
+
+	marble.Escrow = &EscrowLock{
+		OfferId:  offer.Id,
+		TxId:     stub.GetTxID(),
+		LockedAt: timestamp,
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// Release Marble - take the marble out of escrow if this offer holds the lock, and store it
+// ============================================================================================================================
+func release_marble(stub shim.ChaincodeStubInterface, offer Offer) error {
+	marble, err := get_marble(stub, offer.Marble.Id)
+	if err != nil {
+		return err
+	}
+	if marble.Escrow == nil || marble.Escrow.OfferId != offer.Id {
+		return nil //not ours to release
+	}
+
+	marble.Escrow = nil
+	return put_marble(stub, marble)
+}
+
+// ============================================================================================================================
+// Get Offer Seller - the marble's current owner, the copy of the marble on the offer may be stale
+// ============================================================================================================================
+func get_offer_seller(stub shim.ChaincodeStubInterface, offer Offer) (Owner, error) {
+	marble, err := get_marble(stub, offer.Marble.Id)
+	if err != nil {
+		return Owner{}, err
+	}
+	return get_owner(stub, marble.Owner.Id)
+}
+
+// ============================================================================================================================
+// Settle Offer - payment has been verified, hand the marble to the buyer and close the offer
+//
+// All or nothing - the payment is consumed, the marble moves to the buyer and comes off the market,
+// the offer goes PAID then COMPLETED, the marble's other open offers are REJECTED, a sale record is written
+// and an event is emitted.
+// Any error fails the whole transaction so nothing is half done.
+// ============================================================================================================================
+func settle_offer(stub shim.ChaincodeStubInterface, offer Offer, paymentRef string, rail string) error {
+
+	// the same stellar tx can never settle another offer
+	err := consume_payment(stub, paymentRef, rail, offer)
+	if err != nil {
+		return err
+	}
+
+	// the marble has to be in escrow for this offer
+	marble, err := get_marble(stub, offer.Marble.Id)
+	if err != nil {
+		return err
+	}
+	if marble.Escrow == nil || marble.Escrow.OfferId != offer.Id {
+		return new_error(code_offer_state_invalid, "Marble "+marble.Id+" is not in escrow for offer "+offer.Id)
+	}
+
+	buyer, err := get_owner(stub, offer.Buyer.Id)
+	if err != nil {
+		return err
+	}
+
+	// transfer the marble to the buyer
+	seller_id := marble.Owner.Id
+	err = remove_marble_indexes(stub, marble)
+	if err != nil {
+		return err
+	}
+	transfer_marble(&marble, buyer)
+	marble.Escrow = nil
+	err = put_marble(stub, marble)
+	if err != nil {
+		return err
+	}
+	err = add_marble_indexes(stub, marble)
+	if err != nil {
+		return err
+	}
+
+	// close the offer
+	offer.PaymentRef = paymentRef
+	err = transition_offer(stub, &offer, offer_paid)
+	if err != nil {
+		return err
+	}
+	err = transition_offer(stub, &offer, offer_completed)
+	if err != nil {
+		return err
+	}
+	err = put_offer(stub, offer)
+	if err != nil {
+		return err
+	}
+
+	// the marble is sold, the other offers on it are turned down
+	err = close_open_offers(stub, marble.Id, seller_id, offer.Id, offer_rejected)
+	if err != nil {
+		return err
+	}
+
+	// record the sale
+	var sale Sale
+	sale.ObjectType = "marble_sale"
+	sale.MarbleId = marble.Id
+	sale.OfferId = offer.Id
+	sale.SellerId = seller_id
+	sale.BuyerId = buyer.Id
+	sale.Price = offer.OfferPrice
+	sale.Asset = offer.Asset
+	if len(sale.Asset.Code) == 0 { //offers made before assets were configurable were priced in lumens
+		sale.Asset.Code = "native"
+	}
+	sale.Color = marble.Color
+	sale.Size = marble.Size
+	sale.PaymentRef = paymentRef
+	sale.Rail = rail
+	sale.TxId = offer.TxId
+	sale.Timestamp = offer.UpdatedAt
+	err = put_sale(stub, sale)
+	if err != nil {
+		return err
+	}
+
+	// let the app know
+	return emit_event(stub, MarbleEvent{
+		Type:     event_payment_settled,
+		MarbleId: marble.Id,
+		OfferId:  offer.Id,
+		OldOwner: seller_id,
+		NewOwner: buyer.Id,
+		Price:    offer.OfferPrice,
+	})
+}
+
+// ============================================================================================================================
+// Offer Event - event for an offer changing status, the seller is the old owner and the buyer the new one
+// ============================================================================================================================
+func offer_event(event_type string, offer Offer, seller_id string) MarbleEvent {
+	return MarbleEvent{
+		Type:     event_type,
+		MarbleId: offer.Marble.Id,
+		OfferId:  offer.Id,
+		OldOwner: seller_id,
+		NewOwner: offer.Buyer.Id,
+		Price:    offer.OfferPrice,
+	}
+}
@@ -0,0 +1,222 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// ============================================================================================================================
+// State machine
+// ============================================================================================================================
+func TestOfferTransitionTable(t *testing.T) {
+	statuses := []string{"", offer_proposed, offer_accepted, offer_rejected, offer_withdrawn, offer_expired, offer_paid, offer_completed}
+	legal := map[string]bool{
+		"->" + offer_proposed:                   true,
+		offer_proposed + "->" + offer_accepted:  true,
+		offer_proposed + "->" + offer_rejected:  true,
+		offer_proposed + "->" + offer_withdrawn: true,
+		offer_proposed + "->" + offer_expired:   true,
+		offer_accepted + "->" + offer_paid:      true,
+		offer_accepted + "->" + offer_withdrawn: true,
+		offer_accepted + "->" + offer_expired:   true,
+		offer_paid + "->" + offer_completed:     true,
+	}
+	stub := new_test_stub(t)
+	stub.writes = map[string][]byte{} //transition_offer reads the tx id and timestamp
+	for _, from := range statuses {
+		for _, to := range statuses {
+			if got := can_transition_offer(from, to); got != legal[from+"->"+to] {
+				t.Errorf("can_transition_offer(%q, %q) = %v", from, to, got)
+			}
+			offer := Offer{Id: "offer1", Status: from}
+			err := transition_offer(stub, &offer, to)
+			if legal[from+"->"+to] {
+				if err != nil || offer.Status != to || len(offer.StatusHistory) != 1 || offer.StatusHistory[0].TxId != stub.txId {
+					t.Errorf("transition %q -> %q - %v %+v", from, to, err, offer)
+				}
+			} else if error_code(err) != code_offer_state_invalid || offer.Status != from {
+				t.Errorf("transition %q -> %q should be refused, got %v", from, to, err)
+			}
+		}
+	}
+}
+
+func TestOfferHappyPath(t *testing.T) {
+	stub := new_market(t)
+	stub.offer_for("m1", "offer1", false)
+	stub.expect_status("offer1", offer_proposed)
+
+	stub.as_seller()
+	stub.must("accept_offer", "offer1", seller_company)
+	stub.expect_status("offer1", offer_accepted)
+
+	stub.must("payment_complete_against_offer", "offer1", pay("offer1", 150))
+	offer := stub.offer("offer1")
+	if offer.Status != offer_completed || len(offer.PaymentRef) == 0 {
+		t.Fatalf("Offer should be COMPLETED with its payment, got %+v", offer)
+	}
+	history := []string{}
+	for _, change := range offer.StatusHistory {
+		history = append(history, change.Status)
+	}
+	if strings.Join(history, ",") != "PROPOSED,ACCEPTED,PAID,COMPLETED" {
+		t.Fatalf("Unexpected status history %v", history)
+	}
+
+	marble := stub.marble("m1")
+	if marble.Owner.Id != "o2" || marble.IsForSale || marble.Escrow != nil {
+		t.Fatalf("Marble should belong to o2, off the market and out of escrow, got %+v", marble)
+	}
+	sales, err := get_marble_sales(stub, "m1")
+	if err != nil || len(sales) != 1 || sales[0].OfferId != "offer1" || sales[0].Rail != test_rail {
+		t.Fatalf("Expected one sale on %s, got %+v %v", test_rail, sales, err)
+	}
+}
+
+func TestOfferClosedStatesAreFinal(t *testing.T) {
+	stub := new_market(t)
+	stub.offer_for("m1", "rejected", false)
+	stub.as_seller()
+	stub.must("reject_offer", "rejected", seller_company)
+	stub.offer_for("m1", "withdrawn", false)
+	stub.must("withdraw_offer", "withdrawn", buyer_company)
+	stub.offer_for("m2", "completed", true)
+	stub.must("payment_complete_against_offer", "completed", pay("completed", 150))
+	stub.now += offer_ttl_ms //past every deadline
+
+	for _, id := range []string{"rejected", "withdrawn"} {
+		stub.as_seller()
+		stub.expect_code(code_offer_state_invalid, "accept_offer", id, seller_company)
+		stub.expect_code(code_offer_state_invalid, "reject_offer", id, seller_company)
+	}
+	for _, id := range []string{"rejected", "withdrawn", "completed"} {
+		stub.as_buyer()
+		stub.expect_code(code_offer_state_invalid, "withdraw_offer", id, buyer_company)
+		stub.expect_code(code_offer_state_invalid, "expire_offer", id, buyer_company)
+		stub.expect_code(code_offer_state_invalid, "payment_complete_against_offer", id, pay(id, 150))
+	}
+}
+
+func TestOfferIllegalTransitions(t *testing.T) {
+	stub := new_market(t)
+	stub.offer_for("m1", "offer1", false)
+
+	// a proposed offer can't be paid
+	stub.expect_code(code_offer_state_invalid, "payment_complete_against_offer", "offer1", pay("offer1", 150))
+
+	// an accepted offer can't be accepted again or rejected
+	stub.as_seller()
+	stub.must("accept_offer", "offer1", seller_company)
+	stub.expect_code(code_offer_state_invalid, "accept_offer", "offer1", seller_company)
+	stub.expect_code(code_offer_state_invalid, "reject_offer", "offer1", seller_company)
+	stub.expect_status("offer1", offer_accepted)
+}
+
+func TestOfferSidesAreChecked(t *testing.T) {
+	stub := new_market(t)
+	stub.offer_for("m1", "offer1", false)
+
+	// the buyer can't accept or reject, the seller can't withdraw
+	stub.as_buyer()
+	stub.expect_code(code_not_authorized, "accept_offer", "offer1", buyer_company)
+	stub.expect_code(code_not_authorized, "reject_offer", "offer1", buyer_company)
+	stub.as_seller()
+	stub.expect_code(code_not_authorized, "withdraw_offer", "offer1", seller_company)
+
+	// nobody can make an offer for another company's buyer
+	stub.expect_code(code_not_authorized, "make_offer", "m2", "o2", seller_company, "150", "offer2")
+	stub.expect_status("offer1", offer_proposed)
+}
+
+func TestOfferMakeRules(t *testing.T) {
+	stub := new_market(t)
+	stub.as_buyer()
+	stub.expect_code(code_price_below_minimum, "make_offer", "m1", "o2", buyer_company, "99", "offer1")
+	stub.as_seller()
+	stub.expect_code(code_buyer_is_owner, "make_offer", "m1", "o1", seller_company, "150", "offer1")
+	stub.must("init_marble", "m3", "red", "20", "o1", seller_company)
+	stub.as_buyer()
+	stub.expect_code(code_marble_not_for_sale, "make_offer", "m3", "o2", buyer_company, "150", "offer1")
+
+	stub.must("make_offer", "m1", "o2", buyer_company, "150", "offer1")
+	stub.expect_code(code_offer_exists, "make_offer", "m2", "o2", buyer_company, "150", "offer1")
+}
+
+// ============================================================================================================================
+// Expiry
+// ============================================================================================================================
+func TestOfferExpiry(t *testing.T) {
+	stub := new_market(t)
+	stub.offer_for("m1", "offer1", false)
+	offer := stub.offer("offer1")
+	if offer.ExpiresAt != offer.UpdatedAt+offer_ttl_ms {
+		t.Fatalf("Offer should expire %d ms after it was made, got %+v", offer_ttl_ms, offer)
+	}
+
+	// not before the deadline
+	stub.as_seller()
+	stub.expect_code(code_offer_state_invalid, "expire_offer", "offer1", seller_company)
+
+	// not accepted after it
+	stub.now = offer.ExpiresAt
+	stub.expect_code(code_offer_state_invalid, "accept_offer", "offer1", seller_company)
+
+	// either side can expire it then
+	stub.must("expire_offer", "offer1", seller_company)
+	stub.expect_status("offer1", offer_expired)
+
+	// a shorter ttl can be asked for
+	stub.as_buyer()
+	stub.must("make_offer", "m1", "o2", buyer_company, "150", "offer2", "60000")
+	if offer := stub.offer("offer2"); offer.ExpiresAt != offer.UpdatedAt+60000 {
+		t.Fatalf("Offer should expire a minute after it was made, got %+v", offer)
+	}
+	stub.expect_code(code_invalid_argument, "make_offer", "m1", "o2", buyer_company, "150", "offer3", "1")
+	stub.now += 60000
+	stub.must("expire_offer", "offer2", buyer_company)
+}
+
+func TestOfferSellerCannotExpireAcceptedOffer(t *testing.T) {
+	stub := new_market(t)
+	stub.offer_for("m1", "offer1", true)
+	offer := stub.offer("offer1")
+	if offer.ExpiresAt != offer.UpdatedAt+offer_payment_window_ms {
+		t.Fatalf("Accepting should give the buyer the payment window, got %+v", offer)
+	}
+
+	// the buyer's payment may be on its way, the seller can't take the marble back
+	stub.now = offer.ExpiresAt
+	stub.as_seller()
+	stub.expect_code(code_not_authorized, "expire_offer", "offer1", seller_company)
+
+	// the buyer can, and so can an admin clearing an abandoned escrow
+	stub.as_buyer()
+	stub.must("expire_offer", "offer1", buyer_company)
+	if marble := stub.marble("m1"); marble.Escrow != nil {
+		t.Fatalf("Expiring should release the escrow, got %+v", marble.Escrow)
+	}
+
+	stub.offer_for("m1", "offer2", true)
+	stub.now += offer_payment_window_ms
+	stub.as(seller_company, role_admin)
+	stub.must("expire_offer", "offer2", seller_company)
+}
@@ -0,0 +1,228 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ============================================================================================================================
+// Payment Oracles
+//
+// A trusted oracle watches the payment network off-chain and signs an attestation for each payment it sees.
+// The chaincode only checks the signature against the oracle's public key on the ledger, so endorsement never
+// makes a network call and every peer computes the same read/write set.
+//
+// Attestations are JSON, signed with ECDSA P-256 over the SHA-256 of the exact attestation bytes (ASN.1 DER signature).
+// ============================================================================================================================
+
+// how far ahead of the tx timestamp an attestation's ledger close time may be, to allow for clock skew
+const oracle_max_skew_ms = 5 * 60 * 1000
+
+// ----- Oracles ----- //
+type Oracle struct {
+	ObjectType    string `json:"docType"`       //field for couchdb
+	SchemaVersion int    `json:"schemaVersion"` //see schema.go
+	Id            string `json:"id"`
+	PublicKey     string `json:"publicKey"` //PEM encoded ECDSA P-256 public key
+}
+
+// ----- Attestations ----- //
+type PaymentAttestation struct {
+	OracleId        string `json:"oracleId"`        //oracle that signed it
+	OfferId         string `json:"offerId"`         //offer the payment was for
+	Amount          string `json:"amount"`          //stellar amount string, e.g. "100.0000000"
+	AssetCode       string `json:"assetCode"`       //"native" for lumens
+	AssetIssuer     string `json:"assetIssuer"`     //empty for lumens
+	Destination     string `json:"destination"`     //account that was paid
+	StellarTxHash   string `json:"stellarTxHash"`   //stellar transaction the payment was in
+	LedgerCloseTime int64  `json:"ledgerCloseTime"` //close time of the stellar ledger, ms since epoch
+}
+
+// ============================================================================================================================
+// Get Oracle - get a payment oracle from ledger
+// ============================================================================================================================
+func get_oracle(stub shim.ChaincodeStubInterface, id string) (Oracle, error) {
+	var oracle Oracle
+	key, err := stub.CreateCompositeKey("oracle", []string{id})
+	if err != nil {
+		return oracle, err
+	}
+	oracleAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return oracle, new_error(code_ledger_error, "Failed to get oracle - "+id)
+	}
+	if len(oracleAsBytes) == 0 { //test if oracle is actually here or just nil
+		return oracle, new_error(code_oracle_not_found, "Oracle does not exist - "+id)
+	}
+	err = unmarshal_record(id, oracleAsBytes, &oracle)
+	if err != nil {
+		return oracle, err
+	}
+	return oracle, check_record(id, oracle)
+}
+
+// ============================================================================================================================
+// Parse Oracle Key - parse a PEM encoded ECDSA P-256 public key
+// ============================================================================================================================
+func parse_oracle_key(publicKey string) (*ecdsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(publicKey))
+	if block == nil {
+		return nil, new_error(code_invalid_argument, "Oracle public key is not PEM encoded")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, new_error(code_invalid_argument, "Oracle public key cannot be parsed - "+err.Error())
+	}
+	ecdsaKey, ok := key.(*ecdsa.PublicKey)
+	if !ok || ecdsaKey.Curve != elliptic.P256() {
+		return nil, new_error(code_invalid_argument, "Oracle public key must be an ECDSA P-256 key")
+	}
+	return ecdsaKey, nil
+}
+
+// ============================================================================================================================
+// Verify Payment Attestation - check the oracle's signature and that the attestation matches the offer
+//
+// Inputs - offer, account the seller gets paid on, attestation JSON exactly as signed, base64 DER signature
+// ============================================================================================================================
+func verify_payment_attestation(stub shim.ChaincodeStubInterface, offer *Offer, accountId string, attestationJson string, signature string) (PaymentAttestation, error) {
+	var attestation PaymentAttestation
+	err := json.Unmarshal([]byte(attestationJson), &attestation)
+	if err != nil {
+		return attestation, new_error(code_attestation_invalid, "Payment attestation is not valid JSON - "+err.Error())
+	}
+
+	oracle, err := get_oracle(stub, attestation.OracleId)
+	if err != nil {
+		return attestation, err
+	}
+	publicKey, err := parse_oracle_key(oracle.PublicKey)
+	if err != nil {
+		return attestation, err
+	}
+
+	// signature check
+	der, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return attestation, new_error(code_attestation_invalid, "Attestation signature must be base64")
+	}
+	var sig struct {
+		R, S *big.Int
+	}
+	_, err = asn1.Unmarshal(der, &sig)
+	if err != nil || sig.R == nil || sig.S == nil {
+		return attestation, new_error(code_attestation_invalid, "Attestation signature must be an ASN.1 DER ECDSA signature")
+	}
+	digest := sha256.Sum256([]byte(attestationJson))
+	if !ecdsa.Verify(publicKey, digest[:], sig.R, sig.S) {
+		return attestation, new_error(code_attestation_invalid, "Attestation signature does not verify against oracle "+oracle.Id)
+	}
+
+	// contents check
+	if attestation.OfferId != offer.Id {
+		return attestation, new_error(code_attestation_invalid, "Attestation is for offer "+attestation.OfferId+", not "+offer.Id)
+	}
+	if attestation.Destination != accountId {
+		return attestation, new_error(code_attestation_invalid, "Attestation paid account "+attestation.Destination+", not the seller's account")
+	}
+	amount, err := parse_stellar_amount(attestation.Amount)
+	if err != nil {
+		return attestation, new_error(code_attestation_invalid, "Attestation amount - "+error_message(err))
+	}
+	if amount != int64(offer.OfferPrice)*stroops_per_unit {
+		return attestation, new_error(code_attestation_invalid, "Attestation amount "+attestation.Amount+" does not match offer price "+strconv.Itoa(offer.OfferPrice))
+	}
+	asset := offer.Asset
+	if len(asset.Code) == 0 { //offers made before assets were configurable were priced in lumens
+		asset.Code = "native"
+	}
+	if attestation.AssetCode != asset.Code || attestation.AssetIssuer != asset.Issuer {
+		return attestation, new_error(code_attestation_invalid, "Attestation asset "+attestation.AssetCode+" does not match offer asset "+asset.Code)
+	}
+	if !tx_hash_pattern.MatchString(attestation.StellarTxHash) { //it becomes the consumed payment's key
+		return attestation, new_error(code_attestation_invalid, "Attestation stellar tx hash must be 64 hex characters")
+	}
+	now, err := get_tx_timestamp(stub)
+	if err != nil {
+		return attestation, err
+	}
+	if attestation.LedgerCloseTime > now+oracle_max_skew_ms {
+		return attestation, new_error(code_attestation_invalid, "Attestation ledger close time is in the future")
+	}
+
+	return attestation, nil
+}
+
+// ============================================================================================================================
+// Register Oracle - store a payment oracle's public key on the ledger, re-registering replaces the key (admin only)
+//
+// Inputs - Array of Strings
+//        0      ,                        1
+//    oracle id  ,                public key (PEM)
+//  "oracle1"    , "-----BEGIN PUBLIC KEY-----\nMFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAE...\n-----END PUBLIC KEY-----"
+// ============================================================================================================================
+func register_oracle(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting register_oracle")
+
+	if len(args) != 2 {
+		return new_error_response(code_invalid_argument, "Incorrect number of arguments. Expecting 2")
+	}
+
+	var oracle Oracle
+	oracle.ObjectType = "payment_oracle"
+	oracle.Id = args[0]
+	oracle.PublicKey = args[1]
+	_, err = parse_oracle_key(oracle.PublicKey)
+	if err != nil {
+		return error_response(err, code_invalid_argument)
+	}
+
+	key, err := stub.CreateCompositeKey("oracle", []string{oracle.Id})
+	if err != nil {
+		return error_response(err, code_ledger_error)
+	}
+	oracle.SchemaVersion = schema_version
+	oracleAsBytes, err := marshal_record(oracle.Id, oracle) //convert to array of bytes
+	if err != nil {
+		return error_response(err, code_invalid_argument)
+	}
+	err = stub.PutState(key, oracleAsBytes)
+	if err != nil {
+		return error_response(err, code_ledger_error)
+	}
+
+	fmt.Println("- end register_oracle")
+	return success_response("Registered oracle " + oracle.Id)
+}
@@ -0,0 +1,160 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+var test_oracle_hash = strings.Repeat("c0ffee", 10) + "beef"
+
+// ============================================================================================================================
+// New Oracle Market - new_market() with offer1 on m1 accepted and oracle1 registered, returns oracle1's key
+// ============================================================================================================================
+func new_oracle_market(t *testing.T) (*TestStub, *ecdsa.PrivateKey) {
+	stub := new_market(t)
+	stub.offer_for("m1", "offer1", true)
+	key := test_oracle_key(t)
+	stub.as(seller_company, role_admin)
+	stub.must("register_oracle", "oracle1", test_public_pem(t, key))
+	return stub, key
+}
+
+func test_oracle_key(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func test_public_pem(t *testing.T, key *ecdsa.PrivateKey) string {
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+// an attestation of the payment for offer1, as the oracle would send it
+func test_attestation(stub *TestStub) PaymentAttestation {
+	return PaymentAttestation{
+		OracleId:        "oracle1",
+		OfferId:         "offer1",
+		Amount:          "150.0000000",
+		AssetCode:       "native",
+		Destination:     test_account(1),
+		StellarTxHash:   test_oracle_hash,
+		LedgerCloseTime: stub.now,
+	}
+}
+
+// the attestation JSON and its base64 DER signature
+func sign_attestation(t *testing.T, key *ecdsa.PrivateKey, attestation PaymentAttestation) (string, string) {
+	attestationAsBytes, _ := json.Marshal(attestation)
+	digest := sha256.Sum256(attestationAsBytes)
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := asn1.Marshal(struct{ R, S *big.Int }{r, s})
+	return string(attestationAsBytes), base64.StdEncoding.EncodeToString(der)
+}
+
+func TestAttestationValidSignature(t *testing.T) {
+	stub, key := new_oracle_market(t)
+	attestation, signature := sign_attestation(t, key, test_attestation(stub))
+	stub.must("payment_complete_with_attestation", "offer1", attestation, signature)
+
+	stub.expect_status("offer1", offer_completed)
+	consumed, err := get_consumed_payment(stub, test_oracle_hash)
+	if err != nil || consumed.Rail != "oracle" || consumed.OfferId != "offer1" {
+		t.Fatalf("The attested payment should be consumed for offer1, got %+v %v", consumed, err)
+	}
+
+	// and it can't be replayed
+	stub.offer_for("m2", "offer2", true)
+	other := test_attestation(stub)
+	other.OfferId = "offer2"
+	attestation, signature = sign_attestation(t, key, other)
+	stub.expect_code(code_payment_already_used, "payment_complete_with_attestation", "offer2", attestation, signature)
+}
+
+func TestAttestationTamperedBody(t *testing.T) {
+	stub, key := new_oracle_market(t)
+	attestation, signature := sign_attestation(t, key, test_attestation(stub))
+	tampered := strings.Replace(attestation, `"150.0000000"`, `"15.0000000"`, 1)
+	stub.expect_code(code_attestation_invalid, "payment_complete_with_attestation", "offer1", tampered, signature)
+
+	// even a change that doesn't alter the parsed contents breaks the signature
+	stub.expect_code(code_attestation_invalid, "payment_complete_with_attestation", "offer1", attestation+" ", signature)
+	stub.expect_status("offer1", offer_accepted)
+}
+
+func TestAttestationWrongKey(t *testing.T) {
+	stub, _ := new_oracle_market(t)
+	attestation, signature := sign_attestation(t, test_oracle_key(t), test_attestation(stub))
+	stub.expect_code(code_attestation_invalid, "payment_complete_with_attestation", "offer1", attestation, signature)
+	stub.expect_code(code_attestation_invalid, "payment_complete_with_attestation", "offer1", attestation, "not base64!")
+	stub.expect_status("offer1", offer_accepted)
+}
+
+func TestAttestationUnregisteredOracle(t *testing.T) {
+	stub, key := new_oracle_market(t)
+	unregistered := test_attestation(stub)
+	unregistered.OracleId = "oracle2"
+	attestation, signature := sign_attestation(t, key, unregistered)
+	stub.expect_code(code_oracle_not_found, "payment_complete_with_attestation", "offer1", attestation, signature)
+	stub.expect_status("offer1", offer_accepted)
+}
+
+func TestAttestationContents(t *testing.T) {
+	stub, key := new_oracle_market(t)
+	for name, change := range map[string]func(*PaymentAttestation){
+		"short tx hash":  func(a *PaymentAttestation) { a.StellarTxHash = "abc" },
+		"non hex hash":   func(a *PaymentAttestation) { a.StellarTxHash = strings.Repeat("g", 64) },
+		"other offer":    func(a *PaymentAttestation) { a.OfferId = "offer2" },
+		"other account":  func(a *PaymentAttestation) { a.Destination = test_account(2) },
+		"short amount":   func(a *PaymentAttestation) { a.Amount = "149.9999999" },
+		"other asset":    func(a *PaymentAttestation) { a.AssetCode = "USD" },
+		"future close":   func(a *PaymentAttestation) { a.LedgerCloseTime = stub.now + oracle_max_skew_ms + 60000 },
+		"missing amount": func(a *PaymentAttestation) { a.Amount = "" },
+	} {
+		attestation := test_attestation(stub)
+		change(&attestation)
+		attestationJson, signature := sign_attestation(t, key, attestation)
+		res := stub.invoke("payment_complete_with_attestation", "offer1", attestationJson, signature)
+		if !strings.Contains(res.Message, code_attestation_invalid) {
+			t.Errorf("%s should be refused as %s, got %d %s", name, code_attestation_invalid, res.Status, res.Message)
+		}
+	}
+	stub.expect_status("offer1", offer_accepted)
+}
@@ -0,0 +1,117 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ============================================================================================================================
+// Pagination
+//
+// The *WithPagination functions take a page size and a bookmark, and return one page plus the bookmark
+// of the next one. Pass an empty bookmark for the first page, an empty bookmark coming back means you're done.
+// CouchDB rich queries always return a bookmark, those are done once a page has fewer records than the page size.
+// Paginated queries can only be used in queries, the peer refuses them in transactions that write.
+// ============================================================================================================================
+const max_page_size = 200
+
+// ----- Pages ----- //
+type Page struct {
+	Records      interface{} `json:"records"`
+	FetchedCount int32       `json:"fetchedCount"` //how many keys the peer read for this page
+	Bookmark     string      `json:"bookmark"`     //pass this to get the next page
+}
+
+// a raw key/value, the same shape getMarblesByRange() returns
+type QueryRecord struct {
+	Key    string          `json:"Key"`
+	Record json.RawMessage `json:"Record"`
+}
+
+// ============================================================================================================================
+// Parse Page Args - parse the page size and bookmark arguments
+//
+// Inputs - Array of strings
+//      0    ,    1
+//  pageSize , bookmark
+//    "25"   ,    ""
+// ============================================================================================================================
+func parse_page_args(args []string) (int32, string, error) {
+	if len(args) != 2 {
+		return 0, "", new_error(code_invalid_argument, "Expecting a page size and a bookmark")
+	}
+	pageSize, err := strconv.Atoi(args[0])
+	if err != nil || pageSize < 1 || pageSize > max_page_size {
+		return 0, "", new_error(code_invalid_argument, "Page size must be a numeric string between 1 and "+strconv.Itoa(max_page_size))
+	}
+	if len(args[1]) > 1024 {
+		return 0, "", new_error(code_invalid_argument, "Bookmark is too long")
+	}
+	return int32(pageSize), args[1], nil
+}
+
+// ============================================================================================================================
+// New Page - wrap records with the query's response metadata
+// ============================================================================================================================
+func new_page(records interface{}, metadata *pb.QueryResponseMetadata) Page {
+	page := Page{Records: records}
+	if metadata != nil {
+		page.FetchedCount = metadata.FetchedRecordsCount
+		page.Bookmark = metadata.Bookmark
+	}
+	return page
+}
+
+// ============================================================================================================================
+// Page Response - send a page back
+// ============================================================================================================================
+func page_response(records interface{}, metadata *pb.QueryResponseMetadata) pb.Response {
+	pageAsBytes, err := json.Marshal(new_page(records, metadata)) //convert to array of bytes
+	if err != nil {
+		return new_error_response(code_record_invalid, "Unable to encode page - "+err.Error())
+	}
+	return shim.Success(pageAsBytes)
+}
+
+// ============================================================================================================================
+// Collect Records - read an iterator's key/values as they are
+//
+// Values that aren't JSON, like the marbles_ui version string, are sent back as a JSON string.
+// ============================================================================================================================
+func collect_records(resultsIterator shim.StateQueryIteratorInterface) ([]QueryRecord, error) {
+	records := []QueryRecord{}
+	for resultsIterator.HasNext() {
+		aKeyValue, err := resultsIterator.Next()
+		if err != nil {
+			return records, err
+		}
+		value := upgraded_or_raw(aKeyValue.Value)
+		if !json.Valid(value) {
+			value, _ = json.Marshal(string(value)) //quote it
+		}
+		records = append(records, QueryRecord{Key: aKeyValue.Key, Record: json.RawMessage(value)})
+	}
+	return records, nil
+}
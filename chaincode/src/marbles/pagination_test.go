@@ -0,0 +1,99 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestRangePagesQuoteNonJsonValues(t *testing.T) {
+	stub := new_test_stub(t)
+	stub.put_fixture("m1", `{"docType":"marble","id":"m1"}`)
+
+	// walk every key a page at a time until the bookmark comes back empty
+	records := map[string]json.RawMessage{}
+	bookmark := ""
+	for pages := 0; pages < 50; pages++ {
+		res := stub.must("getMarblesByRangeWithPagination", "a", "zz", "2", bookmark)
+		var page struct {
+			Records  []QueryRecord `json:"records"`
+			Bookmark string        `json:"bookmark"`
+		}
+		if err := json.Unmarshal(res.Payload, &page); err != nil {
+			t.Fatalf("Page should be JSON, got %s - %v", res.Payload, err)
+		}
+		for _, record := range page.Records {
+			records[record.Key] = record.Record
+		}
+		bookmark = page.Bookmark
+		if len(bookmark) == 0 {
+			break
+		}
+	}
+	if len(bookmark) > 0 {
+		t.Fatal("Pages should end with an empty bookmark")
+	}
+
+	var version string
+	if err := json.Unmarshal(records["marbles_ui"], &version); err != nil || version != "4.0.1" {
+		t.Fatalf("marbles_ui should come back as a JSON string, got %s", records["marbles_ui"])
+	}
+	var marble Marble
+	if err := json.Unmarshal(records["m1"], &marble); err != nil || marble.Id != "m1" {
+		t.Fatalf("Marbles should come back as they are stored, got %s", records["m1"])
+	}
+}
+
+func TestRangeMatchesItsPage(t *testing.T) {
+	stub := new_test_stub(t)
+	stub.put_fixture("m1", `{"docType":"marble","id":"m1","color":"blue","size":35,"owner":{"id":"o1","username":"bob","company":"United Marbles"}}`)
+	stub.put_fixture(`m"2`, `{"docType":"marble","id":"m2"}`)
+
+	var records []QueryRecord
+	res := stub.must("getMarblesByRange", "a", "zz")
+	if err := json.Unmarshal(res.Payload, &records); err != nil {
+		t.Fatalf("Range should be JSON even with a quote in a key, got %s - %v", res.Payload, err)
+	}
+	var page struct {
+		Records []QueryRecord `json:"records"`
+	}
+	json.Unmarshal(stub.must("getMarblesByRangeWithPagination", "a", "zz", "200", "").Payload, &page)
+	if len(records) == 0 || len(records) != len(page.Records) {
+		t.Fatalf("Range and page should hold the same records, got %d and %d", len(records), len(page.Records))
+	}
+	for i, record := range records {
+		if record.Key != page.Records[i].Key || !bytes.Equal(record.Record, page.Records[i].Record) {
+			t.Errorf("Range record %s is %s, its page has %s", record.Key, record.Record, page.Records[i].Record)
+		}
+	}
+
+	// documents come back upgraded like any other read
+	var marble Marble
+	for _, record := range records {
+		if record.Key == "m1" {
+			json.Unmarshal(record.Record, &marble)
+		}
+	}
+	if marble.SchemaVersion != schema_version {
+		t.Fatalf("m1 should be upgraded to version %d, got %+v", schema_version, marble)
+	}
+}
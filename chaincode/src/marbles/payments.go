@@ -0,0 +1,222 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ledger key for the channel's payment rail
+const payment_rail_key = "payment_rail"
+const default_payment_rail = stellar_testnet_rail
+
+// ============================================================================================================================
+// Payment Verifiers
+//
+// A payment verifier answers "was this offer paid?" for one payment rail (stellar testnet, a bank, ...).
+// Verifiers register themselves by rail name from an init() function, the channel picks one with set_payment_rail().
+// ============================================================================================================================
+type PaymentVerifier interface {
+	// VerifyPayment - true if paymentRef proves the offer's price was paid to accountId
+	VerifyPayment(stub shim.ChaincodeStubInterface, offer *Offer, accountId string, paymentRef string) (bool, error)
+}
+
+var payment_verifiers = map[string]PaymentVerifier{}
+
+// ============================================================================================================================
+// Register Payment Verifier - make a verifier available under a rail name, replaces any verifier already there
+// ============================================================================================================================
+func register_payment_verifier(rail string, verifier PaymentVerifier) {
+	payment_verifiers[rail] = verifier
+}
+
+// ============================================================================================================================
+// Get Payment Rails - sorted names of the registered rails
+// ============================================================================================================================
+func get_payment_rails() []string {
+	var rails []string
+	for rail := range payment_verifiers {
+		rails = append(rails, rail)
+	}
+	sort.Strings(rails)
+	return rails
+}
+
+// ============================================================================================================================
+// Get Payment Verifier - get the verifier for the rail configured on the ledger
+// ============================================================================================================================
+func get_payment_verifier(stub shim.ChaincodeStubInterface) (string, PaymentVerifier, error) {
+	railAsBytes, err := stub.GetState(payment_rail_key)
+	if err != nil {
+		return "", nil, new_error(code_ledger_error, "Failed to get payment rail")
+	}
+
+	rail := string(railAsBytes)
+	if len(rail) == 0 {
+		rail = default_payment_rail
+	}
+
+	verifier, ok := payment_verifiers[rail]
+	if !ok {
+		return rail, nil, new_error(code_payment_rail_unavailable, "No payment verifier registered for rail '"+rail+"'")
+	}
+	return rail, verifier, nil
+}
+
+// ----- Consumed Payments ----- //
+type ConsumedPayment struct {
+	ObjectType    string `json:"docType"`       //field for couchdb
+	SchemaVersion int    `json:"schemaVersion"` //see schema.go
+	PaymentRef    string `json:"paymentRef"`    //stellar tx hash (lower case)
+	Rail          string `json:"rail"`          //rail or "oracle" it was verified with
+	OfferId       string `json:"offerId"`       //offer the payment settled
+	TxId          string `json:"txId"`          //fabric tx that settled the offer
+	Timestamp     int64  `json:"timestamp"`     //tx timestamp in ms since epoch
+}
+
+// ============================================================================================================================
+// Get Consumed Payment - get the record of which offer a payment settled, error if it never settled one
+// ============================================================================================================================
+func get_consumed_payment(stub shim.ChaincodeStubInterface, paymentRef string) (ConsumedPayment, error) {
+	var consumed ConsumedPayment
+	key, err := stub.CreateCompositeKey("payment", []string{strings.ToLower(paymentRef)})
+	if err != nil {
+		return consumed, err
+	}
+	consumedAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return consumed, new_error(code_ledger_error, "Failed to get payment - "+paymentRef)
+	}
+	if len(consumedAsBytes) == 0 { //test if payment is actually here or just nil
+		return consumed, new_error(code_payment_not_found, "Payment has not settled an offer - "+paymentRef)
+	}
+	err = unmarshal_record(paymentRef, consumedAsBytes, &consumed)
+	if err != nil {
+		return consumed, err
+	}
+	return consumed, check_record(paymentRef, consumed)
+}
+
+// ============================================================================================================================
+// Check Payment Not Consumed - error if the payment already settled an offer, so it can't be replayed
+// ============================================================================================================================
+func check_payment_not_consumed(stub shim.ChaincodeStubInterface, paymentRef string) error {
+	consumed, err := get_consumed_payment(stub, paymentRef)
+	if err == nil {
+		return new_error(code_payment_already_used, "Payment "+paymentRef+" was already used to settle offer "+consumed.OfferId)
+	}
+	if error_code(err) != code_payment_not_found { //can't tell, don't let it through
+		return err
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// Consume Payment - record that a payment settled an offer
+// ============================================================================================================================
+func consume_payment(stub shim.ChaincodeStubInterface, paymentRef string, rail string, offer Offer) error {
+	err := check_payment_not_consumed(stub, paymentRef)
+	if err != nil {
+		return err
+	}
+
+	timestamp, err := get_tx_timestamp(stub)
+	if err != nil {
+		return err
+	}
+
+	var consumed ConsumedPayment
+	consumed.ObjectType = "consumed_payment"
+	consumed.PaymentRef = strings.ToLower(paymentRef)
+	consumed.Rail = rail
+	consumed.OfferId = offer.Id
+	consumed.TxId = stub.GetTxID()
+	consumed.Timestamp = timestamp
+
+	key, err := stub.CreateCompositeKey("payment", []string{consumed.PaymentRef})
+	if err != nil {
+		return err
+	}
+	consumed.SchemaVersion = schema_version
+	consumedAsBytes, err := marshal_record(consumed.PaymentRef, consumed) //convert to array of bytes
+	if err != nil {
+		return err
+	}
+	return stub.PutState(key, consumedAsBytes)
+}
+
+// ============================================================================================================================
+// Set Payment Rail - pick which payment rail this channel settles offers on (admin only)
+//
+// Inputs - Array of Strings
+//          0
+//        rail
+//  "stellar_public"
+// ============================================================================================================================
+func set_payment_rail(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting set_payment_rail")
+
+	if len(args) != 1 {
+		return new_error_response(code_invalid_argument, "Incorrect number of arguments. Expecting 1")
+	}
+
+	rail := args[0]
+	if _, ok := payment_verifiers[rail]; !ok {
+		return new_error_response(code_invalid_argument, "Unknown payment rail '"+rail+"', expecting one of: "+strings.Join(get_payment_rails(), ", "))
+	}
+
+	err = stub.PutState(payment_rail_key, []byte(rail))
+	if err != nil {
+		return error_response(err, code_ledger_error)
+	}
+
+	fmt.Println("- end set_payment_rail")
+	return success_response("Payment rail is " + rail)
+}
+
+// ============================================================================================================================
+// Memory Payment Verifier - verifier backed by a map, swap it in for a rail when testing
+//
+//	register_payment_verifier("stellar_testnet", &MemoryPaymentVerifier{Payments: map[string]MemoryPayment{...}})
+// ============================================================================================================================
+type MemoryPayment struct {
+	To      string //account that was paid
+	Amount  int
+	OfferId string
+}
+
+type MemoryPaymentVerifier struct {
+	Payments map[string]MemoryPayment //payment reference -> payment
+}
+
+// VerifyPayment - look the payment reference up in the map
+func (v *MemoryPaymentVerifier) VerifyPayment(stub shim.ChaincodeStubInterface, offer *Offer, accountId string, paymentRef string) (bool, error) {
+	payment, ok := v.Payments[paymentRef]
+	if !ok {
+		return false, nil
+	}
+	return payment.To == accountId && payment.Amount == offer.OfferPrice && payment.OfferId == offer.Id, nil
+}
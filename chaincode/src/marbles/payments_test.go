@@ -0,0 +1,74 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPaymentRailIsReadFromTheLedger(t *testing.T) {
+	stub := new_test_stub(t)
+	if rail, _, err := get_payment_verifier(stub); err != nil || rail != default_payment_rail {
+		t.Fatalf("A new channel should settle on %s, got %s %v", default_payment_rail, rail, err)
+	}
+
+	stub.expect_code(code_invalid_argument, "set_payment_rail", "nowhere")
+	stub.must("set_payment_rail", test_rail)
+	if rail, verifier, err := get_payment_verifier(stub); err != nil || rail != test_rail || verifier != test_payments {
+		t.Fatalf("Expected the %s verifier, got %s %v %v", test_rail, rail, verifier, err)
+	}
+
+	// a rail stored by a build that had a verifier for it
+	stub.state[payment_rail_key] = []byte("nowhere")
+	if _, _, err := get_payment_verifier(stub); error_code(err) != code_payment_rail_unavailable {
+		t.Fatalf("An unregistered rail should be unavailable, got %v", err)
+	}
+}
+
+func TestPaymentCannotBeSpentTwice(t *testing.T) {
+	stub := new_market(t)
+	stub.offer_for("m1", "offer1", true)
+	stub.offer_for("m2", "offer2", true)
+
+	ref := pay("offer1", 150)
+	test_payments.Payments[strings.ToUpper(ref)] = MemoryPayment{To: test_account(1), Amount: 150, OfferId: "offer2"}
+	stub.must("payment_complete_against_offer", "offer1", ref)
+
+	if err := check_payment_not_consumed(stub, ref); error_code(err) != code_payment_already_used {
+		t.Fatalf("The payment should be consumed, got %v", err)
+	}
+	if err := check_payment_not_consumed(stub, strings.ToUpper(ref)); error_code(err) != code_payment_already_used {
+		t.Fatalf("Payment references should not be case sensitive, got %v", err)
+	}
+	if err := check_payment_not_consumed(stub, strings.Repeat("e", 64)); err != nil {
+		t.Fatalf("An unused payment should pass, got %v", err)
+	}
+
+	// the same stellar tx can't settle the second offer, even one the verifier would accept
+	stub.expect_code(code_payment_already_used, "payment_complete_against_offer", "offer2", ref)
+	stub.expect_code(code_payment_already_used, "payment_complete_against_offer", "offer2", strings.ToUpper(ref))
+	stub.expect_status("offer2", offer_accepted)
+
+	consumed, err := get_consumed_payment(stub, ref)
+	if err != nil || consumed.OfferId != "offer1" {
+		t.Fatalf("The payment should be recorded against offer1, got %+v %v", consumed, err)
+	}
+}
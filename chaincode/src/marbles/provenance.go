@@ -0,0 +1,182 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ============================================================================================================================
+// Provenance
+//
+// A self-contained record of a marble's lineage built only from ledger data - its history and its sale records -
+// so anyone with access to the ledger can rebuild it and recompute the digest.
+//
+// The digest is the hex SHA-256 of the document serialized as compact JSON with the digest field left out,
+// fields in the order of the structs below. Any change to the layout gets a new schema version.
+// ============================================================================================================================
+const provenance_schema = "marbles.provenance/v1"
+
+// ----- Provenance ----- //
+type Provenance struct {
+	Schema   string              `json:"schema"` //provenance_schema
+	MarbleId string              `json:"marbleId"`
+	Created  ProvenanceEvent     `json:"created"`           //tx that created the marble
+	Deleted  *ProvenanceEvent    `json:"deleted,omitempty"` //tx that deleted it, if it is gone
+	Owners   []ProvenanceHolding `json:"owners"`            //every owner, oldest first
+	Sales    []ProvenanceSale    `json:"sales"`             //every settled sale, oldest first
+	Digest   string              `json:"digest,omitempty"`  //hex sha256, see above
+}
+
+type ProvenanceEvent struct {
+	TxId      string `json:"txId"`
+	Timestamp int64  `json:"timestamp"` //tx timestamp in ms since epoch
+}
+
+type ProvenanceHolding struct {
+	Owner    OwnerRelation `json:"owner"`
+	From     int64         `json:"from"`     //when they got it, ms since epoch
+	FromTxId string        `json:"fromTxId"` //tx they got it in
+	To       int64         `json:"to"`       //when they stopped holding it, 0 while they still do
+	ToTxId   string        `json:"toTxId"`   //tx they stopped holding it in, empty while they still do
+}
+
+type ProvenanceSale struct {
+	OfferId    string       `json:"offerId"`
+	SellerId   string       `json:"sellerId"`
+	BuyerId    string       `json:"buyerId"`
+	Price      int          `json:"price"`
+	Asset      PaymentAsset `json:"asset"`
+	PaymentRef string       `json:"paymentRef"` //stellar settlement tx hash
+	Rail       string       `json:"rail"`
+	TxId       string       `json:"txId"`
+	Timestamp  int64        `json:"timestamp"`
+}
+
+// ============================================================================================================================
+// Build Provenance - build a marble's provenance document and sign it off with its digest
+// ============================================================================================================================
+func build_provenance(stub shim.ChaincodeStubInterface, marbleId string) (Provenance, error) {
+	provenance := Provenance{Schema: provenance_schema, MarbleId: marbleId, Owners: []ProvenanceHolding{}, Sales: []ProvenanceSale{}}
+
+	_, modifications, err := get_record_history(stub, marbleId)
+	if err != nil {
+		return provenance, err
+	}
+	if get_doc_type(modifications) != "marble" {
+		return provenance, new_error(code_marble_not_found, "No marble history for - "+marbleId)
+	}
+
+	// walk the history, closing a holding each time the owner changes or the marble is deleted
+	var holding *ProvenanceHolding
+	for _, modification := range modifications {
+		if modification.IsDelete {
+			provenance.Deleted = &ProvenanceEvent{TxId: modification.TxId, Timestamp: modification.Timestamp}
+			if holding != nil {
+				holding.To, holding.ToTxId = modification.Timestamp, modification.TxId
+				provenance.Owners = append(provenance.Owners, *holding)
+				holding = nil
+			}
+			continue
+		}
+
+		var marble Marble
+		json.Unmarshal(modification.Value, &marble) //un stringify it aka JSON.parse()
+		if len(provenance.Created.TxId) == 0 {
+			provenance.Created = ProvenanceEvent{TxId: modification.TxId, Timestamp: modification.Timestamp}
+		}
+		provenance.Deleted = nil //it was created again after a delete
+
+		if holding != nil && holding.Owner.Id == marble.Owner.Id {
+			continue //same owner, something else changed
+		}
+		if holding != nil {
+			holding.To, holding.ToTxId = modification.Timestamp, modification.TxId
+			provenance.Owners = append(provenance.Owners, *holding)
+		}
+		holding = &ProvenanceHolding{Owner: marble.Owner, From: modification.Timestamp, FromTxId: modification.TxId}
+	}
+	if holding != nil {
+		provenance.Owners = append(provenance.Owners, *holding)
+	}
+
+	// sale records carry the price and the stellar settlement
+	sales, err := get_marble_sales(stub, marbleId)
+	if err != nil {
+		return provenance, err
+	}
+	for _, sale := range sales {
+		provenance.Sales = append(provenance.Sales, ProvenanceSale{
+			OfferId:    sale.OfferId,
+			SellerId:   sale.SellerId,
+			BuyerId:    sale.BuyerId,
+			Price:      sale.Price,
+			Asset:      sale.Asset,
+			PaymentRef: sale.PaymentRef,
+			Rail:       sale.Rail,
+			TxId:       sale.TxId,
+			Timestamp:  sale.Timestamp,
+		})
+	}
+
+	provenance.Digest = provenance_digest(provenance)
+	return provenance, nil
+}
+
+// ============================================================================================================================
+// Provenance Digest - hex SHA-256 of the document without its digest
+// ============================================================================================================================
+func provenance_digest(provenance Provenance) string {
+	provenance.Digest = ""
+	provenanceAsBytes, _ := json.Marshal(provenance) //convert to array of bytes
+	digest := sha256.Sum256(provenanceAsBytes)
+	return hex.EncodeToString(digest[:])
+}
+
+// ============================================================================================================================
+// Get Provenance - a marble's lineage certificate
+//
+// Inputs - Array of strings
+//           0
+//           id
+//  "m01490985296352SjAyM"
+// ============================================================================================================================
+func getProvenance(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting getProvenance")
+
+	if len(args) != 1 {
+		return new_error_response(code_invalid_argument, "Incorrect number of arguments. Expecting 1")
+	}
+
+	provenance, err := build_provenance(stub, args[0])
+	if err != nil {
+		return error_response(err, code_ledger_error)
+	}
+
+	fmt.Println("- end getProvenance")
+	provenanceAsBytes, _ := json.Marshal(provenance) //convert to array of bytes
+	return shim.Success(provenanceAsBytes)
+}
@@ -20,9 +20,10 @@ under the License.
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
+	"strconv"
+	"strings"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	pb "github.com/hyperledger/fabric/protos/peer"
@@ -41,26 +42,20 @@ import (
 // Returns - string
 // ============================================================================================================================
 func read(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	var key, jsonResp string
+	var key string
 	var err error
 	fmt.Println("starting read")
 
 	if len(args) != 1 {
-		return shim.Error("Incorrect number of arguments. Expecting key of the var to query")
-	}
-
-	// input sanitation
-	err = sanitize_arguments(args)
-	if err != nil {
-		return shim.Error(err.Error())
+		return new_error_response(code_invalid_argument, "Incorrect number of arguments. Expecting key of the var to query")
 	}
 
 	key = args[0]
 	valAsbytes, err := stub.GetState(key)           //get the var from ledger
 	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get state for " + key + "\"}"
-		return shim.Error(jsonResp)
+		return new_error_response(code_ledger_error, "Failed to get state for "+key)
 	}
+	valAsbytes = upgraded_or_raw(valAsbytes) //documents come back in the current schema, see migrations.go
 
 	fmt.Println("- end read")
 	return shim.Success(valAsbytes)                  //send it onward
@@ -69,7 +64,7 @@ func read(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 // ============================================================================================================================
 // Get everything we need (owners + marbles + companies)
 //
-// Inputs - none
+// Inputs - none, an empty string is accepted and ignored (the Node client sends [''])
 //
 // Returns:
 // {
@@ -100,20 +95,23 @@ func read_everything(stub shim.ChaincodeStubInterface) pb.Response {
 	// ---- Get All Marbles ---- //
 	resultsIterator, err := stub.GetStateByRange("m0", "m9999999999999999999")
 	if err != nil {
-		return shim.Error(err.Error())
+		return error_response(err, code_ledger_error)
 	}
 	defer resultsIterator.Close()
 	
 	for resultsIterator.HasNext() {
 		aKeyValue, err := resultsIterator.Next()
 		if err != nil {
-			return shim.Error(err.Error())
+			return error_response(err, code_ledger_error)
 		}
 		queryKeyAsStr := aKeyValue.Key
 		queryValAsBytes := aKeyValue.Value
 		fmt.Println("on marble id - ", queryKeyAsStr)
 		var marble Marble
-		json.Unmarshal(queryValAsBytes, &marble)                  //un stringify it aka JSON.parse()
+		err = unmarshal_record(queryKeyAsStr, queryValAsBytes, &marble) //un stringify it aka JSON.parse()
+		if err != nil {
+			return error_response(err, code_record_invalid)
+		}
 		everything.Marbles = append(everything.Marbles, marble)   //add this marble to the list
 	}
 	fmt.Println("marble array - ", everything.Marbles)
@@ -121,20 +119,23 @@ func read_everything(stub shim.ChaincodeStubInterface) pb.Response {
 	// ---- Get All Owners ---- //
 	ownersIterator, err := stub.GetStateByRange("o0", "o9999999999999999999")
 	if err != nil {
-		return shim.Error(err.Error())
+		return error_response(err, code_ledger_error)
 	}
 	defer ownersIterator.Close()
 
 	for ownersIterator.HasNext() {
 		aKeyValue, err := ownersIterator.Next()
 		if err != nil {
-			return shim.Error(err.Error())
+			return error_response(err, code_ledger_error)
 		}
 		queryKeyAsStr := aKeyValue.Key
 		queryValAsBytes := aKeyValue.Value
 		fmt.Println("on owner id - ", queryKeyAsStr)
 		var owner Owner
-		json.Unmarshal(queryValAsBytes, &owner)                   //un stringify it aka JSON.parse()
+		err = unmarshal_record(queryKeyAsStr, queryValAsBytes, &owner)  //un stringify it aka JSON.parse()
+		if err != nil {
+			return error_response(err, code_record_invalid)
+		}
 
 		if owner.Enabled {                                        //only return enabled owners
 			everything.Owners = append(everything.Owners, owner)  //add this marble to the list
@@ -152,52 +153,55 @@ func read_everything(stub shim.ChaincodeStubInterface) pb.Response {
 //
 // Shows Off GetHistoryForKey() - reading complete history of a key/value
 //
-// Inputs - Array of strings
-//  0
-//  id
-//  "m01490985296352SjAyM"
+// Works for marbles, owners and offers, the record's docType picks how the history is read (see history.go).
+// Each entry has the tx timestamp and whether the record was deleted, plus what changed in that tx -
+// the previous owner for marbles, the changed fields for owners and the previous status for offers.
+// The "ownership" view is for marbles, it only keeps the entries where the owner changed.
+//
+// Inputs - Array of strings (all but the id are optional, see parse_history_options())
+//           0           ,       1        ,       2        ,   3   ,     4
+//           id          ,   from (ms)    ,    to (ms)     , order , view
+//  "m01490985296352SjAyM", "1500000000000", "1600000000000", "desc", "ownership"
 // ============================================================================================================================
 func getHistory(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	type AuditHistory struct {
-		TxId    string   `json:"txId"`
-		Value   Marble   `json:"value"`
+	if len(args) < 1 {
+		return new_error_response(code_invalid_argument, "Incorrect number of arguments. Expecting 1 to 5")
 	}
-	var history []AuditHistory;
-	var marble Marble
-
-	if len(args) != 1 {
-		return shim.Error("Incorrect number of arguments. Expecting 1")
+	options, err := parse_history_options(args[1:])
+	if err != nil {
+		return error_response(err, code_invalid_argument)
 	}
 
-	marbleId := args[0]
-	fmt.Printf("- start getHistoryForMarble: %s\n", marbleId)
+	id := args[0]
+	fmt.Println("- start getHistory: " + id)
 
 	// Get History
-	resultsIterator, err := stub.GetHistoryForKey(marbleId)
+	docType, modifications, err := get_record_history(stub, id)
 	if err != nil {
-		return shim.Error(err.Error())
+		return error_response(err, code_ledger_error)
 	}
-	defer resultsIterator.Close()
 
-	for resultsIterator.HasNext() {
-		historyData, err := resultsIterator.Next()
-		if err != nil {
-			return shim.Error(err.Error())
-		}
+	var history []interface{}
+	switch docType {
+	case "marble":
+		history, err = marble_history(modifications, options)
+	case "marble_owner":
+		history, err = owner_history(modifications, options)
+	case "marble_offer":
+		history, err = offer_history(modifications, options)
+	default:
+		err = new_error(code_invalid_argument, "No marble, owner or offer history for - "+id)
+	}
+	if err != nil {
+		return error_response(err, code_invalid_argument)
+	}
 
-		var tx AuditHistory
-		tx.TxId = historyData.TxId                     //copy transaction id over
-		json.Unmarshal(historyData.Value, &marble)     //un stringify it aka JSON.parse()
-		if historyData.Value == nil {                  //marble has been deleted
-			var emptyMarble Marble
-			tx.Value = emptyMarble                 //copy nil marble
-		} else {
-			json.Unmarshal(historyData.Value, &marble) //un stringify it aka JSON.parse()
-			tx.Value = marble                      //copy marble over
+	if options.Descending {
+		for i, j := 0, len(history)-1; i < j; i, j = i+1, j-1 {
+			history[i], history[j] = history[j], history[i]
 		}
-		history = append(history, tx)              //add this tx to the list
 	}
-	fmt.Printf("- getHistoryForMarble returning:\n%s", history)
+	fmt.Println("- getHistory returning " + strconv.Itoa(len(history)) + " " + docType + " entries")
 
 	//change to array of bytes
 	historyAsBytes, _ := json.Marshal(history)     //convert to array of bytes
@@ -208,6 +212,7 @@ func getHistory(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 // Get history of asset - performs a range query based on the start and end keys provided.
 //
 // Shows Off GetStateByRange() - reading a multiple key/values from the ledger
+// Records have the same shape as a page of getMarblesByRangeWithPagination()
 //
 // Inputs - Array of strings
 //       0     ,    1
@@ -216,7 +221,7 @@ func getHistory(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 // ============================================================================================================================
 func getMarblesByRange(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	if len(args) != 2 {
-		return shim.Error("Incorrect number of arguments. Expecting 2")
+		return new_error_response(code_invalid_argument, "Incorrect number of arguments. Expecting 2")
 	}
 
 	startKey := args[0]
@@ -224,41 +229,324 @@ func getMarblesByRange(stub shim.ChaincodeStubInterface, args []string) pb.Respo
 
 	resultsIterator, err := stub.GetStateByRange(startKey, endKey)
 	if err != nil {
-		return shim.Error(err.Error())
+		return error_response(err, code_ledger_error)
 	}
 	defer resultsIterator.Close()
 
-	// buffer is a JSON array containing QueryResults
-	var buffer bytes.Buffer
-	buffer.WriteString("[")
+	records, err := collect_records(resultsIterator)
+	if err != nil {
+		return error_response(err, code_ledger_error)
+	}
 
-	bArrayMemberAlreadyWritten := false
-	for resultsIterator.HasNext() {
-		aKeyValue, err := resultsIterator.Next()
+	recordsAsBytes, err := json.Marshal(records) //convert to array of bytes
+	if err != nil {
+		return new_error_response(code_record_invalid, "Unable to encode records - "+err.Error())
+	}
+	fmt.Printf("- getMarblesByRange queryResult:\n%s\n", string(recordsAsBytes))
+
+	return shim.Success(recordsAsBytes)
+}
+
+// ============================================================================================================================
+// Get Payment Settlement - which offer a payment settled
+//
+// Inputs - Array of strings
+//                                   0
+//                           stellar tx hash
+//  "bbfaf6c5d4a0ddbd69f4592736986a7596b5b18dec6fde0658f12fb2e6900d81"
+// ============================================================================================================================
+func getPaymentSettlement(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return new_error_response(code_invalid_argument, "Incorrect number of arguments. Expecting 1")
+	}
+
+	consumed, err := get_consumed_payment(stub, args[0])
+	if err != nil {
+		return error_response(err, code_payment_not_found)
+	}
+
+	//change to array of bytes
+	consumedAsBytes, _ := json.Marshal(consumed) //convert to array of bytes
+	return shim.Success(consumedAsBytes)
+}
+
+// ============================================================================================================================
+// Get marbles by owner - uses the owner~marble index instead of scanning every marble
+//
+// Shows Off GetStateByPartialCompositeKey() - reading the keys that start with some attributes
+//
+// Inputs - Array of strings
+//         0
+//      owner id
+//  "o9999999999999"
+// ============================================================================================================================
+func getMarblesByOwner(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	return get_marbles_by_index_response(stub, args, owner_marble_index)
+}
+
+// ============================================================================================================================
+// Get marbles by company - uses the company~marble index
+//
+// Inputs - Array of strings
+//         0
+//      company
+//  "United Marbles"
+// ============================================================================================================================
+func getMarblesByCompany(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	return get_marbles_by_index_response(stub, args, company_marble_index)
+}
+
+// ============================================================================================================================
+// Get marbles by color - uses the color~marble index
+//
+// Inputs - Array of strings
+//     0
+//   color
+//  "blue"
+// ============================================================================================================================
+func getMarblesByColor(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) == 1 {
+		args = []string{strings.ToLower(args[0])} //colors are stored lower case
+	}
+	return get_marbles_by_index_response(stub, args, color_marble_index)
+}
+
+func get_marbles_by_index_response(stub shim.ChaincodeStubInterface, args []string, index string) pb.Response {
+	if len(args) != 1 {
+		return new_error_response(code_invalid_argument, "Incorrect number of arguments. Expecting 1")
+	}
+
+	marbles, err := get_marbles_by_index(stub, index, args[0])
+	if err != nil {
+		return error_response(err, code_ledger_error)
+	}
+	fmt.Printf("- %s found %d marbles for %s\n", index, len(marbles), args[0])
+
+	//change to array of bytes
+	marblesAsBytes, _ := json.Marshal(marbles) //convert to array of bytes
+	return shim.Success(marblesAsBytes)
+}
+
+// ============================================================================================================================
+// Query marbles - search marbles in the state database (CouchDB only)
+//
+// Shows Off GetQueryResult() - running a CouchDB selector query
+//
+// Inputs - Array of strings
+//                                     0
+//                                  query
+//  {"company": "United Marbles", "isForSale": true, "minPrice": 10, "sort": [{"field": "size", "order": "asc"}]}
+//
+// Query fields - owner, company, color, minSize, maxSize, isForSale, minPrice, maxPrice, sort
+// Sort fields - id, owner, company, color, size, minPrice, or color+size, company+owner, size+minPrice, minPrice+size, all in one order
+// ============================================================================================================================
+func queryMarbles(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return new_error_response(code_invalid_argument, "Incorrect number of arguments. Expecting 1")
+	}
+
+	query, err := parse_marble_query(args[0])
+	if err != nil {
+		return error_response(err, code_invalid_argument)
+	}
+	couchQuery, err := build_marble_selector(query)
+	if err != nil {
+		return error_response(err, code_invalid_argument)
+	}
+	fmt.Println("- queryMarbles selector: " + couchQuery)
+
+	marbles, err := get_marbles_by_query(stub, couchQuery)
+	if err != nil {
+		return error_response(err, code_ledger_error)
+	}
+
+	//change to array of bytes
+	marblesAsBytes, _ := json.Marshal(marbles) //convert to array of bytes
+	return shim.Success(marblesAsBytes)
+}
+
+// ============================================================================================================================
+// Paginated Queries
+//
+// Each returns one page - {"records": [...], "fetchedCount": 25, "bookmark": "..."}
+// Pass the bookmark back to get the next page, see pagination.go
+// ============================================================================================================================
+
+// ============================================================================================================================
+// Get everything we need (owners + marbles), a page at a time
+//
+// Owners and marbles are paged separately, pass each one's bookmark back. Disabled owners are left out of
+// the records but still count towards fetchedCount.
+//
+// Inputs - Array of strings
+//      0    ,      1          ,       2
+//  pageSize , marbles bookmark, owners bookmark
+//    "25"   ,       ""        ,       ""
+// ============================================================================================================================
+func read_everything_with_pagination(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	type Everything struct {
+		Owners  Page `json:"owners"`
+		Marbles Page `json:"marbles"`
+	}
+	var everything Everything
+
+	if len(args) != 3 {
+		return new_error_response(code_invalid_argument, "Incorrect number of arguments. Expecting 3")
+	}
+	pageSize, marblesBookmark, err := parse_page_args(args[:2])
+	if err != nil {
+		return error_response(err, code_invalid_argument)
+	}
+	_, ownersBookmark, err := parse_page_args([]string{args[0], args[2]})
+	if err != nil {
+		return error_response(err, code_invalid_argument)
+	}
+
+	// ---- Get A Page Of Marbles ---- //
+	resultsIterator, metadata, err := stub.GetStateByRangeWithPagination("m0", "m9999999999999999999", pageSize, marblesBookmark)
+	if err != nil {
+		return error_response(err, code_ledger_error)
+	}
+	defer resultsIterator.Close()
+	marbles, err := collect_marbles(resultsIterator)
+	if err != nil {
+		return error_response(err, code_ledger_error)
+	}
+	everything.Marbles = new_page(marbles, metadata)
+
+	// ---- Get A Page Of Owners ---- //
+	ownersIterator, metadata, err := stub.GetStateByRangeWithPagination("o0", "o9999999999999999999", pageSize, ownersBookmark)
+	if err != nil {
+		return error_response(err, code_ledger_error)
+	}
+	defer ownersIterator.Close()
+	owners := []Owner{}
+	for ownersIterator.HasNext() {
+		aKeyValue, err := ownersIterator.Next()
 		if err != nil {
-			return shim.Error(err.Error())
+			return error_response(err, code_ledger_error)
 		}
-		queryResultKey := aKeyValue.Key
-		queryResultValue := aKeyValue.Value
-
-		// Add a comma before array members, suppress it for the first array member
-		if bArrayMemberAlreadyWritten == true {
-			buffer.WriteString(",")
+		var owner Owner
+		err = unmarshal_record(aKeyValue.Key, aKeyValue.Value, &owner) //un stringify it aka JSON.parse()
+		if err != nil {
+			return error_response(err, code_record_invalid)
+		}
+		if owner.Enabled {                                       //only return enabled owners
+			owners = append(owners, owner)
 		}
-		buffer.WriteString("{\"Key\":")
-		buffer.WriteString("\"")
-		buffer.WriteString(queryResultKey)
-		buffer.WriteString("\"")
+	}
+	everything.Owners = new_page(owners, metadata)
+
+	//change to array of bytes
+	everythingAsBytes, _ := json.Marshal(everything) //convert to array of bytes
+	return shim.Success(everythingAsBytes)
+}
+
+// ============================================================================================================================
+// Get marbles by range, a page at a time
+//
+// Shows Off GetStateByRangeWithPagination()
+//
+// Inputs - Array of strings
+//       0     ,    1    ,    2     ,    3
+//   startKey  ,  endKey , pageSize , bookmark
+//  "marbles1" , "marbles5",  "25"  ,    ""
+// ============================================================================================================================
+func getMarblesByRangeWithPagination(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 4 {
+		return new_error_response(code_invalid_argument, "Incorrect number of arguments. Expecting 4")
+	}
+	pageSize, bookmark, err := parse_page_args(args[2:])
+	if err != nil {
+		return error_response(err, code_invalid_argument)
+	}
 
-		buffer.WriteString(", \"Record\":")
-		// Record is a JSON object, so we write as-is
-		buffer.WriteString(string(queryResultValue))
-		buffer.WriteString("}")
-		bArrayMemberAlreadyWritten = true
+	resultsIterator, metadata, err := stub.GetStateByRangeWithPagination(args[0], args[1], pageSize, bookmark)
+	if err != nil {
+		return error_response(err, code_ledger_error)
 	}
-	buffer.WriteString("]")
+	defer resultsIterator.Close()
 
-	fmt.Printf("- getMarblesByRange queryResult:\n%s\n", buffer.String())
+	records, err := collect_records(resultsIterator)
+	if err != nil {
+		return error_response(err, code_ledger_error)
+	}
+	return page_response(records, metadata)
+}
 
-	return shim.Success(buffer.Bytes())
+// ============================================================================================================================
+// Get marbles by owner, company or color, a page at a time
+//
+// Shows Off GetStateByPartialCompositeKeyWithPagination()
+//
+// Inputs - Array of strings
+//         0        ,    1     ,    2
+//   owner id       , pageSize , bookmark
+//  "o9999999999999",   "25"   ,    ""
+// ============================================================================================================================
+func getMarblesByOwnerWithPagination(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	return get_marbles_by_index_page_response(stub, args, owner_marble_index)
+}
+
+func getMarblesByCompanyWithPagination(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	return get_marbles_by_index_page_response(stub, args, company_marble_index)
+}
+
+func getMarblesByColorWithPagination(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) == 3 {
+		args = []string{strings.ToLower(args[0]), args[1], args[2]} //colors are stored lower case
+	}
+	return get_marbles_by_index_page_response(stub, args, color_marble_index)
+}
+
+func get_marbles_by_index_page_response(stub shim.ChaincodeStubInterface, args []string, index string) pb.Response {
+	if len(args) != 3 {
+		return new_error_response(code_invalid_argument, "Incorrect number of arguments. Expecting 3")
+	}
+
+	pageSize, bookmark, err := parse_page_args(args[1:])
+	if err != nil {
+		return error_response(err, code_invalid_argument)
+	}
+
+	marbles, metadata, err := get_marbles_by_index_with_pagination(stub, index, args[0], pageSize, bookmark)
+	if err != nil {
+		return error_response(err, code_ledger_error)
+	}
+	return page_response(marbles, metadata)
+}
+
+// ============================================================================================================================
+// Query marbles, a page at a time (CouchDB only)
+//
+// Shows Off GetQueryResultWithPagination()
+//
+// Inputs - Array of strings
+//                  0                 ,    1     ,    2
+//                query               , pageSize , bookmark
+//  {"color": "blue", "isForSale": true},   "25"   ,    ""
+// ============================================================================================================================
+func queryMarblesWithPagination(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return new_error_response(code_invalid_argument, "Incorrect number of arguments. Expecting 3")
+	}
+	pageSize, bookmark, err := parse_page_args(args[1:])
+	if err != nil {
+		return error_response(err, code_invalid_argument)
+	}
+
+	query, err := parse_marble_query(args[0])
+	if err != nil {
+		return error_response(err, code_invalid_argument)
+	}
+	couchQuery, err := build_marble_selector(query)
+	if err != nil {
+		return error_response(err, code_invalid_argument)
+	}
+
+	marbles, metadata, err := get_marbles_by_query_with_pagination(stub, couchQuery, pageSize, bookmark)
+	if err != nil {
+		return error_response(err, code_ledger_error)
+	}
+	return page_response(marbles, metadata)
 }
@@ -0,0 +1,36 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"testing"
+)
+
+func TestReadEverythingRefusesBrokenRecords(t *testing.T) {
+	for _, fixture := range [][2]string{
+		{"m1", `{"docType":"marble","id":"m1","size":"big"}`},
+		{"o1", `{"docType":"marble_owner","id":"o1","enabled":"yes"}`},
+	} {
+		stub := new_test_stub(t)
+		stub.put_fixture(fixture[0], fixture[1])
+		stub.expect_code(code_record_invalid, "read_everything")
+		stub.expect_code(code_record_invalid, "read_everything_with_pagination", "25", "", "")
+	}
+}
@@ -0,0 +1,653 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ============================================================================================================================
+// Function Registry
+//
+// Every chaincode function is registered here with its arguments, whether it writes to the ledger and the role
+// the caller needs. Invoke() looks functions up here, checks the arguments (see validators.go) and role, then calls the handler.
+// describe() hands the whole catalogue to clients. To add a function, write the handler and register it below.
+//
+// Arguments can be passed positionally, ["m999999999", "blue", "35", "o9999999999999", "united marbles"], or as one
+// JSON object keyed by argument name, [{"id": "m999999999", "color": "blue", "size": 35, "ownerId": ...}].
+// Objects are checked against the argument specs, numbers and booleans are real JSON types, then they are turned
+// into the positional form so the handlers only ever see one shape.
+// ============================================================================================================================
+
+// what a function answers with when it succeeds, errors are always the envelope (see errors.go)
+const returns_envelope = "envelope" //writes - status, code and message
+const returns_document = "document" //reads - the document or page read, not wrapped in the envelope
+
+// argument types, every argument is passed as a string
+const arg_string = "string" //any text
+const arg_number = "number" //numeric string
+const arg_bool = "bool"     //"true" or "false"
+const arg_json = "json"     //JSON document
+
+// ----- Functions ----- //
+type ArgSpec struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`       //arg_string, arg_number, arg_bool or arg_json
+	Optional    bool   `json:"optional"`   //optional arguments come last and may be left off
+	AllowEmpty  bool   `json:"allowEmpty"` //may be an empty string, and left out of a JSON object
+	Format      string `json:"format"`     //what the value is checked against, see validators.go
+	Description string `json:"description"`
+}
+
+type ChaincodeFunction struct {
+	Name        string                                                  `json:"name"`
+	Description string                                                  `json:"description"`
+	Args        []ArgSpec                                               `json:"args"`
+	Mutates     bool                                                    `json:"mutates"` //writes to the ledger
+	Role        string                                                  `json:"role"`    //role the caller's certificate needs, empty for anyone
+	Returns     string                                                  `json:"returns"` //returns_envelope or returns_document, set from Mutates
+	Handler     func(shim.ChaincodeStubInterface, []string) pb.Response `json:"-"`
+}
+
+var chaincode_functions = map[string]ChaincodeFunction{}
+var chaincode_function_names []string //registration order, for describe()
+
+// ============================================================================================================================
+// Register Function - make a function callable, replaces any function already registered with the name
+// ============================================================================================================================
+func register_function(function ChaincodeFunction) {
+	if _, ok := chaincode_functions[function.Name]; !ok {
+		chaincode_function_names = append(chaincode_function_names, function.Name)
+	}
+	if function.Args == nil {
+		function.Args = []ArgSpec{}
+	}
+	function.Returns = returns_document
+	if function.Mutates {
+		function.Returns = returns_envelope
+	}
+	chaincode_functions[function.Name] = function
+}
+
+// ============================================================================================================================
+// Call Function - look a function up, check the caller may use it with these arguments and run it
+// ============================================================================================================================
+func call_function(stub shim.ChaincodeStubInterface, name string, args []string) pb.Response {
+	function, ok := chaincode_functions[name]
+	if !ok {
+		return new_error_response(code_unknown_function, "Received unknown invoke function name - '"+name+"'")
+	}
+
+	if len(args) == 1 && is_object_args(function, args[0]) {
+		var err error
+		args, err = parse_object_args(function, args[0])
+		if err != nil {
+			return error_response(err, code_invalid_argument)
+		}
+	}
+
+	required := 0
+	for _, arg := range function.Args {
+		if !arg.Optional {
+			required++
+		}
+	}
+	if len(args) < required || len(args) > len(function.Args) {
+		expecting := strconv.Itoa(required)
+		if required != len(function.Args) {
+			expecting += " to " + strconv.Itoa(len(function.Args))
+		}
+		return new_error_response(code_invalid_argument, "Incorrect number of arguments for "+name+". Expecting "+expecting)
+	}
+
+	for i, value := range args {
+		err := validate_arg(function.Args[i], value)
+		if err != nil {
+			return error_response(err, code_invalid_argument)
+		}
+	}
+
+	if len(function.Role) > 0 {
+		err := check_role(stub, function.Role)
+		if err != nil {
+			return error_response(err, code_not_authorized)
+		}
+	}
+
+	return function.Handler(stub, args)
+}
+
+// ============================================================================================================================
+// Is Object Args - true if a lone argument is the JSON object form of the function's arguments
+//
+// A function whose only argument is itself JSON (queryMarbles) gets the object form only when every key is
+// one of its argument names, {"query": {...}}, anything else is its positional JSON argument
+// ============================================================================================================================
+func is_object_args(function ChaincodeFunction, arg string) bool {
+	var object map[string]json.RawMessage
+	if json.Unmarshal([]byte(arg), &object) != nil { //not an object
+		return false
+	}
+	if len(function.Args) == 0 || function.Args[0].Type != arg_json || len(function.Args) > 1 && !function.Args[1].Optional {
+		return true
+	}
+	for key := range object {
+		if _, ok := find_arg(function, key); !ok {
+			return false
+		}
+	}
+	return len(object) > 0
+}
+
+// ============================================================================================================================
+// Find Arg - position of an argument by name
+// ============================================================================================================================
+func find_arg(function ChaincodeFunction, name string) (int, bool) {
+	for i, spec := range function.Args {
+		if spec.Name == name {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// ============================================================================================================================
+// Parse Object Args - check a JSON object against the function's argument specs and turn it into positional arguments
+// ============================================================================================================================
+func parse_object_args(function ChaincodeFunction, arg string) ([]string, error) {
+	var object map[string]json.RawMessage
+	decoder := json.NewDecoder(strings.NewReader(arg))
+	decoder.UseNumber()
+	err := decoder.Decode(&object)
+	if err != nil {
+		return nil, new_error(code_invalid_argument, "Arguments object is not valid JSON - "+err.Error())
+	}
+
+	for key := range object {
+		if _, ok := find_arg(function, key); !ok {
+			return nil, new_error(code_invalid_argument, "Unknown argument '"+key+"' for "+function.Name)
+		}
+	}
+
+	args := make([]string, len(function.Args))
+	last := 0 //one past the last argument given, optional ones after it are left off
+	for i, spec := range function.Args {
+		raw, ok := object[spec.Name]
+		if !ok || string(raw) == "null" {
+			if !spec.Optional && !spec.AllowEmpty {
+				return nil, new_error(code_invalid_argument, "Missing argument '"+spec.Name+"' for "+function.Name)
+			}
+			if !spec.Optional {
+				last = i + 1
+			}
+			continue
+		}
+
+		args[i], err = object_arg_value(spec, raw)
+		if err != nil {
+			return nil, err
+		}
+		last = i + 1
+	}
+	return args[:last], nil
+}
+
+// ============================================================================================================================
+// Object Arg Value - positional string for one value of the object form, the value has to be of the spec's type
+// ============================================================================================================================
+func object_arg_value(spec ArgSpec, raw json.RawMessage) (string, error) {
+	switch spec.Type {
+	case arg_number:
+		var number json.Number
+		decoder := json.NewDecoder(bytes.NewReader(raw))
+		decoder.UseNumber()
+		if bytes.HasPrefix(bytes.TrimSpace(raw), []byte(`"`)) || decoder.Decode(&number) != nil { //json.Number would take "35" too
+			return "", new_error(code_invalid_argument, "Argument '"+spec.Name+"' must be a number")
+		}
+		if _, err := number.Int64(); err != nil {
+			return "", new_error(code_invalid_argument, "Argument '"+spec.Name+"' must be a whole number")
+		}
+		return number.String(), nil
+	case arg_bool:
+		var value bool
+		if json.Unmarshal(raw, &value) != nil {
+			return "", new_error(code_invalid_argument, "Argument '"+spec.Name+"' must be true or false")
+		}
+		return strconv.FormatBool(value), nil
+	case arg_json:
+		var value interface{}
+		if json.Unmarshal(raw, &value) != nil {
+			return "", new_error(code_invalid_argument, "Argument '"+spec.Name+"' must be JSON")
+		}
+		if str, ok := value.(string); ok { //already stringified, pass it through
+			return str, nil
+		}
+		return string(raw), nil
+	default:
+		var value string
+		if json.Unmarshal(raw, &value) != nil {
+			return "", new_error(code_invalid_argument, "Argument '"+spec.Name+"' must be a string")
+		}
+		return value, nil
+	}
+}
+
+// ============================================================================================================================
+// Describe - the function catalogue, every function with its arguments, whether it mutates state and its role
+//
+// "returns" tells clients how to read a success - writes answer with the envelope, reads with the document they read,
+// unwrapped. Errors are the envelope either way.
+//
+// Inputs - none
+// ============================================================================================================================
+func describe(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	catalogue := []ChaincodeFunction{}
+	for _, name := range chaincode_function_names {
+		catalogue = append(catalogue, chaincode_functions[name])
+	}
+	catalogueAsBytes, _ := json.Marshal(catalogue) //convert to array of bytes
+	return shim.Success(catalogueAsBytes)
+}
+
+// ============================================================================================================================
+// Argument Helpers - the arguments most functions share
+// ============================================================================================================================
+func arg(name string, format string, description string) ArgSpec {
+	return ArgSpec{Name: name, Type: arg_string, Format: format, Description: description}
+}
+
+func number_arg(name string, format string, description string) ArgSpec {
+	return ArgSpec{Name: name, Type: arg_number, Format: format, Description: description}
+}
+
+func json_arg(name string, description string) ArgSpec {
+	return ArgSpec{Name: name, Type: arg_json, Format: format_json, Description: description}
+}
+
+func optional(spec ArgSpec) ArgSpec {
+	spec.Optional = true
+	spec.AllowEmpty = true
+	return spec
+}
+
+func allow_empty(spec ArgSpec) ArgSpec {
+	spec.AllowEmpty = true
+	return spec
+}
+
+var company_arg = allow_empty(arg("authedByCompany", format_company, "company authorizing the change, may be empty when the certificate carries one, see get_caller_company()"))
+var page_size_arg = number_arg("pageSize", format_page_size, "records per page, 1 to 200")
+var bookmark_arg = allow_empty(arg("bookmark", format_bookmark, "bookmark from the previous page, empty for the first page"))
+var from_arg = optional(number_arg("from", format_timestamp, "only entries at or after this time, ms since epoch, empty for no limit"))
+var to_arg = optional(number_arg("to", format_timestamp, "only entries at or before this time, ms since epoch, empty for no limit"))
+var order_arg = optional(arg("order", format_text, "'asc' (default) or 'desc'"))
+
+// ============================================================================================================================
+// The Functions
+// ============================================================================================================================
+func init() {
+	// ---- Chaincode ---- //
+	register_function(ChaincodeFunction{
+		Name:        "init",
+		Description: "initialize the chaincode state, used as reset",
+		Args:        []ArgSpec{optional(number_arg("selftest", format_number, "number written to the selftest key"))},
+		Mutates:     true,
+		Role:        role_admin,
+		Handler: func(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+			return new(SimpleChaincode).Init(stub)
+		},
+	})
+	register_function(ChaincodeFunction{
+		Name:        "describe",
+		Description: "this catalogue of functions",
+		Handler:     describe,
+	})
+	register_function(ChaincodeFunction{
+		Name:        "read",
+		Description: "generic read ledger",
+		Args:        []ArgSpec{arg("key", format_text, "key to read")},
+		Handler:     read,
+	})
+	register_function(ChaincodeFunction{
+		Name:        "write",
+		Description: "generic writes to ledger, plain scratch keys only",
+		Args:        []ArgSpec{arg("key", format_text, "key to write"), arg("value", format_text, "value to write")},
+		Mutates:     true,
+		Role:        role_admin,
+		Handler:     write,
+	})
+
+	// ---- Marbles and Owners ---- //
+	register_function(ChaincodeFunction{
+		Name:        "init_marble",
+		Description: "create a new marble",
+		Args: []ArgSpec{
+			arg("id", format_marble_id, "marble id"),
+			arg("color", format_color, "marble color"),
+			number_arg("size", format_size, "size in mm"),
+			arg("ownerId", format_owner_id, "owner of the new marble"),
+			company_arg,
+		},
+		Mutates: true,
+		Handler: init_marble,
+	})
+	register_function(ChaincodeFunction{
+		Name:        "delete_marble",
+		Description: "deletes a marble from state",
+		Args:        []ArgSpec{arg("id", format_marble_id, "marble id"), company_arg},
+		Mutates:     true,
+		Handler:     delete_marble,
+	})
+	register_function(ChaincodeFunction{
+		Name:        "set_owner",
+		Description: "change owner of a marble",
+		Args:        []ArgSpec{arg("marbleId", format_marble_id, "marble id"), arg("ownerId", format_owner_id, "new owner"), company_arg},
+		Mutates:     true,
+		Handler:     set_owner,
+	})
+	register_function(ChaincodeFunction{
+		Name:        "init_owner",
+		Description: "create a new marble owner",
+		Args: []ArgSpec{
+			arg("id", format_owner_id, "owner id"),
+			arg("username", format_username, "owner's username"),
+			arg("company", format_company, "owner's company"),
+			arg("accountId", format_stellar_account, "owner's stellar account"),
+		},
+		Mutates: true,
+		Handler: init_owner,
+	})
+	register_function(ChaincodeFunction{
+		Name:        "disable_owner",
+		Description: "disable a marble owner from appearing on the UI",
+		Args:        []ArgSpec{arg("ownerId", format_owner_id, "owner id"), company_arg},
+		Mutates:     true,
+		Handler:     disable_owner,
+	})
+
+	// ---- Reads ---- //
+	register_function(ChaincodeFunction{
+		Name:        "read_everything",
+		Description: "read everything, (owners + marbles + companies)",
+		Args:        []ArgSpec{optional(arg("unused", format_text, "ignored, the Node client sends ['']"))},
+		Handler: func(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+			return read_everything(stub)
+		},
+	})
+	register_function(ChaincodeFunction{
+		Name:        "read_everything_with_pagination",
+		Description: "read a page of owners and marbles",
+		Args:        []ArgSpec{page_size_arg, allow_empty(arg("marblesBookmark", format_bookmark, "bookmark of the marbles page")), allow_empty(arg("ownersBookmark", format_bookmark, "bookmark of the owners page"))},
+		Handler:     read_everything_with_pagination,
+	})
+	register_function(ChaincodeFunction{
+		Name:        "getHistory",
+		Description: "read history of a marble, owner or offer (audit)",
+		Args:        []ArgSpec{arg("id", format_id, "marble, owner or offer id"), from_arg, to_arg, order_arg, optional(arg("view", format_text, "'full' (default) or 'ownership'"))},
+		Handler:     getHistory,
+	})
+	register_function(ChaincodeFunction{
+		Name:        "getMarblesByRange",
+		Description: "read a bunch of marbles by start and stop id",
+		Args:        []ArgSpec{arg("startKey", format_text, "first key"), arg("endKey", format_text, "key after the last one")},
+		Handler:     getMarblesByRange,
+	})
+	register_function(ChaincodeFunction{
+		Name:        "getMarblesByRangeWithPagination",
+		Description: "read a page of marbles by start and stop id",
+		Args:        []ArgSpec{arg("startKey", format_text, "first key"), arg("endKey", format_text, "key after the last one"), page_size_arg, bookmark_arg},
+		Handler:     getMarblesByRangeWithPagination,
+	})
+	register_function(ChaincodeFunction{
+		Name:        "getMarblesByOwner",
+		Description: "read the marbles of one owner, via the owner~marble index",
+		Args:        []ArgSpec{arg("ownerId", format_owner_id, "owner id")},
+		Handler:     getMarblesByOwner,
+	})
+	register_function(ChaincodeFunction{
+		Name:        "getMarblesByOwnerWithPagination",
+		Description: "read a page of the marbles of one owner",
+		Args:        []ArgSpec{arg("ownerId", format_owner_id, "owner id"), page_size_arg, bookmark_arg},
+		Handler:     getMarblesByOwnerWithPagination,
+	})
+	register_function(ChaincodeFunction{
+		Name:        "getMarblesByCompany",
+		Description: "read the marbles of one company, via the company~marble index",
+		Args:        []ArgSpec{arg("company", format_company, "company")},
+		Handler:     getMarblesByCompany,
+	})
+	register_function(ChaincodeFunction{
+		Name:        "getMarblesByCompanyWithPagination",
+		Description: "read a page of the marbles of one company",
+		Args:        []ArgSpec{arg("company", format_company, "company"), page_size_arg, bookmark_arg},
+		Handler:     getMarblesByCompanyWithPagination,
+	})
+	register_function(ChaincodeFunction{
+		Name:        "getMarblesByColor",
+		Description: "read the marbles of one color, via the color~marble index",
+		Args:        []ArgSpec{arg("color", format_color, "color")},
+		Handler:     getMarblesByColor,
+	})
+	register_function(ChaincodeFunction{
+		Name:        "getMarblesByColorWithPagination",
+		Description: "read a page of the marbles of one color",
+		Args:        []ArgSpec{arg("color", format_color, "color"), page_size_arg, bookmark_arg},
+		Handler:     getMarblesByColorWithPagination,
+	})
+	register_function(ChaincodeFunction{
+		Name:        "queryMarbles",
+		Description: "search marbles with a CouchDB rich query",
+		Args:        []ArgSpec{json_arg("query", "filters and sort, see rich_query.go")},
+		Handler:     queryMarbles,
+	})
+	register_function(ChaincodeFunction{
+		Name:        "queryMarblesWithPagination",
+		Description: "read a page of a rich query",
+		Args:        []ArgSpec{json_arg("query", "filters and sort, see rich_query.go"), page_size_arg, bookmark_arg},
+		Handler:     queryMarblesWithPagination,
+	})
+	register_function(ChaincodeFunction{
+		Name:        "getOwnerActivity",
+		Description: "read a page of what happened to an owner",
+		Args: []ArgSpec{
+			arg("ownerId", format_owner_id, "owner id"),
+			allow_empty(arg("activity", format_text, "only this activity, empty for all")),
+			allow_empty(number_arg("from", format_timestamp, "only activity at or after this time, ms since epoch, empty for no limit")),
+			allow_empty(number_arg("to", format_timestamp, "only activity at or before this time, ms since epoch, empty for no limit")),
+			page_size_arg,
+			bookmark_arg,
+		},
+		Handler: getOwnerActivity,
+	})
+	register_function(ChaincodeFunction{
+		Name:        "getProvenance",
+		Description: "lineage certificate of a marble",
+		Args:        []ArgSpec{arg("id", format_marble_id, "marble id")},
+		Handler:     getProvenance,
+	})
+	register_function(ChaincodeFunction{
+		Name:        "getPriceHistory",
+		Description: "sales of a marble",
+		Args:        []ArgSpec{arg("id", format_marble_id, "marble id"), from_arg, to_arg, order_arg},
+		Handler:     getPriceHistory,
+	})
+	register_function(ChaincodeFunction{
+		Name:        "getPriceStats",
+		Description: "market stats for a color, per size bucket",
+		Args:        []ArgSpec{arg("color", format_color, "color"), optional(arg("sizeBucket", format_text, "e.g. '30-39', empty for all")), from_arg, to_arg},
+		Handler:     getPriceStats,
+	})
+	register_function(ChaincodeFunction{
+		Name:        "getPaymentSettlement",
+		Description: "read which offer a stellar payment settled",
+		Args:        []ArgSpec{arg("paymentRef", format_tx_hash, "stellar tx hash")},
+		Handler:     getPaymentSettlement,
+	})
+
+	// ---- Sales ---- //
+	register_function(ChaincodeFunction{
+		Name:        "mark_for_sale",
+		Description: "put a marble on the market",
+		Args:        []ArgSpec{arg("marbleId", format_marble_id, "marble id"), company_arg, number_arg("minPrice", format_min_price, "lowest price offers may be")},
+		Mutates:     true,
+		Handler:     mark_for_sale,
+	})
+	register_function(ChaincodeFunction{
+		Name:        "make_offer",
+		Description: "buyer makes an offer for a marble on sale",
+		Args: []ArgSpec{
+			arg("marbleId", format_marble_id, "marble id"),
+			arg("buyerId", format_owner_id, "owner making the offer"),
+			company_arg,
+			number_arg("offerPrice", format_price, "price offered"),
+			arg("offerId", format_offer_id, "id for the new offer"),
+			optional(number_arg("ttl", format_offer_ttl, "ms until either side may expire the offer, empty for 7 days")),
+		},
+		Mutates: true,
+		Handler: make_offer,
+	})
+	register_function(ChaincodeFunction{
+		Name:        "accept_offer",
+		Description: "seller accepts an offer, the marble goes into escrow",
+		Args:        []ArgSpec{arg("offerId", format_offer_id, "offer id"), company_arg},
+		Mutates:     true,
+		Handler:     accept_offer,
+	})
+	register_function(ChaincodeFunction{
+		Name:        "reject_offer",
+		Description: "seller rejects an offer",
+		Args:        []ArgSpec{arg("offerId", format_offer_id, "offer id"), company_arg},
+		Mutates:     true,
+		Handler:     reject_offer,
+	})
+	register_function(ChaincodeFunction{
+		Name:        "withdraw_offer",
+		Description: "buyer withdraws their offer",
+		Args:        []ArgSpec{arg("offerId", format_offer_id, "offer id"), company_arg},
+		Mutates:     true,
+		Handler:     withdraw_offer,
+	})
+	register_function(ChaincodeFunction{
+		Name:        "expire_offer",
+		Description: "marks an offer past its expiresAt as expired, an accepted offer only by the buyer",
+		Args:        []ArgSpec{arg("offerId", format_offer_id, "offer id"), company_arg},
+		Mutates:     true,
+		Handler:     expire_offer,
+	})
+	register_function(ChaincodeFunction{
+		Name:        "payment_complete_against_offer",
+		Description: "settle an accepted offer with a payment on the channel's payment rail",
+		Args:        []ArgSpec{arg("offerId", format_offer_id, "offer id"), arg("paymentRef", format_tx_hash, "stellar tx hash")},
+		Mutates:     true,
+		Handler:     payment_complete_against_offer,
+	})
+	register_function(ChaincodeFunction{
+		Name:        "payment_complete_with_attestation",
+		Description: "settle an offer with a signed oracle attestation",
+		Args:        []ArgSpec{arg("offerId", format_offer_id, "offer id"), json_arg("attestation", "attestation exactly as signed"), arg("signature", format_text, "base64 DER ECDSA signature")},
+		Mutates:     true,
+		Handler:     payment_complete_with_attestation,
+	})
+
+	// ---- Admin ---- //
+	register_function(ChaincodeFunction{
+		Name:        "register_oracle",
+		Description: "store a payment oracle's public key",
+		Args:        []ArgSpec{arg("oracleId", format_id, "oracle id"), arg("publicKey", format_pem, "PEM encoded ECDSA P-256 public key")},
+		Mutates:     true,
+		Role:        role_admin,
+		Handler:     register_oracle,
+	})
+	register_function(ChaincodeFunction{
+		Name:        "reindex_marbles",
+		Description: "build the marble indexes for a batch of marbles created before them",
+		Args:        []ArgSpec{number_arg("batchSize", format_page_size, "marbles per batch, 1 to 50"), allow_empty(arg("bookmark", format_marble_id, "bookmark from the previous batch, empty for the first batch"))},
+		Mutates:     true,
+		Role:        role_admin,
+		Handler:     reindex_marbles,
+	})
+	register_function(ChaincodeFunction{
+		Name:        "set_payment_rail",
+		Description: "pick the payment rail offers are settled on",
+		Args:        []ArgSpec{arg("rail", format_text, "registered rail, e.g. 'stellar_public'")},
+		Mutates:     true,
+		Role:        role_admin,
+		Handler:     set_payment_rail,
+	})
+	register_function(ChaincodeFunction{
+		Name:        "set_stellar_config",
+		Description: "point a stellar rail at a Horizon server",
+		Args: []ArgSpec{
+			arg("rail", format_text, "stellar rail to configure, e.g. 'stellar_public'"),
+			arg("horizonUrl", format_text, "http(s) url of the Horizon server"),
+			arg("networkPassphrase", format_text, "stellar network passphrase"),
+			number_arg("timeoutMs", format_number, "request timeout, 1 to 60000"),
+			number_arg("retries", format_number, "retries per request, 0 to 5"),
+			optional(arg("assetCode", format_text, "asset offers are priced in, 'native' for lumens")),
+			optional(arg("assetIssuer", format_stellar_account, "issuer of the asset, needed with any asset code but 'native'")),
+		},
+		Mutates: true,
+		Role:    role_admin,
+		Handler: set_stellar_config,
+	})
+	register_function(ChaincodeFunction{
+		Name:        "set_auth_mode",
+		Description: "switch between migration window and strict cert checks",
+		Args:        []ArgSpec{arg("mode", format_text, "'migration' or 'strict'")},
+		Mutates:     true,
+		Role:        role_admin,
+		Handler:     set_auth_mode,
+	})
+	register_function(ChaincodeFunction{
+		Name:        "set_msp_company",
+		Description: "map an MSP ID to a company",
+		Args:        []ArgSpec{arg("mspId", format_text, "MSP ID"), arg("company", format_company, "company")},
+		Mutates:     true,
+		Role:        role_admin,
+		Handler:     set_msp_company,
+	})
+	register_function(ChaincodeFunction{
+		Name:        "migration_plan",
+		Description: "find the stored documents in a batch that migrate has to upgrade",
+		Args:        []ArgSpec{number_arg("pageSize", format_page_size, "documents per batch, 1 to 50"), allow_empty(arg("bookmark", format_bookmark, "bookmark from the previous plan, empty for the first plan"))},
+		Role:        role_admin,
+		Handler:     migration_plan,
+	})
+	register_function(ChaincodeFunction{
+		Name:        "migrate",
+		Description: "upgrade the stored documents a migration plan found to the current schema version",
+		Args:        []ArgSpec{json_arg("keys", "the keys from migration_plan, a JSON array")},
+		Mutates:     true,
+		Role:        role_admin,
+		Handler:     migrate,
+	})
+	register_function(ChaincodeFunction{
+		Name:        "validate_ledger",
+		Description: "report every stored document that fails to unmarshal or is missing required fields",
+		Role:        role_admin,
+		Handler:     validate_ledger,
+	})
+}
@@ -0,0 +1,67 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestDescribeSaysWhatSuccessReturns(t *testing.T) {
+	stub := new_test_stub(t)
+	res := stub.must("describe")
+	var catalogue []ChaincodeFunction
+	if err := json.Unmarshal(res.Payload, &catalogue); err != nil || len(catalogue) == 0 {
+		t.Fatalf("describe should list the functions, got %s", res.Payload)
+	}
+	for _, function := range catalogue {
+		if (function.Mutates && function.Returns != returns_envelope) || (!function.Mutates && function.Returns != returns_document) {
+			t.Errorf("%s mutates: %v but returns %s", function.Name, function.Mutates, function.Returns)
+		}
+	}
+}
+
+func TestHelperErrorsKeepTheirCode(t *testing.T) {
+	stub := new_test_stub(t)
+	stub.put_fixture(msp_company_map_key, "{not json")
+	_, err := get_msp_companies(stub)
+	if error_code(err) != code_record_invalid || error_message(err) != "The MSP company map is corrupt - invalid character 'n' looking for beginning of object key string" {
+		t.Fatalf("A corrupt company map should be %s, got %v", code_record_invalid, err)
+	}
+
+	_, err = parse_stellar_amount("1.23456789")
+	if error_code(err) != code_payment_not_verified {
+		t.Fatalf("A bad amount should be %s, got %v", code_payment_not_verified, err)
+	}
+}
+
+func TestReadEverythingIgnoresAnEmptyArg(t *testing.T) {
+	stub := new_test_stub(t)
+	stub.put_fixture("m1", `{"docType":"marble","schemaVersion":2,"id":"m1","color":"blue","size":35,"owner":{"id":"o1","username":"alice","company":"United Marbles"}}`)
+	for _, args := range [][]string{{}, {""}} {
+		res := stub.must("read_everything", args...)
+		var everything struct {
+			Marbles []Marble `json:"marbles"`
+		}
+		if err := json.Unmarshal(res.Payload, &everything); err != nil || len(everything.Marbles) != 1 {
+			t.Fatalf("read_everything %q should return m1, got %s", args, res.Payload)
+		}
+	}
+}
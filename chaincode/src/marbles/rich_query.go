@@ -0,0 +1,242 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ============================================================================================================================
+// Marble Rich Queries
+//
+// Clients never send a raw CouchDB selector, they send a MarbleQuery and we build the selector from it.
+// Unknown fields are rejected, so a client can only search on what the shipped indexes cover
+// (see META-INF/statedb/couchdb/indexes). CouchDB can only sort with an index over exactly the sort fields, in one
+// direction, so only the sorts in marble_sort_indexes are allowed.
+// Rich queries only work when the peer uses CouchDB as its state database.
+//
+// Rich query results are not re-checked at commit time, only use them for reads, never to decide a write.
+// ============================================================================================================================
+
+// ----- Queries ----- //
+type MarbleQuery struct {
+	Owner     string            `json:"owner"`   //owner id
+	Company   string            `json:"company"` //owner's company
+	Color     string            `json:"color"`
+	MinSize   *int              `json:"minSize"`
+	MaxSize   *int              `json:"maxSize"`
+	IsForSale *bool             `json:"isForSale"`
+	MinPrice  *int              `json:"minPrice"` //bounds on the marble's minPrice
+	MaxPrice  *int              `json:"maxPrice"`
+	Sort      []MarbleQuerySort `json:"sort"`
+}
+
+type MarbleQuerySort struct {
+	Field string `json:"field"` //one of the keys in marble_sort_fields
+	Order string `json:"order"` //"asc" or "desc"
+}
+
+// sortable fields - query name -> document field
+var marble_sort_fields = map[string]string{
+	"id":       "id",
+	"owner":    "owner.id",
+	"company":  "owner.company",
+	"color":    "color",
+	"size":     "size",
+	"minPrice": "minPrice",
+}
+
+// allowed sorts - comma separated sort fields -> index over docType and those fields
+var marble_sort_indexes = map[string]string{
+	"id":            "indexId",
+	"owner":         "indexOwner",
+	"company":       "indexCompany",
+	"color":         "indexColor",
+	"size":          "indexSize",
+	"minPrice":      "indexMinPrice",
+	"color,size":    "indexColorSize",
+	"company,owner": "indexCompanyOwner",
+	"size,minPrice": "indexSizeMinPrice",
+	"minPrice,size": "indexMinPriceSize",
+}
+
+// ============================================================================================================================
+// Parse Marble Query - parse a MarbleQuery JSON string, rejecting any field that is not in the allowlist
+// ============================================================================================================================
+func parse_marble_query(queryJson string) (MarbleQuery, error) {
+	var query MarbleQuery
+	decoder := json.NewDecoder(bytes.NewReader([]byte(queryJson)))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&query)
+	if err != nil {
+		return query, new_error(code_invalid_argument, "Bad marble query - "+err.Error())
+	}
+
+	for _, sort := range query.Sort {
+		if _, ok := marble_sort_fields[sort.Field]; !ok {
+			return query, new_error(code_invalid_argument, "Cannot sort marbles by '"+sort.Field+"'")
+		}
+		if sort.Order != "asc" && sort.Order != "desc" {
+			return query, new_error(code_invalid_argument, "Sort order must be 'asc' or 'desc'")
+		}
+		if sort.Order != query.Sort[0].Order {
+			return query, new_error(code_invalid_argument, "All sort fields must have the same order")
+		}
+	}
+	if len(query.Sort) > 0 {
+		if _, ok := marble_sort_indexes[sort_key(query.Sort)]; !ok {
+			return query, new_error(code_invalid_argument, "No index to sort marbles by '"+sort_key(query.Sort)+"'")
+		}
+	}
+	return query, nil
+}
+
+// the key of a sort in marble_sort_indexes
+func sort_key(sort []MarbleQuerySort) string {
+	var fields []string
+	for _, s := range sort {
+		fields = append(fields, s.Field)
+	}
+	return strings.Join(fields, ",")
+}
+
+// ============================================================================================================================
+// Build Marble Selector - turn a MarbleQuery into a CouchDB query string
+// ============================================================================================================================
+func build_marble_selector(query MarbleQuery) (string, error) {
+	selector := map[string]interface{}{
+		"docType": "marble",
+	}
+	if len(query.Owner) > 0 {
+		selector["owner.id"] = query.Owner
+	}
+	if len(query.Company) > 0 {
+		selector["owner.company"] = query.Company
+	}
+	if len(query.Color) > 0 {
+		selector["color"] = strings.ToLower(query.Color) //marbles are stored with lowercase colors
+	}
+	if query.IsForSale != nil {
+		selector["isForSale"] = *query.IsForSale
+	}
+	err := add_range(selector, "size", query.MinSize, query.MaxSize)
+	if err != nil {
+		return "", err
+	}
+	err = add_range(selector, "minPrice", query.MinPrice, query.MaxPrice)
+	if err != nil {
+		return "", err
+	}
+
+	// couchdb can only sort on fields that are in the selector, the docType sort lets it use our indexes
+	var sort []map[string]string
+	if len(query.Sort) > 0 {
+		sort = append(sort, map[string]string{"docType": query.Sort[0].Order})
+	}
+	for _, s := range query.Sort {
+		field := marble_sort_fields[s.Field]
+		if _, ok := selector[field]; !ok {
+			selector[field] = map[string]interface{}{"$gt": nil}
+		}
+		sort = append(sort, map[string]string{field: s.Order})
+	}
+
+	couchQuery := map[string]interface{}{
+		"selector": selector,
+	}
+	if len(sort) > 0 {
+		index := marble_sort_indexes[sort_key(query.Sort)]
+		couchQuery["sort"] = sort
+		couchQuery["use_index"] = []string{index + "Doc", index}
+	}
+	queryAsBytes, err := json.Marshal(couchQuery)
+	if err != nil {
+		return "", err
+	}
+	return string(queryAsBytes), nil
+}
+
+func add_range(selector map[string]interface{}, field string, min *int, max *int) error {
+	if min == nil && max == nil {
+		return nil
+	}
+	bounds := map[string]interface{}{}
+	if min != nil {
+		bounds["$gte"] = *min
+	}
+	if max != nil {
+		bounds["$lte"] = *max
+	}
+	if min != nil && max != nil && *min > *max {
+		return new_error(code_invalid_argument, "The "+field+" range is empty")
+	}
+	selector[field] = bounds
+	return nil
+}
+
+// ============================================================================================================================
+// Get Marbles By Query - run a CouchDB query and collect the marbles
+// ============================================================================================================================
+func get_marbles_by_query(stub shim.ChaincodeStubInterface, couchQuery string) ([]Marble, error) {
+	resultsIterator, err := stub.GetQueryResult(couchQuery)
+	if err != nil {
+		return []Marble{}, new_error(code_ledger_error, "Rich query failed, is the state database CouchDB? - "+err.Error())
+	}
+	defer resultsIterator.Close()
+	return collect_marbles(resultsIterator)
+}
+
+// ============================================================================================================================
+// Get Marbles By Query With Pagination - one page of get_marbles_by_query()
+// ============================================================================================================================
+func get_marbles_by_query_with_pagination(stub shim.ChaincodeStubInterface, couchQuery string, pageSize int32, bookmark string) ([]Marble, *pb.QueryResponseMetadata, error) {
+	resultsIterator, metadata, err := stub.GetQueryResultWithPagination(couchQuery, pageSize, bookmark)
+	if err != nil {
+		return []Marble{}, nil, new_error(code_ledger_error, "Rich query failed, is the state database CouchDB? - "+err.Error())
+	}
+	defer resultsIterator.Close()
+	marbles, err := collect_marbles(resultsIterator)
+	return marbles, metadata, err
+}
+
+// ============================================================================================================================
+// Collect Marbles - read the marbles out of an iterator over marble documents
+// ============================================================================================================================
+func collect_marbles(resultsIterator shim.StateQueryIteratorInterface) ([]Marble, error) {
+	marbles := []Marble{}
+	for resultsIterator.HasNext() {
+		aKeyValue, err := resultsIterator.Next()
+		if err != nil {
+			return marbles, err
+		}
+		var marble Marble
+		err = unmarshal_record(aKeyValue.Key, aKeyValue.Value, &marble) //un stringify it aka JSON.parse()
+		if err != nil {
+			return marbles, err
+		}
+		marbles = append(marbles, marble)
+	}
+	return marbles, nil
+}
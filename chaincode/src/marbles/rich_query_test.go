@@ -0,0 +1,101 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMarbleQueryColorIsLowercased(t *testing.T) {
+	query, err := parse_marble_query(`{"color": "Blue"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	couchQuery, _ := build_marble_selector(query)
+	var built struct {
+		Selector map[string]interface{} `json:"selector"`
+	}
+	json.Unmarshal([]byte(couchQuery), &built)
+	if built.Selector["color"] != "blue" {
+		t.Fatalf("Color should be matched in lowercase, got %s", couchQuery)
+	}
+}
+
+func TestMarbleQuerySortsNeedAnIndex(t *testing.T) {
+	for sort, ok := range map[string]bool{
+		`[{"field": "size", "order": "asc"}]`:                                        true,
+		`[{"field": "color", "order": "desc"}, {"field": "size", "order": "desc"}]`:  true,
+		`[{"field": "company", "order": "asc"}, {"field": "owner", "order": "asc"}]`: true,
+		`[{"field": "size", "order": "asc"}, {"field": "color", "order": "asc"}]`:    false, //no index in that order
+		`[{"field": "color", "order": "asc"}, {"field": "size", "order": "desc"}]`:   false, //couchdb sorts one way
+		`[{"field": "id", "order": "asc"}, {"field": "size", "order": "asc"}]`:       false,
+		`[{"field": "docType", "order": "asc"}]`:                                     false,
+	} {
+		query, err := parse_marble_query(`{"sort": ` + sort + `}`)
+		if ok != (err == nil) {
+			t.Errorf("Sort %s should be allowed: %v, got %v", sort, ok, err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		// the query names the index that covers the sort
+		couchQuery, _ := build_marble_selector(query)
+		var built struct {
+			UseIndex []string `json:"use_index"`
+		}
+		json.Unmarshal([]byte(couchQuery), &built)
+		index := marble_sort_indexes[sort_key(query.Sort)]
+		if !reflect.DeepEqual(built.UseIndex, []string{index + "Doc", index}) {
+			t.Errorf("Sort %s should use %s, got %s", sort, index, couchQuery)
+		}
+	}
+}
+
+func TestMarbleSortIndexesAreShipped(t *testing.T) {
+	for key, index := range marble_sort_indexes {
+		var definition struct {
+			Index struct {
+				Fields []string `json:"fields"`
+			} `json:"index"`
+			Ddoc string `json:"ddoc"`
+			Name string `json:"name"`
+		}
+		indexAsBytes, err := ioutil.ReadFile("META-INF/statedb/couchdb/indexes/" + index + ".json")
+		if err != nil {
+			t.Errorf("Index %s for sort %s is not shipped - %s", index, key, err)
+			continue
+		}
+		json.Unmarshal(indexAsBytes, &definition)
+
+		fields := []string{"docType"}
+		for _, field := range strings.Split(key, ",") {
+			fields = append(fields, marble_sort_fields[field])
+		}
+		if definition.Name != index || definition.Ddoc != index+"Doc" || !reflect.DeepEqual(definition.Index.Fields, fields) {
+			t.Errorf("Index %s should cover %v, got %+v", index, fields, definition)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ============================================================================================================================
+// Sales
+//
+// settle_offer() writes a sale record for every completed sale under sale -> [marble id, tx id], they are never
+// changed. Sales are also indexed under color~size~sale -> [color, size bucket, marble id, tx id] for market stats.
+// ============================================================================================================================
+const sale_stats_index = "color~size~sale"
+const size_bucket_width = 10 //mm, sizes 10-19 share a bucket, 20-29 the next...
+
+// ----- Sales ----- //
+type Sale struct {
+	ObjectType    string       `json:"docType"`       //field for couchdb
+	SchemaVersion int          `json:"schemaVersion"` //see schema.go
+	MarbleId      string       `json:"marbleId"`
+	OfferId       string       `json:"offerId"`
+	SellerId      string       `json:"sellerId"`
+	BuyerId       string       `json:"buyerId"`
+	Color         string       `json:"color"`      //marble's color when sold
+	Size          int          `json:"size"`       //marble's size when sold
+	Price         int          `json:"price"`      //whole units of Asset
+	Asset         PaymentAsset `json:"asset"`      //what the buyer paid in
+	PaymentRef    string       `json:"paymentRef"` //stellar tx hash of the payment
+	Rail          string       `json:"rail"`       //rail or "oracle" the payment was verified with
+	TxId          string       `json:"txId"`       //fabric tx that settled the sale
+	Timestamp     int64        `json:"timestamp"`  //tx timestamp in ms since epoch
+}
+
+// ============================================================================================================================
+// Put Sale - store a sale record, sales are written once and never changed
+// ============================================================================================================================
+func put_sale(stub shim.ChaincodeStubInterface, sale Sale) error {
+	key, err := stub.CreateCompositeKey("sale", []string{sale.MarbleId, sale.TxId})
+	if err != nil {
+		return err
+	}
+	sale.SchemaVersion = schema_version
+	saleAsBytes, err := marshal_record(sale.MarbleId+"/"+sale.TxId, sale) //convert to array of bytes
+	if err != nil {
+		return err
+	}
+	err = stub.PutState(key, saleAsBytes)
+	if err != nil {
+		return new_error(code_ledger_error, "Could not store sale of marble - "+sale.MarbleId)
+	}
+
+	statsKey, err := stub.CreateCompositeKey(sale_stats_index, []string{sale.Color, size_bucket(sale.Size), sale.MarbleId, sale.TxId})
+	if err != nil {
+		return err
+	}
+	return stub.PutState(statsKey, []byte{0x00}) //the key is all we need, the sale is read from its own key
+}
+
+// ============================================================================================================================
+// Size Bucket - the bucket a size falls in, e.g. 35 -> "30-39"
+// ============================================================================================================================
+func size_bucket(size int) string {
+	low := size - size%size_bucket_width
+	return strconv.Itoa(low) + "-" + strconv.Itoa(low+size_bucket_width-1)
+}
+
+// ============================================================================================================================
+// Get Sale - get one sale record
+// ============================================================================================================================
+func get_sale(stub shim.ChaincodeStubInterface, marbleId string, txId string) (Sale, error) {
+	var sale Sale
+	key, err := stub.CreateCompositeKey("sale", []string{marbleId, txId})
+	if err != nil {
+		return sale, err
+	}
+	saleAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return sale, new_error(code_ledger_error, "Failed to get sale of marble - "+marbleId)
+	}
+	if len(saleAsBytes) == 0 { //test if sale is actually here or just nil
+		return sale, new_error(code_record_invalid, "Sale does not exist - "+marbleId+" "+txId)
+	}
+	err = unmarshal_record(marbleId+"/"+txId, saleAsBytes, &sale)
+	if err != nil {
+		return sale, err
+	}
+	return sale, check_record(marbleId+"/"+txId, sale)
+}
+
+// ============================================================================================================================
+// Get Marble Sales - every sale of a marble, oldest first
+// ============================================================================================================================
+func get_marble_sales(stub shim.ChaincodeStubInterface, marbleId string) ([]Sale, error) {
+	sales := []Sale{}
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("sale", []string{marbleId})
+	if err != nil {
+		return sales, err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		aKeyValue, err := resultsIterator.Next()
+		if err != nil {
+			return sales, err
+		}
+		var sale Sale
+		err = unmarshal_record(marbleId, aKeyValue.Value, &sale)
+		if err == nil {
+			err = check_record(marbleId+"/"+sale.TxId, sale)
+		}
+		if err != nil {
+			return sales, err
+		}
+		sales = append(sales, sale)
+	}
+	sort.SliceStable(sales, func(i, j int) bool { return sales[i].Timestamp < sales[j].Timestamp })
+	return sales, nil
+}
+
+// ----- Price Stats ----- //
+type PriceStats struct {
+	Color      string       `json:"color"`
+	SizeBucket string       `json:"sizeBucket"` //e.g. "30-39"
+	Asset      PaymentAsset `json:"asset"`      //prices in different assets are never mixed
+	Count      int          `json:"count"`      //number of sales
+	Volume     int          `json:"volume"`     //sum of the sale prices
+	Last       int          `json:"last"`       //price of the newest sale
+	LastAt     int64        `json:"lastAt"`     //when the newest sale was, ms since epoch
+	Min        int          `json:"min"`
+	Max        int          `json:"max"`
+	Mean       float64      `json:"mean"`
+}
+
+// ============================================================================================================================
+// Get Price History - every sale of a marble
+//
+// Inputs - Array of strings (all but the id are optional, see parse_history_options())
+//           0           ,       1        ,       2        ,   3
+//           id          ,   from (ms)    ,    to (ms)     , order
+//  "m01490985296352SjAyM", "1500000000000", "1600000000000", "desc"
+// ============================================================================================================================
+func getPriceHistory(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting getPriceHistory")
+
+	if len(args) < 1 || len(args) > 4 {
+		return new_error_response(code_invalid_argument, "Incorrect number of arguments. Expecting 1 to 4")
+	}
+
+	options, err := parse_history_options(args[1:])
+	if err != nil {
+		return error_response(err, code_invalid_argument)
+	}
+
+	sales, err := get_marble_sales(stub, args[0])
+	if err != nil {
+		return error_response(err, code_ledger_error)
+	}
+	history := []Sale{}
+	for _, sale := range sales {
+		if options.in_range(sale.Timestamp) {
+			history = append(history, sale)
+		}
+	}
+	if options.Descending {
+		sort.SliceStable(history, func(i, j int) bool { return history[i].Timestamp > history[j].Timestamp })
+	}
+
+	fmt.Println("- end getPriceHistory")
+	historyAsBytes, _ := json.Marshal(history) //convert to array of bytes
+	return shim.Success(historyAsBytes)
+}
+
+// ============================================================================================================================
+// Get Price Stats - last price, min, max, mean and volume of the sales of a color, per size bucket and asset
+//
+// Inputs - Array of strings (all but the color are optional, leave any of them empty for no filter)
+//     0   ,     1      ,       2        ,       3
+//   color , size bucket,   from (ms)    ,    to (ms)
+//  "blue" ,  "30-39"   , "1500000000000", "1600000000000"
+// ============================================================================================================================
+func getPriceStats(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting getPriceStats")
+
+	if len(args) < 1 || len(args) > 4 {
+		return new_error_response(code_invalid_argument, "Incorrect number of arguments. Expecting 1 to 4")
+	}
+
+	args = append(args, "", "", "")[:4] //fill in the defaults
+	color := strings.ToLower(args[0])   //colors are stored lower case
+	bucket := args[1]
+	options, err := parse_history_options(args[2:])
+	if err != nil {
+		return error_response(err, code_invalid_argument)
+	}
+
+	attributes := []string{color}
+	if len(bucket) > 0 {
+		attributes = append(attributes, bucket)
+	}
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(sale_stats_index, attributes)
+	if err != nil {
+		return error_response(err, code_ledger_error)
+	}
+	defer resultsIterator.Close()
+
+	statsByGroup := map[string]*PriceStats{}
+	var groups []string
+	for resultsIterator.HasNext() {
+		aKeyValue, err := resultsIterator.Next()
+		if err != nil {
+			return error_response(err, code_ledger_error)
+		}
+		_, keyParts, err := stub.SplitCompositeKey(aKeyValue.Key)
+		if err != nil || len(keyParts) != 4 {
+			continue
+		}
+		sale, err := get_sale(stub, keyParts[2], keyParts[3])
+		if err != nil || !options.in_range(sale.Timestamp) {
+			continue
+		}
+
+		group := keyParts[1] + "|" + sale.Asset.Code + "|" + sale.Asset.Issuer
+		stats, ok := statsByGroup[group]
+		if !ok {
+			stats = &PriceStats{Color: color, SizeBucket: keyParts[1], Asset: sale.Asset, Min: sale.Price, Max: sale.Price}
+			statsByGroup[group] = stats
+			groups = append(groups, group)
+		}
+		stats.Count++
+		stats.Volume += sale.Price
+		if sale.Price < stats.Min {
+			stats.Min = sale.Price
+		}
+		if sale.Price > stats.Max {
+			stats.Max = sale.Price
+		}
+		if sale.Timestamp >= stats.LastAt {
+			stats.Last = sale.Price
+			stats.LastAt = sale.Timestamp
+		}
+	}
+
+	sort.Strings(groups)
+	results := []PriceStats{}
+	for _, group := range groups {
+		stats := statsByGroup[group]
+		stats.Mean = float64(stats.Volume) / float64(stats.Count)
+		results = append(results, *stats)
+	}
+
+	fmt.Println("- end getPriceStats")
+	resultsAsBytes, _ := json.Marshal(results) //convert to array of bytes
+	return shim.Success(resultsAsBytes)
+}
@@ -0,0 +1,362 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ============================================================================================================================
+// Schema
+//
+// Every document is written by marshalling its struct, never by hand, and carries the schema version it was written
+// with. Documents are checked when they are read - they have to unmarshal, have their required fields and not come
+// from a newer chaincode than this one. Documents from before schemaVersion existed read as version 0.
+//
+// Bump schema_version whenever a document's layout changes.
+// ============================================================================================================================
+const schema_version = 2
+
+// plain keys that hold chaincode settings instead of documents, validate_ledger() skips them
+var settings_keys = append([]string{"selftest", "marbles_ui", schema_version_key, auth_mode_key, msp_company_map_key, payment_rail_key}, stellar_config_keys()...)
+
+// ----- Records ----- //
+type Record interface {
+	problems() []string //everything wrong with the document, empty if it is fine
+}
+
+// composite key namespace -> empty document of the type stored there
+// (the index namespaces only hold keys, they are not listed)
+var record_namespaces = map[string]func() Record{
+	"offer":                     func() Record { return &Offer{} },
+	"sale":                      func() Record { return &Sale{} },
+	"oracle":                    func() Record { return &Oracle{} },
+	"payment":                   func() Record { return &ConsumedPayment{} },
+	owner_activity_index:        func() Record { return &OwnerActivity{} },
+	legacy_owner_activity_index: func() Record { return &OwnerActivity{} }, //until migrate() moves them
+}
+
+// the order validate_ledger() and migration_plan() visit the namespaces in, after the plain keys
+var record_namespace_order = []string{"offer", "sale", "oracle", "payment", owner_activity_index, legacy_owner_activity_index}
+
+// docType -> empty document of that type, for plain keys
+var record_doc_types = map[string]func() Record{
+	"marble":       func() Record { return &Marble{} },
+	"marble_owner": func() Record { return &Owner{} },
+	"marble_offer": func() Record { return &Offer{} }, //offers from before the offer namespace
+}
+
+// ============================================================================================================================
+// Schema Problems - check a document's schema version
+// ============================================================================================================================
+func schema_problems(version int) []string {
+	if version < 0 || version > schema_version {
+		return []string{"schemaVersion " + strconv.Itoa(version) + " is not readable by this chaincode (reads up to " + strconv.Itoa(schema_version) + ")"}
+	}
+	return []string{}
+}
+
+// ============================================================================================================================
+// Require - add a problem if a required field is empty
+// ============================================================================================================================
+func require(problems []string, field string, value string) []string {
+	if len(value) == 0 {
+		return append(problems, "missing "+field)
+	}
+	return problems
+}
+
+// ============================================================================================================================
+// Require Doc Type - add a problem if the docType isn't one of the allowed ones
+// ============================================================================================================================
+func require_doc_type(problems []string, docType string, allowed ...string) []string {
+	for _, a := range allowed {
+		if docType == a {
+			return problems
+		}
+	}
+	return append(problems, "docType '"+docType+"' should be '"+allowed[0]+"'")
+}
+
+// ============================================================================================================================
+// Record Problems - what is wrong with each type of document
+// ============================================================================================================================
+func (marble Marble) problems() []string {
+	problems := schema_problems(marble.SchemaVersion)
+	problems = require_doc_type(problems, marble.ObjectType, "marble")
+	problems = require(problems, "id", marble.Id)
+	problems = require(problems, "color", marble.Color)
+	problems = require(problems, "owner.id", marble.Owner.Id)
+	problems = require(problems, "owner.company", marble.Owner.Company)
+	if marble.Size <= 0 {
+		problems = append(problems, "size must be above 0")
+	}
+	if marble.MinPrice < 0 {
+		problems = append(problems, "minPrice must not be negative")
+	}
+	if marble.Escrow != nil {
+		problems = require(problems, "escrow.offerId", marble.Escrow.OfferId)
+	}
+	return problems
+}
+
+func (owner Owner) problems() []string {
+	problems := schema_problems(owner.SchemaVersion)
+	problems = require_doc_type(problems, owner.ObjectType, "marble_owner")
+	problems = require(problems, "id", owner.Id)
+	problems = require(problems, "username", owner.Username)
+	problems = require(problems, "company", owner.Company)
+	return problems
+}
+
+func (offer Offer) problems() []string {
+	problems := schema_problems(offer.SchemaVersion)
+	problems = require_doc_type(problems, offer.ObjectType, "marble_offer", "") //offers had no docType at first
+	problems = require(problems, "id", offer.Id)
+	problems = require(problems, "marble.id", offer.Marble.Id)
+	problems = require(problems, "buyer.id", offer.Buyer.Id)
+	if _, ok := offer_transitions[offer.Status]; !ok || len(offer.Status) == 0 {
+		problems = append(problems, "status '"+offer.Status+"' is not an offer status")
+	}
+	if offer.OfferPrice <= 0 {
+		problems = append(problems, "offerPrice must be above 0")
+	}
+	return problems
+}
+
+func (sale Sale) problems() []string {
+	problems := schema_problems(sale.SchemaVersion)
+	problems = require_doc_type(problems, sale.ObjectType, "marble_sale")
+	problems = require(problems, "marbleId", sale.MarbleId)
+	problems = require(problems, "offerId", sale.OfferId)
+	problems = require(problems, "sellerId", sale.SellerId)
+	problems = require(problems, "buyerId", sale.BuyerId)
+	problems = require(problems, "paymentRef", sale.PaymentRef)
+	problems = require(problems, "txId", sale.TxId)
+	if sale.Price <= 0 {
+		problems = append(problems, "price must be above 0")
+	}
+	return problems
+}
+
+func (oracle Oracle) problems() []string {
+	problems := schema_problems(oracle.SchemaVersion)
+	problems = require_doc_type(problems, oracle.ObjectType, "payment_oracle")
+	problems = require(problems, "id", oracle.Id)
+	problems = require(problems, "publicKey", oracle.PublicKey)
+	return problems
+}
+
+func (consumed ConsumedPayment) problems() []string {
+	problems := schema_problems(consumed.SchemaVersion)
+	problems = require_doc_type(problems, consumed.ObjectType, "consumed_payment")
+	problems = require(problems, "paymentRef", consumed.PaymentRef)
+	problems = require(problems, "offerId", consumed.OfferId)
+	problems = require(problems, "txId", consumed.TxId)
+	return problems
+}
+
+func (activity OwnerActivity) problems() []string {
+	problems := schema_problems(activity.SchemaVersion)
+	problems = require_doc_type(problems, activity.ObjectType, "owner_activity")
+	problems = require(problems, "ownerId", activity.OwnerId)
+	problems = require(problems, "activity", activity.Activity)
+	problems = require(problems, "txId", activity.TxId)
+	return problems
+}
+
+// ============================================================================================================================
+// Unmarshal Record - un stringify a document read from the ledger, upgraded to the current schema (see migrations.go)
+// ============================================================================================================================
+func unmarshal_record(key string, valAsBytes []byte, record Record) error {
+	upgradedAsBytes, _, err := upgrade_document(valAsBytes)
+	if err != nil {
+		return new_error(code_record_invalid, "Record "+key+" "+error_message(err))
+	}
+	err = json.Unmarshal(upgradedAsBytes, record) //un stringify it aka JSON.parse()
+	if err != nil {
+		return new_error(code_record_invalid, "Record "+key+" does not fit its type - "+err.Error())
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// Check Record - error listing everything wrong with a document
+// ============================================================================================================================
+func check_record(key string, record Record) error {
+	problems := record.problems()
+	if len(problems) > 0 {
+		return new_error(code_record_invalid, "Record "+key+" is invalid - "+strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// Marshal Record - check a document and stringify it for the ledger, callers set its SchemaVersion first
+// ============================================================================================================================
+func marshal_record(key string, record Record) ([]byte, error) {
+	err := check_record(key, record)
+	if err != nil {
+		return nil, err
+	}
+	recordAsBytes, _ := json.Marshal(record) //convert to array of bytes
+	return recordAsBytes, nil
+}
+
+// ----- Ledger Report ----- //
+type LedgerReport struct {
+	SchemaVersion int             `json:"schemaVersion"` //version this chaincode writes
+	Scanned       int             `json:"scanned"`       //documents checked, settings and index keys are not counted
+	Versions      map[string]int  `json:"versions"`      //schemaVersion -> number of documents with it
+	Invalid       []InvalidRecord `json:"invalid"`
+}
+
+type InvalidRecord struct {
+	Namespace string   `json:"namespace,omitempty"` //composite key namespace, empty for plain keys
+	Key       string   `json:"key"`                 //plain key, or the composite key's attributes joined with "/"
+	DocType   string   `json:"docType"`
+	Problems  []string `json:"problems"`
+}
+
+// ============================================================================================================================
+// Validate Record - check one document and add it to the report
+//
+// newRecord is nil when we can't tell what type of document it is
+// ============================================================================================================================
+func validate_record(report *LedgerReport, namespace string, key string, valAsBytes []byte, newRecord func() Record) {
+	var probe struct {
+		ObjectType    string `json:"docType"`
+		SchemaVersion int    `json:"schemaVersion"`
+		Id            string `json:"id"`
+	}
+	invalid := InvalidRecord{Namespace: namespace, Key: key, Problems: []string{}}
+	report.Scanned++
+
+	err := json.Unmarshal(valAsBytes, &probe) //un stringify it aka JSON.parse()
+	if err != nil {
+		invalid.Problems = append(invalid.Problems, "not valid JSON - "+err.Error())
+		report.Invalid = append(report.Invalid, invalid)
+		return
+	}
+	invalid.DocType = probe.ObjectType
+	report.Versions[strconv.Itoa(probe.SchemaVersion)]++
+
+	if newRecord == nil {
+		invalid.Problems = append(invalid.Problems, "unknown docType '"+probe.ObjectType+"'")
+		report.Invalid = append(report.Invalid, invalid)
+		return
+	}
+	record := newRecord()
+	upgradedAsBytes, _, err := upgrade_document(valAsBytes) //check it the way it would be read, see migrations.go
+	if err == nil {
+		err = json.Unmarshal(upgradedAsBytes, record) //un stringify it aka JSON.parse()
+	}
+	if err != nil {
+		invalid.Problems = append(invalid.Problems, "can't be read as a "+probe.ObjectType+" - "+error_message(err))
+	} else {
+		invalid.Problems = record.problems()
+	}
+	if len(namespace) == 0 && probe.Id != key {
+		invalid.Problems = append(invalid.Problems, "id '"+probe.Id+"' does not match its key")
+	}
+	if len(invalid.Problems) > 0 {
+		report.Invalid = append(report.Invalid, invalid)
+	}
+}
+
+// ============================================================================================================================
+// Plain Key Record Type - the document type for a plain key, offers from before offers had a docType are found by status
+// ============================================================================================================================
+func plain_key_record_type(valAsBytes []byte) func() Record {
+	var probe struct {
+		ObjectType string `json:"docType"`
+		Status     string `json:"status"`
+	}
+	json.Unmarshal(valAsBytes, &probe) //un stringify it aka JSON.parse()
+	if len(probe.ObjectType) == 0 && len(probe.Status) > 0 {
+		return record_doc_types["marble_offer"]
+	}
+	return record_doc_types[probe.ObjectType]
+}
+
+// ============================================================================================================================
+// Validate Ledger - scan every document in state and report the ones that don't read (admin only)
+//
+// Plain keys (marbles, owners, legacy offers) are checked by their docType, composite keys by their namespace.
+// Index keys and settings are skipped.
+//
+// Inputs - none
+// ============================================================================================================================
+func validate_ledger(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting validate_ledger")
+
+	if len(args) != 0 {
+		return new_error_response(code_invalid_argument, "Incorrect number of arguments. Expecting 0")
+	}
+
+	report := LedgerReport{SchemaVersion: schema_version, Versions: map[string]int{}, Invalid: []InvalidRecord{}}
+	settings := map[string]bool{}
+	for _, key := range settings_keys {
+		settings[key] = true
+	}
+
+	// plain keys, the range skips composite keys
+	resultsIterator, err := stub.GetStateByRange("", "")
+	if err != nil {
+		return error_response(err, code_ledger_error)
+	}
+	defer resultsIterator.Close()
+	for resultsIterator.HasNext() {
+		aKeyValue, err := resultsIterator.Next()
+		if err != nil {
+			return error_response(err, code_ledger_error)
+		}
+		if settings[aKeyValue.Key] {
+			continue
+		}
+		validate_record(&report, "", aKeyValue.Key, aKeyValue.Value, plain_key_record_type(aKeyValue.Value))
+	}
+
+	// composite keys, one namespace at a time
+	for _, namespace := range record_namespace_order {
+		namespaceIterator, err := stub.GetStateByPartialCompositeKey(namespace, []string{})
+		if err != nil {
+			return error_response(err, code_ledger_error)
+		}
+		defer namespaceIterator.Close()
+		for namespaceIterator.HasNext() {
+			aKeyValue, err := namespaceIterator.Next()
+			if err != nil {
+				return error_response(err, code_ledger_error)
+			}
+			validate_record(&report, namespace, display_key(stub, namespace, aKeyValue.Key), aKeyValue.Value, record_namespaces[namespace])
+		}
+	}
+
+	fmt.Println("- end validate_ledger, " + strconv.Itoa(len(report.Invalid)) + " of " + strconv.Itoa(report.Scanned) + " invalid")
+	reportAsBytes, _ := json.Marshal(report) //convert to array of bytes
+	return shim.Success(reportAsBytes)
+}
@@ -0,0 +1,63 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSettlementReleasesEscrowAndClosesOtherOffers(t *testing.T) {
+	stub := new_market(t)
+	stub.offer_for("m1", "offer1", true)
+	stub.as_buyer()
+	stub.must("make_offer", "m1", "o3", buyer_company, "120", "offer2")
+	stub.must("make_offer", "m2", "o3", buyer_company, "120", "offer3")
+
+	stub.must("payment_complete_against_offer", "offer1", pay("offer1", 150))
+	stub.expect_status("offer1", offer_completed)
+	stub.expect_status("offer2", offer_rejected)
+	stub.expect_status("offer3", offer_proposed) //another marble
+	if marble := stub.marble("m1"); marble.Escrow != nil || marble.Owner.Id != "o2" {
+		t.Fatalf("Settling should hand the marble over out of escrow, got %+v", marble)
+	}
+
+	// deleting a marble expires its offers
+	stub.as_seller()
+	stub.must("delete_marble", "m2", seller_company)
+	stub.expect_status("offer3", offer_expired)
+}
+
+func TestSettlementNeedsAMatchingPayment(t *testing.T) {
+	stub := new_market(t)
+	stub.offer_for("m1", "offer1", true)
+
+	stub.expect_code(code_payment_not_verified, "payment_complete_against_offer", "offer1", pay("offer1", 149))
+	stub.expect_code(code_payment_not_verified, "payment_complete_against_offer", "offer1", pay("offer2", 150))
+	stub.expect_code(code_payment_not_verified, "payment_complete_against_offer", "offer1", strings.Repeat("f", 64))
+	stub.expect_status("offer1", offer_accepted)
+	if marble := stub.marble("m1"); marble.Owner.Id != "o1" || marble.Escrow == nil {
+		t.Fatalf("A failed settlement should leave the marble alone, got %+v", marble)
+	}
+
+	// an unregistered rail can't verify anything
+	stub.state[payment_rail_key] = []byte("nowhere")
+	stub.expect_code(code_payment_rail_unavailable, "payment_complete_against_offer", "offer1", pay("offer1", 150))
+}
@@ -0,0 +1,474 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stellar/go/clients/horizon"
+	hProtocol "github.com/stellar/go/protocols/horizon"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Horizon servers for the stellar rails
+const stellar_testnet_URL = "https://horizon-testnet.stellar.org"
+const stellar_public_URL = "https://horizon.stellar.org"
+const stellar_local_URL = "http://localhost:8000" //standalone network, e.g. the stellar/quickstart container
+
+// stellar amounts have 7 decimal places, 1 unit = 10,000,000 stroops
+const stroops_per_unit = 10000000
+
+// the stellar rails
+const stellar_testnet_rail = "stellar_testnet"
+const stellar_public_rail = "stellar_public"
+const stellar_local_rail = "stellar_local"
+
+var stellar_rails = []string{stellar_testnet_rail, stellar_public_rail, stellar_local_rail}
+
+// ledger keys for settings that override a rail's defaults, one per rail, see set_stellar_config()
+// stellar_config itself is from before configs were per rail, it is still read for the channel's current rail
+const stellar_config_key = "stellar_config"
+
+func stellar_config_key_for(rail string) string {
+	return stellar_config_key + "_" + rail
+}
+
+func stellar_config_keys() []string {
+	keys := []string{stellar_config_key}
+	for _, rail := range stellar_rails {
+		keys = append(keys, stellar_config_key_for(rail))
+	}
+	return keys
+}
+
+func init() {
+	register_payment_verifier(stellar_testnet_rail, &StellarPaymentVerifier{Rail: stellar_testnet_rail, Defaults: StellarConfig{
+		HorizonURL:        stellar_testnet_URL,
+		NetworkPassphrase: "Test SDF Network ; September 2015",
+		TimeoutMs:         10000,
+		Retries:           2,
+	}})
+	register_payment_verifier(stellar_public_rail, &StellarPaymentVerifier{Rail: stellar_public_rail, Defaults: StellarConfig{
+		HorizonURL:        stellar_public_URL,
+		NetworkPassphrase: "Public Global Stellar Network ; September 2015",
+		TimeoutMs:         10000,
+		Retries:           2,
+	}})
+	register_payment_verifier(stellar_local_rail, &StellarPaymentVerifier{Rail: stellar_local_rail, Defaults: StellarConfig{
+		HorizonURL:        stellar_local_URL,
+		NetworkPassphrase: "Standalone Network ; February 2017",
+		TimeoutMs:         5000,
+		Retries:           0,
+	}})
+}
+
+// ----- Stellar Settings ----- //
+type StellarConfig struct {
+	HorizonURL        string `json:"horizonUrl"`        //base url of the Horizon server, without a trailing slash
+	NetworkPassphrase string `json:"networkPassphrase"` //Horizon has to report this passphrase or we won't trust it
+	TimeoutMs         int    `json:"timeoutMs"`         //timeout per http request
+	Retries           int    `json:"retries"`           //extra attempts after a network error or 5xx
+	AssetCode         string `json:"assetCode"`         //asset new offers are priced in, "native" for lumens
+	AssetIssuer       string `json:"assetIssuer"`       //issuing account of the asset, empty for lumens
+}
+
+// ----- Assets ----- //
+type PaymentAsset struct {
+	Code   string `json:"code"`   //"native" for lumens
+	Issuer string `json:"issuer"` //empty for lumens
+}
+
+// ----- Stellar ----- //
+type StellarPaymentVerifier struct {
+	Rail     string        //rail name, its settings are stored under stellar_config_key_for(Rail)
+	Defaults StellarConfig //used for any setting not stored on the ledger
+}
+
+// VerifyPayment - payment reference is the stellar transaction id
+func (v *StellarPaymentVerifier) VerifyPayment(stub shim.ChaincodeStubInterface, offer *Offer, accountId string, paymentRef string) (bool, error) {
+	config, err := get_stellar_config(stub, v.Rail, v.Defaults)
+	if err != nil {
+		return false, err
+	}
+	return is_payment_done_for_offer(config, offer, accountId, paymentRef)
+}
+
+// ============================================================================================================================
+// Get Stellar Config - get a rail's stellar settings from ledger, filling in anything unset from the defaults
+// ============================================================================================================================
+func get_stellar_config(stub shim.ChaincodeStubInterface, rail string, defaults StellarConfig) (StellarConfig, error) {
+	var stored struct {
+		StellarConfig
+		Retries *int `json:"retries"` //0 retries is a setting, nil means it was never stored
+	}
+	config := defaults
+
+	configAsBytes, err := stub.GetState(stellar_config_key_for(rail))
+	if err != nil {
+		return config, new_error(code_ledger_error, "Failed to get stellar config for rail "+rail)
+	}
+	if len(configAsBytes) == 0 {
+		configAsBytes, err = get_legacy_stellar_config(stub, rail)
+		if err != nil {
+			return config, err
+		}
+	}
+	if len(configAsBytes) == 0 {
+		return config, nil
+	}
+	err = json.Unmarshal(configAsBytes, &stored) //un stringify it aka JSON.parse()
+	if err != nil {
+		return config, new_error(code_record_invalid, "The stellar config for rail "+rail+" is corrupt - "+err.Error())
+	}
+
+	if len(stored.HorizonURL) > 0 {
+		config.HorizonURL = stored.HorizonURL
+	}
+	if len(stored.NetworkPassphrase) > 0 {
+		config.NetworkPassphrase = stored.NetworkPassphrase
+	}
+	if stored.TimeoutMs > 0 {
+		config.TimeoutMs = stored.TimeoutMs
+	}
+	if stored.Retries != nil {
+		config.Retries = *stored.Retries
+	}
+	if len(stored.AssetCode) > 0 {
+		config.AssetCode = stored.AssetCode
+		config.AssetIssuer = stored.AssetIssuer
+	}
+	return config, nil
+}
+
+// ============================================================================================================================
+// Get Legacy Stellar Config - the config stored before configs were per rail, it was for the channel's current rail
+// ============================================================================================================================
+func get_legacy_stellar_config(stub shim.ChaincodeStubInterface, rail string) ([]byte, error) {
+	current, _, err := get_payment_verifier(stub)
+	if current != rail {
+		return nil, nil //it was written for whichever rail was current
+	}
+	if err != nil {
+		return nil, err
+	}
+	configAsBytes, err := stub.GetState(stellar_config_key)
+	if err != nil {
+		return nil, new_error(code_ledger_error, "Failed to get stellar config")
+	}
+	return configAsBytes, nil
+}
+
+// ============================================================================================================================
+// Get Offer Asset - the asset new offers are priced in, lumens unless set_stellar_config() picked another for the rail
+// ============================================================================================================================
+func get_offer_asset(stub shim.ChaincodeStubInterface) (PaymentAsset, error) {
+	rail, _, err := get_payment_verifier(stub)
+	if err != nil && error_code(err) != code_payment_rail_unavailable {
+		return PaymentAsset{}, err
+	}
+	config, err := get_stellar_config(stub, rail, StellarConfig{})
+	if err != nil {
+		return PaymentAsset{}, err
+	}
+	if len(config.AssetCode) == 0 || config.AssetCode == "native" {
+		return PaymentAsset{Code: "native"}, nil
+	}
+	return PaymentAsset{Code: config.AssetCode, Issuer: config.AssetIssuer}, nil
+}
+
+// ============================================================================================================================
+// Set Stellar Config - store a rail's Horizon server, network passphrase and http settings on the ledger (admin only)
+//
+// Each rail has its own settings, switching rails with set_payment_rail() never points one network at another's server.
+// An asset other than lumens needs its issuer.
+//
+// Inputs - Array of Strings
+//         0       ,                 1                 ,                  2                 ,     3     ,    4   ,  5 (optional) ,    6 (optional)
+//       rail      ,            horizon url            ,          network passphrase        , timeout ms, retries,  asset code   ,    asset issuer
+// "stellar_testnet", "https://horizon-testnet.stellar.org", "Test SDF Network ; September 2015",  "10000"  ,  "2"   ,    "USD"      , "GBUYUAI75XXWDZEKLY66CFYKQPET5JR4EENXZBUZ3YXZ7DS56Z4OKOFU"
+// ============================================================================================================================
+func set_stellar_config(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting set_stellar_config")
+
+	if len(args) < 5 || len(args) > 7 {
+		return new_error_response(code_invalid_argument, "Incorrect number of arguments. Expecting 5 to 7")
+	}
+
+	rail := args[0]
+	if _, ok := payment_verifiers[rail].(*StellarPaymentVerifier); !ok {
+		return new_error_response(code_invalid_argument, "1st argument must be a stellar rail, one of: "+strings.Join(stellar_rails, ", "))
+	}
+
+	var config StellarConfig
+	config.HorizonURL = strings.TrimRight(args[1], "/")
+	config.NetworkPassphrase = args[2]
+	config.TimeoutMs, err = strconv.Atoi(args[3])
+	if err != nil || config.TimeoutMs < 1 || config.TimeoutMs > 60000 {
+		return new_error_response(code_invalid_argument, "4th argument must be a numeric string between 1 and 60000")
+	}
+	config.Retries, err = strconv.Atoi(args[4])
+	if err != nil || config.Retries < 0 || config.Retries > 5 {
+		return new_error_response(code_invalid_argument, "5th argument must be a numeric string between 0 and 5")
+	}
+
+	config.AssetCode = "native"
+	if len(args) > 5 && len(args[5]) > 0 && args[5] != "native" {
+		config.AssetCode = args[5]
+		if !asset_code_pattern.MatchString(config.AssetCode) {
+			return new_error_response(code_invalid_argument, "6th argument must be a stellar asset code, 1 to 12 letters or digits")
+		}
+		if len(args) < 7 || len(args[6]) == 0 {
+			return new_error_response(code_invalid_argument, "Asset "+config.AssetCode+" needs its issuer as the 7th argument")
+		}
+		config.AssetIssuer = args[6]
+	}
+
+	horizonURL, err := url.Parse(config.HorizonURL)
+	if err != nil || (horizonURL.Scheme != "http" && horizonURL.Scheme != "https") || len(horizonURL.Host) == 0 {
+		return new_error_response(code_invalid_argument, "2nd argument must be an http(s) url")
+	}
+
+	configAsBytes, _ := json.Marshal(config) //convert to array of bytes
+	err = stub.PutState(stellar_config_key_for(rail), configAsBytes)
+	if err != nil {
+		return error_response(err, code_ledger_error)
+	}
+
+	fmt.Println("- end set_stellar_config")
+	return success_response("Updated stellar config for " + rail)
+}
+
+// Horizon's transaction resource, with the fields the protocols package at our vendored revision does not have
+type horizon_transaction struct {
+	hProtocol.Transaction
+	Successful *bool `json:"successful"` //only reported by newer Horizon, older ones never return failed txs
+}
+
+// Horizon's page of payment operations for a transaction
+type horizon_payments_page struct {
+	Embedded struct {
+		Records []horizon.Payment `json:"records"`
+	} `json:"_embedded"`
+}
+
+// Invoke Stellar APIs to check if payment has been made
+//
+// Every payment operation in the transaction is walked, the amounts paid to the seller in the offer's asset
+// are added up in stroops and have to match the offer price exactly. The memo has to link the transaction to
+// the offer, either MEMO_TEXT of the offer id or MEMO_HASH of sha256(offer id).
+func is_payment_done_for_offer(config StellarConfig, offer *Offer, accountId, stellar_transaction_id string) (bool, error) {
+
+	// make sure Horizon is on the network we expect before trusting anything it says
+	err := check_horizon_network(config)
+	if err != nil {
+		return false, err
+	}
+
+	transactions_path := "/transactions/"
+
+	var transaction horizon_transaction
+	err = horizon_get(config, transactions_path+stellar_transaction_id, &transaction) // transaction has Memo. Memo is set to offerId so that payment can be linked to offer.
+	if err != nil {
+		return false, new_error(code_payment_rail_unavailable, " error getting transaction details from stellar. Please try again later - "+error_message(err))
+	}
+	if transaction.Hash != stellar_transaction_id {
+		fmt.Println("- horizon returned transaction " + transaction.Hash + ", asked for " + stellar_transaction_id)
+		return false, nil
+	}
+	if transaction.Successful != nil && !*transaction.Successful {
+		fmt.Println("- stellar transaction " + stellar_transaction_id + " failed")
+		return false, nil
+	}
+	if !is_offer_memo(transaction.MemoType, transaction.Memo, offer.Id) {
+		fmt.Println("- stellar transaction memo (" + transaction.MemoType + ") does not reference offer " + offer.Id)
+		return false, nil
+	}
+
+	// a transaction has at most 100 operations, one page of 200 gets them all
+	var page horizon_payments_page
+	err = horizon_get(config, transactions_path+stellar_transaction_id+"/payments?limit=200", &page)
+	if err != nil {
+		return false, new_error(code_payment_rail_unavailable, " error getting payment details from stellar. Please try again later - "+error_message(err))
+	}
+
+	asset := offer.Asset
+	if len(asset.Code) == 0 { //offers made before assets were configurable were priced in lumens
+		asset.Code = "native"
+	}
+
+	var paid int64
+	for _, payment := range page.Embedded.Records { // payment has from, to and amount details
+		if payment.Type != "payment" && payment.Type != "path_payment" {
+			continue
+		}
+		if payment.To != accountId || !is_payment_asset(payment, asset) {
+			continue
+		}
+		amount, err := parse_stellar_amount(payment.Amount)
+		if err != nil {
+			return false, err
+		}
+		if paid > math.MaxInt64-amount {
+			return false, new_error(code_payment_not_verified, "Payment amounts overflow")
+		}
+		paid += amount
+	}
+
+	price := int64(offer.OfferPrice) * stroops_per_unit
+	if paid != price {
+		fmt.Println("- seller was paid", paid, "stroops of", asset.Code, "expected", price)
+		return false, nil
+	}
+	return true, nil
+}
+
+// true if the memo links a transaction to the offer
+func is_offer_memo(memoType string, memo string, offerId string) bool {
+	switch memoType {
+	case "text":
+		return memo == offerId
+	case "hash":
+		hash := sha256.Sum256([]byte(offerId))
+		return memo == base64.StdEncoding.EncodeToString(hash[:]) //Horizon returns hash memos base64 encoded
+	}
+	return false
+}
+
+// true if the payment operation moved the asset we priced the offer in
+func is_payment_asset(payment horizon.Payment, asset PaymentAsset) bool {
+	if asset.Code == "native" {
+		return payment.AssetType == "native"
+	}
+	return payment.AssetType != "native" && payment.AssetCode == asset.Code && payment.AssetIssuer == asset.Issuer
+}
+
+// Parse a stellar amount string ("100.0000000", "100.5" or "100") into stroops, exactly, no floats
+func parse_stellar_amount(amount string) (int64, error) {
+	bad := new_error(code_payment_not_verified, "Unable to parse amount '"+amount+"', expecting a decimal with up to 7 places")
+
+	parts := strings.SplitN(amount, ".", 2)
+	if !is_digits(parts[0]) {
+		return 0, bad
+	}
+	whole, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, bad
+	}
+
+	var fraction int64
+	if len(parts) == 2 {
+		if !is_digits(parts[1]) || len(parts[1]) > 7 {
+			return 0, bad
+		}
+		fraction, _ = strconv.ParseInt(parts[1]+strings.Repeat("0", 7-len(parts[1])), 10, 64)
+	}
+
+	if whole > (math.MaxInt64-fraction)/stroops_per_unit {
+		return 0, bad
+	}
+	return whole*stroops_per_unit + fraction, nil
+}
+
+func is_digits(str string) bool {
+	if len(str) == 0 {
+		return false
+	}
+	for _, c := range str {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Ask Horizon's root resource which network it is on
+func check_horizon_network(config StellarConfig) error {
+	if len(config.NetworkPassphrase) == 0 {
+		return nil
+	}
+
+	var root struct {
+		NetworkPassphrase string `json:"network_passphrase"`
+	}
+	err := horizon_get(config, "/", &root)
+	if err != nil {
+		return new_error(code_payment_rail_unavailable, " error getting network details from stellar. Please try again later")
+	}
+	if root.NetworkPassphrase != config.NetworkPassphrase {
+		return new_error(code_payment_rail_unavailable, "Horizon at "+config.HorizonURL+" is on network '"+root.NetworkPassphrase+"', expected '"+config.NetworkPassphrase+"'")
+	}
+	return nil
+}
+
+// GET a Horizon resource, retrying network errors and 5xx responses
+func horizon_get(config StellarConfig, path string, object interface{}) (err error) {
+	client := &http.Client{Timeout: time.Duration(config.TimeoutMs) * time.Millisecond}
+
+	for attempt := 0; attempt <= config.Retries; attempt++ {
+		var resp *http.Response
+		resp, err = client.Get(config.HorizonURL + path)
+		if err != nil {
+			fmt.Println("- horizon request failed, attempt", attempt+1, err)
+			continue
+		}
+		if resp.StatusCode >= 500 {
+			resp.Body.Close()
+			err = new_error(code_payment_rail_unavailable, "Horizon returned status "+strconv.Itoa(resp.StatusCode))
+			fmt.Println("- horizon request failed, attempt", attempt+1, err)
+			continue
+		}
+		return decodeResponse(resp, object)
+	}
+	return
+}
+
+func decodeResponse(resp *http.Response, object interface{}) (err error) {
+	defer resp.Body.Close()
+	decoder := json.NewDecoder(resp.Body)
+
+	if !(resp.StatusCode >= 200 && resp.StatusCode < 300) {
+		horizonError := &horizon.Error{
+			Response: resp,
+		}
+		decodeError := decoder.Decode(&horizonError.Problem)
+		if decodeError != nil {
+			return decodeError
+		}
+		return horizonError
+	}
+
+	err = decoder.Decode(&object)
+	if err != nil {
+		return
+	}
+	return
+}
@@ -0,0 +1,274 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// ============================================================================================================================
+// Config
+// ============================================================================================================================
+func TestStellarConfigPerRail(t *testing.T) {
+	stub := new_test_stub(t)
+	stub.must("set_stellar_config", stellar_public_rail, "https://horizon.example.com/", "Public Global Stellar Network ; September 2015", "5000", "1")
+
+	public, err := get_stellar_config(stub, stellar_public_rail, payment_verifiers[stellar_public_rail].(*StellarPaymentVerifier).Defaults)
+	if err != nil || public.HorizonURL != "https://horizon.example.com" || public.TimeoutMs != 5000 || public.Retries != 1 {
+		t.Fatalf("Public rail should use the stored config, got %+v %v", public, err)
+	}
+	testnet, err := get_stellar_config(stub, stellar_testnet_rail, payment_verifiers[stellar_testnet_rail].(*StellarPaymentVerifier).Defaults)
+	if err != nil || testnet.HorizonURL != stellar_testnet_URL || testnet.NetworkPassphrase != "Test SDF Network ; September 2015" {
+		t.Fatalf("Testnet should keep its defaults, got %+v %v", testnet, err)
+	}
+
+	stub.expect_code(code_invalid_argument, "set_stellar_config", "memory", "https://horizon.example.com", "x", "5000", "1")
+	res := stub.expect_code(code_invalid_argument, "set_stellar_config", stellar_public_rail, "ftp://horizon.example.com", "x", "5000", "1")
+	if !strings.Contains(res.Message, "2nd argument") {
+		t.Fatalf("The url is the 2nd argument, got %s", res.Message)
+	}
+
+	// no retries is a setting of its own
+	stub.must("set_stellar_config", stellar_public_rail, "https://horizon.example.com", "Public Global Stellar Network ; September 2015", "5000", "0")
+	public, _ = get_stellar_config(stub, stellar_public_rail, StellarConfig{Retries: 2})
+	if public.Retries != 0 {
+		t.Fatalf("Stored retries of 0 should win over the default, got %d", public.Retries)
+	}
+	stub.expect_code(code_not_authorized, "write", stellar_config_key_for(stellar_public_rail), "{}")
+}
+
+func TestStellarConfigLegacyKey(t *testing.T) {
+	stub := new_test_stub(t)
+	stub.put_fixture(stellar_config_key, `{"horizonUrl":"https://old.example.com","networkPassphrase":"Test SDF Network ; September 2015"}`)
+
+	// the config from before rails had their own was for the current rail only
+	testnet, err := get_stellar_config(stub, stellar_testnet_rail, StellarConfig{Retries: 2})
+	if err != nil || testnet.HorizonURL != "https://old.example.com" || testnet.Retries != 2 {
+		t.Fatalf("The current rail should read the legacy config, got %+v %v", testnet, err)
+	}
+	public, err := get_stellar_config(stub, stellar_public_rail, StellarConfig{HorizonURL: stellar_public_URL})
+	if err != nil || public.HorizonURL != stellar_public_URL {
+		t.Fatalf("Other rails should not read the legacy config, got %+v %v", public, err)
+	}
+}
+
+func TestStellarConfigAsset(t *testing.T) {
+	stub := new_test_stub(t)
+	issuer := test_account(9)
+	stub.expect_code(code_invalid_argument, "set_stellar_config", stellar_testnet_rail, stellar_testnet_URL, "Test SDF Network ; September 2015", "5000", "1", "USD")
+	stub.expect_code(code_invalid_argument, "set_stellar_config", stellar_testnet_rail, stellar_testnet_URL, "Test SDF Network ; September 2015", "5000", "1", "USD", "")
+	stub.expect_code(code_invalid_argument, "set_stellar_config", stellar_testnet_rail, stellar_testnet_URL, "Test SDF Network ; September 2015", "5000", "1", "US D", issuer)
+
+	stub.must("set_stellar_config", stellar_testnet_rail, stellar_testnet_URL, "Test SDF Network ; September 2015", "5000", "1", "USD", issuer)
+	asset, err := get_offer_asset(stub)
+	if err != nil || asset.Code != "USD" || asset.Issuer != issuer {
+		t.Fatalf("Offers should be priced in USD, got %+v %v", asset, err)
+	}
+
+	// lumens have no issuer
+	stub.must("set_stellar_config", stellar_testnet_rail, stellar_testnet_URL, "Test SDF Network ; September 2015", "5000", "1", "native")
+	asset, err = get_offer_asset(stub)
+	if err != nil || asset.Code != "native" || len(asset.Issuer) > 0 {
+		t.Fatalf("Offers should be priced in lumens, got %+v %v", asset, err)
+	}
+}
+
+// ============================================================================================================================
+// Amounts
+// ============================================================================================================================
+func TestParseStellarAmount(t *testing.T) {
+	for _, test := range []struct {
+		amount  string
+		stroops int64
+		ok      bool
+	}{
+		{"100.0000000", 1000000000, true},
+		{"100", 1000000000, true},
+		{"100.5", 1005000000, true},
+		{"0.0000001", 1, true},
+		{"0.1234567", 1234567, true},
+		{"922337203685.4775807", 9223372036854775807, true},
+		{"922337203685.4775808", 0, false}, //one stroop over int64
+		{"0.12345678", 0, false},           //more precision than a stroop, never rounded
+		{"1.00000001", 0, false},
+		{"-1", 0, false},
+		{"-0.0000001", 0, false},
+		{"+1", 0, false},
+		{"1e7", 0, false},
+		{"1.", 0, false},
+		{".5", 0, false},
+		{"", 0, false},
+		{"1.2.3", 0, false},
+		{" 1", 0, false},
+	} {
+		stroops, err := parse_stellar_amount(test.amount)
+		if test.ok && (err != nil || stroops != test.stroops) {
+			t.Errorf("'%s' should be %d stroops, got %d %v", test.amount, test.stroops, stroops, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("'%s' should not parse, got %d stroops", test.amount, stroops)
+		}
+	}
+}
+
+// ============================================================================================================================
+// Memos
+// ============================================================================================================================
+func TestOfferMemo(t *testing.T) {
+	hash := sha256.Sum256([]byte("offer1"))
+	hashMemo := base64.StdEncoding.EncodeToString(hash[:])
+	otherHash := sha256.Sum256([]byte("offer2"))
+
+	for _, test := range []struct {
+		memoType string
+		memo     string
+		matches  bool
+	}{
+		{"text", "offer1", true},
+		{"text", "offer2", false},
+		{"text", "offer1 ", false},
+		{"text", hashMemo, false},
+		{"hash", hashMemo, true},
+		{"hash", base64.StdEncoding.EncodeToString(otherHash[:]), false},
+		{"hash", "offer1", false},
+		{"id", "offer1", false},
+		{"return", hashMemo, false},
+		{"none", "", false},
+	} {
+		if is_offer_memo(test.memoType, test.memo, "offer1") != test.matches {
+			t.Errorf("%s memo '%s' should match offer1: %v", test.memoType, test.memo, test.matches)
+		}
+	}
+}
+
+// ============================================================================================================================
+// Horizon - a fake Horizon serving one transaction and its payment operations
+// ============================================================================================================================
+const test_horizon_hash = "5d0c4c4bd4b0a6f8e7a3f1c0e9d8b7a6f5e4d3c2b1a09f8e7d6c5b4a39281706"
+const test_network = "Test SDF Network ; September 2015"
+
+type test_horizon struct {
+	passphrase string
+	memoType   string
+	memo       string
+	failed     bool
+	payments   []map[string]string
+}
+
+func (h *test_horizon) start(t *testing.T) StellarConfig {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body interface{}
+		switch r.URL.Path {
+		case "/":
+			body = map[string]string{"network_passphrase": h.passphrase}
+		case "/transactions/" + test_horizon_hash:
+			body = map[string]interface{}{"hash": test_horizon_hash, "memo_type": h.memoType, "memo": h.memo, "successful": !h.failed}
+		case "/transactions/" + test_horizon_hash + "/payments":
+			body = map[string]interface{}{"_embedded": map[string]interface{}{"records": h.payments}}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			body = map[string]interface{}{"status": 404, "title": "Resource Missing"}
+		}
+		json.NewEncoder(w).Encode(body)
+	}))
+	t.Cleanup(server.Close)
+	return StellarConfig{HorizonURL: server.URL, NetworkPassphrase: test_network, TimeoutMs: 5000}
+}
+
+func test_payment(kind string, to string, amount string) map[string]string {
+	return map[string]string{"type": kind, "from": test_account(2), "to": to, "asset_type": "native", "amount": amount}
+}
+
+func TestCheckHorizonNetwork(t *testing.T) {
+	horizon := &test_horizon{passphrase: "Public Global Stellar Network ; September 2015"}
+	config := horizon.start(t)
+	if err := check_horizon_network(config); err == nil || !strings.Contains(err.Error(), "expected '"+test_network+"'") {
+		t.Fatalf("Horizon on the wrong network should be refused, got %v", err)
+	}
+	if ok, err := is_payment_done_for_offer(config, &Offer{Id: "offer1", OfferPrice: 100}, test_account(1), test_horizon_hash); ok || err == nil {
+		t.Fatalf("No payment should be trusted from the wrong network, got %v %v", ok, err)
+	}
+
+	horizon.passphrase = test_network
+	if err := check_horizon_network(config); err != nil {
+		t.Fatalf("Horizon on the expected network should be trusted, got %v", err)
+	}
+}
+
+func TestPaymentDoneForOffer(t *testing.T) {
+	seller := test_account(1)
+	usd := map[string]string{"type": "payment", "to": seller, "asset_type": "credit_alphanum4", "asset_code": "USD", "asset_issuer": test_account(9), "amount": "100.0000000"}
+
+	for _, test := range []struct {
+		name     string
+		horizon  test_horizon
+		asset    PaymentAsset
+		verified bool
+	}{
+		{"single payment", test_horizon{memoType: "text", memo: "offer1", payments: []map[string]string{
+			test_payment("payment", seller, "100.0000000")}}, PaymentAsset{}, true},
+		{"payment and path payment", test_horizon{memoType: "text", memo: "offer1", payments: []map[string]string{
+			test_payment("payment", seller, "60"),
+			test_payment("path_payment", seller, "40.0000000")}}, PaymentAsset{}, true},
+		{"path payment only", test_horizon{memoType: "text", memo: "offer1", payments: []map[string]string{
+			test_payment("path_payment", seller, "100")}}, PaymentAsset{Code: "native"}, true},
+		{"hash memo", test_horizon{memoType: "hash", memo: "", payments: []map[string]string{
+			test_payment("payment", seller, "100")}}, PaymentAsset{}, true},
+		{"payments to others are not counted", test_horizon{memoType: "text", memo: "offer1", payments: []map[string]string{
+			test_payment("payment", seller, "60"),
+			test_payment("path_payment", test_account(3), "40")}}, PaymentAsset{}, false},
+		{"other operations are not counted", test_horizon{memoType: "text", memo: "offer1", payments: []map[string]string{
+			test_payment("payment", seller, "60"),
+			test_payment("create_account", seller, "40")}}, PaymentAsset{}, false},
+		{"overpaid", test_horizon{memoType: "text", memo: "offer1", payments: []map[string]string{
+			test_payment("payment", seller, "100"),
+			test_payment("path_payment", seller, "0.0000001")}}, PaymentAsset{}, false},
+		{"wrong memo", test_horizon{memoType: "text", memo: "offer2", payments: []map[string]string{
+			test_payment("payment", seller, "100")}}, PaymentAsset{}, false},
+		{"failed transaction", test_horizon{memoType: "text", memo: "offer1", failed: true, payments: []map[string]string{
+			test_payment("payment", seller, "100")}}, PaymentAsset{}, false},
+		{"issued asset", test_horizon{memoType: "text", memo: "offer1", payments: []map[string]string{usd}},
+			PaymentAsset{Code: "USD", Issuer: test_account(9)}, true},
+		{"issued asset from another issuer", test_horizon{memoType: "text", memo: "offer1", payments: []map[string]string{usd}},
+			PaymentAsset{Code: "USD", Issuer: test_account(8)}, false},
+		{"lumens for an issued asset", test_horizon{memoType: "text", memo: "offer1", payments: []map[string]string{
+			test_payment("payment", seller, "100")}}, PaymentAsset{Code: "USD", Issuer: test_account(9)}, false},
+	} {
+		horizon := test.horizon
+		horizon.passphrase = test_network
+		if horizon.memoType == "hash" {
+			hash := sha256.Sum256([]byte("offer1"))
+			horizon.memo = base64.StdEncoding.EncodeToString(hash[:])
+		}
+		config := horizon.start(t)
+
+		offer := &Offer{Id: "offer1", OfferPrice: 100, Asset: test.asset}
+		verified, err := is_payment_done_for_offer(config, offer, seller, test_horizon_hash)
+		if err != nil || verified != test.verified {
+			t.Errorf("%s should be verified: %v, got %v %v", test.name, test.verified, verified, err)
+		}
+	}
+}
@@ -0,0 +1,543 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base32"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+	"github.com/hyperledger/fabric/protos/msp"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ============================================================================================================================
+// Test Stub - an in-memory peer for the tests
+//
+// shim.MockStub has no creator, history or pagination, so the tests use this instead. It behaves like a peer where
+// the chaincode cares -
+//   - a transaction does not see its own writes, and its writes are only committed if it succeeds
+//   - plain range queries skip composite keys
+//   - paginated queries are refused in a transaction that writes, and writes after a paginated query
+//   - the caller's certificate carries the marbles.company and marbles.role attributes, see as()
+//
+// Rich queries need CouchDB and are not supported.
+// ============================================================================================================================
+type TestStub struct {
+	t       *testing.T
+	state   map[string][]byte                         //committed state
+	history map[string][]*queryresult.KeyModification //committed changes per key, oldest first
+	now     int64                                     //tx timestamp of the next transaction, ms since epoch
+	txCount int
+	creator []byte
+	scanned int //keys handed out by query iterators, to check how much a function reads
+
+	// the transaction in flight
+	args      [][]byte
+	txId      string
+	writes    map[string][]byte //nil for a delete
+	wrote     bool
+	paginated bool
+
+	// the last transaction's event
+	eventName    string
+	eventPayload []byte
+	eventsSet    int //SetEvent() calls the last transaction made
+}
+
+const test_channel = "testchannel"
+const test_start_time = 1500000000000 //ms since epoch
+
+// ============================================================================================================================
+// New Test Stub - an instantiated chaincode on an empty ledger, called by an admin of "United Marbles"
+// ============================================================================================================================
+func new_test_stub(t *testing.T) *TestStub {
+	stub := &TestStub{
+		t:       t,
+		state:   map[string][]byte{},
+		history: map[string][]*queryresult.KeyModification{},
+		now:     test_start_time,
+	}
+	stub.as("United Marbles", role_admin)
+	res := stub.transact(func() pb.Response { return new(SimpleChaincode).Init(stub) }, "init", "314")
+	if res.Status != shim.OK {
+		t.Fatalf("Init failed - %s", res.Message)
+	}
+	return stub
+}
+
+// ============================================================================================================================
+// Invoke - run one transaction through Invoke(), commit its writes if it succeeded
+// ============================================================================================================================
+func (stub *TestStub) invoke(function string, args ...string) pb.Response {
+	return stub.transact(func() pb.Response { return new(SimpleChaincode).Invoke(stub) }, function, args...)
+}
+
+func (stub *TestStub) transact(run func() pb.Response, function string, args ...string) pb.Response {
+	stub.txCount++
+	stub.txId = "tx" + strconv.Itoa(stub.txCount)
+	stub.args = [][]byte{[]byte(function)}
+	for _, arg := range args {
+		stub.args = append(stub.args, []byte(arg))
+	}
+	stub.writes = map[string][]byte{}
+	stub.wrote = false
+	stub.paginated = false
+	stub.eventName = ""
+	stub.eventPayload = nil
+	stub.eventsSet = 0
+
+	res := run()
+	if res.Status < shim.ERRORTHRESHOLD {
+		stub.commit()
+	}
+	stub.writes = nil
+	stub.now += 1000 //a second between transactions
+	return res
+}
+
+func (stub *TestStub) commit() {
+	ts := stub.timestamp()
+	for key, value := range stub.writes {
+		change := &queryresult.KeyModification{TxId: stub.txId, Value: value, Timestamp: ts, IsDelete: value == nil}
+		stub.history[key] = append(stub.history[key], change)
+		if value == nil {
+			delete(stub.state, key)
+		} else {
+			stub.state[key] = value
+		}
+	}
+}
+
+// ============================================================================================================================
+// Must - invoke and fail the test unless it succeeded
+// ============================================================================================================================
+func (stub *TestStub) must(function string, args ...string) pb.Response {
+	stub.t.Helper()
+	res := stub.invoke(function, args...)
+	if res.Status != shim.OK {
+		stub.t.Fatalf("%s %v failed - %s", function, args, res.Message)
+	}
+	return res
+}
+
+// ============================================================================================================================
+// Expect Code - invoke and fail the test unless it failed with this error code
+// ============================================================================================================================
+func (stub *TestStub) expect_code(code string, function string, args ...string) pb.Response {
+	stub.t.Helper()
+	res := stub.invoke(function, args...)
+	if res.Status == shim.OK {
+		stub.t.Fatalf("%s %v succeeded, expected %s", function, args, code)
+	}
+	var envelope ResponseEnvelope
+	err := json.Unmarshal([]byte(res.Message), &envelope)
+	if err != nil || envelope.Code != code {
+		stub.t.Fatalf("%s %v failed with %s, expected %s", function, args, res.Message, code)
+	}
+	return res
+}
+
+// ============================================================================================================================
+// Put Fixture - write straight to committed state, for documents older chaincode left behind
+// ============================================================================================================================
+func (stub *TestStub) put_fixture(key string, value string) {
+	stub.state[key] = []byte(value)
+}
+
+// ============================================================================================================================
+// As - make the following transactions come from a user of this company with this role, both may be empty
+// ============================================================================================================================
+func (stub *TestStub) as(company string, role string) {
+	attrs := map[string]string{}
+	if len(company) > 0 {
+		attrs[company_attribute] = company
+	}
+	if len(role) > 0 {
+		attrs[role_attribute] = role
+	}
+	stub.creator = test_creator(stub.t, "Org1MSP", attrs)
+}
+
+// ============================================================================================================================
+// Test Creator - a serialized identity with a self signed certificate carrying fabric-ca style attributes
+// ============================================================================================================================
+var test_attr_oid = asn1.ObjectIdentifier{1, 2, 3, 4, 5, 6, 7, 8, 1} //fabric-ca puts attributes under this extension
+var test_cert_key, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+func test_creator(t *testing.T, mspId string, attrs map[string]string) []byte {
+	attrsAsBytes, _ := json.Marshal(map[string]interface{}{"attrs": attrs})
+	template := &x509.Certificate{
+		SerialNumber:    big.NewInt(1),
+		Subject:         pkix.Name{CommonName: "user1"},
+		NotBefore:       time.Now().Add(-time.Hour),
+		NotAfter:        time.Now().Add(time.Hour),
+		ExtraExtensions: []pkix.Extension{{Id: test_attr_oid, Value: attrsAsBytes}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &test_cert_key.PublicKey, test_cert_key)
+	if err != nil {
+		t.Fatalf("Could not make a test certificate - %s", err)
+	}
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	creator, err := proto.Marshal(&msp.SerializedIdentity{Mspid: mspId, IdBytes: certPem})
+	if err != nil {
+		t.Fatalf("Could not serialize the test identity - %s", err)
+	}
+	return creator
+}
+
+// ============================================================================================================================
+// Test Account - a stellar account id with a valid checksum, different for every seed
+// ============================================================================================================================
+func test_account(seed byte) string {
+	decoded := make([]byte, 35)
+	decoded[0] = strkey_version_account
+	for i := 1; i < 33; i++ {
+		decoded[i] = seed + byte(i)
+	}
+	checksum := crc16_xmodem(decoded[:33])
+	decoded[33] = byte(checksum) //little endian
+	decoded[34] = byte(checksum >> 8)
+	return base32.StdEncoding.EncodeToString(decoded)
+}
+
+// ============================================================================================================================
+// State - the ledger
+// ============================================================================================================================
+func (stub *TestStub) timestamp() *timestamp.Timestamp {
+	return &timestamp.Timestamp{Seconds: stub.now / 1000, Nanos: int32(stub.now%1000) * 1000000}
+}
+
+func (stub *TestStub) GetState(key string) ([]byte, error) {
+	return stub.state[key], nil //committed state only, like a peer
+}
+
+func (stub *TestStub) PutState(key string, value []byte) error {
+	if len(key) == 0 {
+		return errors.New("key must not be an empty string")
+	}
+	if stub.writes == nil {
+		return errors.New("PutState outside a transaction")
+	}
+	if stub.paginated {
+		return errors.New("txid [" + stub.txId + "]: Transaction has already performed a paginated query. Writes are not allowed")
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	stub.writes[key] = value
+	stub.wrote = true
+	return nil
+}
+
+func (stub *TestStub) DelState(key string) error {
+	if stub.writes == nil {
+		return errors.New("DelState outside a transaction")
+	}
+	if stub.paginated {
+		return errors.New("txid [" + stub.txId + "]: Transaction has already performed a paginated query. Writes are not allowed")
+	}
+	stub.writes[key] = nil
+	stub.wrote = true
+	return nil
+}
+
+// committed keys in [startKey, endKey), endKey "" for no end
+func (stub *TestStub) range_keys(startKey string, endKey string) []string {
+	var keys []string
+	for key := range stub.state {
+		if key >= startKey && (len(endKey) == 0 || key < endKey) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (stub *TestStub) iterator(keys []string) *TestIterator {
+	iterator := &TestIterator{stub: stub}
+	for _, key := range keys {
+		iterator.kvs = append(iterator.kvs, &queryresult.KV{Namespace: "marbles", Key: key, Value: stub.state[key]})
+	}
+	return iterator
+}
+
+func simple_range(startKey string, endKey string) (string, string, error) {
+	for _, key := range []string{startKey, endKey} {
+		if len(key) > 0 && key[0] == 0 {
+			return "", "", errors.New("first character of the key [" + key + "] contains a null character which is not allowed")
+		}
+	}
+	if len(startKey) == 0 {
+		startKey = "\x01" //keeps composite keys out, like the peer
+	}
+	return startKey, endKey, nil
+}
+
+func (stub *TestStub) GetStateByRange(startKey string, endKey string) (shim.StateQueryIteratorInterface, error) {
+	startKey, endKey, err := simple_range(startKey, endKey)
+	if err != nil {
+		return nil, err
+	}
+	return stub.iterator(stub.range_keys(startKey, endKey)), nil
+}
+
+func (stub *TestStub) GetStateByPartialCompositeKey(objectType string, attributes []string) (shim.StateQueryIteratorInterface, error) {
+	partialKey, err := stub.CreateCompositeKey(objectType, attributes)
+	if err != nil {
+		return nil, err
+	}
+	return stub.iterator(stub.range_keys(partialKey, partialKey+string(utf8.MaxRune))), nil
+}
+
+// the bookmark is the first key of the next page, empty once there are no more
+func (stub *TestStub) page(startKey string, endKey string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	if stub.wrote {
+		return nil, nil, errors.New("txid [" + stub.txId + "]: Paginated queries are supported only in a read-only transaction")
+	}
+	stub.paginated = true
+	if len(bookmark) > 0 {
+		startKey = bookmark
+	}
+	keys := stub.range_keys(startKey, endKey)
+	metadata := &pb.QueryResponseMetadata{}
+	if int32(len(keys)) > pageSize {
+		metadata.Bookmark = keys[pageSize]
+		keys = keys[:pageSize]
+	}
+	metadata.FetchedRecordsCount = int32(len(keys))
+	return stub.iterator(keys), metadata, nil
+}
+
+func (stub *TestStub) GetStateByRangeWithPagination(startKey string, endKey string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	startKey, endKey, err := simple_range(startKey, endKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return stub.page(startKey, endKey, pageSize, bookmark)
+}
+
+func (stub *TestStub) GetStateByPartialCompositeKeyWithPagination(objectType string, attributes []string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	partialKey, err := stub.CreateCompositeKey(objectType, attributes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return stub.page(partialKey, partialKey+string(utf8.MaxRune), pageSize, bookmark)
+}
+
+func (stub *TestStub) GetQueryResult(query string) (shim.StateQueryIteratorInterface, error) {
+	return nil, errors.New("rich queries need CouchDB, the test stub does not have one")
+}
+
+func (stub *TestStub) GetQueryResultWithPagination(query string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	return nil, nil, errors.New("rich queries need CouchDB, the test stub does not have one")
+}
+
+func (stub *TestStub) GetHistoryForKey(key string) (shim.HistoryQueryIteratorInterface, error) {
+	return &TestHistoryIterator{changes: stub.history[key]}, nil
+}
+
+func (stub *TestStub) CreateCompositeKey(objectType string, attributes []string) (string, error) {
+	key := "\x00" + objectType + "\x00"
+	for _, attribute := range append([]string{objectType}, attributes...) {
+		if !utf8.ValidString(attribute) || strings.ContainsRune(attribute, 0) || strings.ContainsRune(attribute, utf8.MaxRune) {
+			return "", errors.New("input attribute [" + attribute + "] is not allowed in a composite key")
+		}
+	}
+	for _, attribute := range attributes {
+		key += attribute + "\x00"
+	}
+	return key, nil
+}
+
+func (stub *TestStub) SplitCompositeKey(compositeKey string) (string, []string, error) {
+	if len(compositeKey) < 2 || compositeKey[0] != 0 {
+		return "", nil, errors.New("not a composite key")
+	}
+	parts := strings.Split(compositeKey[1:], "\x00")
+	return parts[0], parts[1 : len(parts)-1], nil
+}
+
+// ============================================================================================================================
+// Transaction - args, identity, time and events
+// ============================================================================================================================
+func (stub *TestStub) GetArgs() [][]byte {
+	return stub.args
+}
+
+func (stub *TestStub) GetStringArgs() []string {
+	var args []string
+	for _, arg := range stub.args {
+		args = append(args, string(arg))
+	}
+	return args
+}
+
+func (stub *TestStub) GetFunctionAndParameters() (string, []string) {
+	args := stub.GetStringArgs()
+	if len(args) == 0 {
+		return "", []string{}
+	}
+	return args[0], args[1:]
+}
+
+func (stub *TestStub) GetArgsSlice() ([]byte, error) {
+	var slice []byte
+	for _, arg := range stub.args {
+		slice = append(slice, arg...)
+	}
+	return slice, nil
+}
+
+func (stub *TestStub) GetTxID() string {
+	return stub.txId
+}
+
+func (stub *TestStub) GetChannelID() string {
+	return test_channel
+}
+
+func (stub *TestStub) GetCreator() ([]byte, error) {
+	return stub.creator, nil
+}
+
+func (stub *TestStub) GetTxTimestamp() (*timestamp.Timestamp, error) {
+	return stub.timestamp(), nil
+}
+
+func (stub *TestStub) SetEvent(name string, payload []byte) error {
+	stub.eventName = name //a transaction carries one event, the last one set
+	stub.eventPayload = payload
+	stub.eventsSet++
+	return nil
+}
+
+func (stub *TestStub) GetTransient() (map[string][]byte, error) {
+	return map[string][]byte{}, nil
+}
+
+func (stub *TestStub) GetBinding() ([]byte, error) {
+	return nil, nil
+}
+
+func (stub *TestStub) GetDecorations() map[string][]byte {
+	return map[string][]byte{}
+}
+
+func (stub *TestStub) GetSignedProposal() (*pb.SignedProposal, error) {
+	return &pb.SignedProposal{}, nil
+}
+
+func (stub *TestStub) InvokeChaincode(chaincodeName string, args [][]byte, channel string) pb.Response {
+	return shim.Error("the test stub can't call other chaincode")
+}
+
+// not used by marbles
+func (stub *TestStub) SetStateValidationParameter(key string, ep []byte) error { return nil }
+func (stub *TestStub) GetStateValidationParameter(key string) ([]byte, error)  { return nil, nil }
+func (stub *TestStub) GetPrivateData(collection string, key string) ([]byte, error) {
+	return nil, errors.New("no private data in the test stub")
+}
+func (stub *TestStub) PutPrivateData(collection string, key string, value []byte) error {
+	return errors.New("no private data in the test stub")
+}
+func (stub *TestStub) DelPrivateData(collection string, key string) error {
+	return errors.New("no private data in the test stub")
+}
+func (stub *TestStub) SetPrivateDataValidationParameter(collection string, key string, ep []byte) error {
+	return errors.New("no private data in the test stub")
+}
+func (stub *TestStub) GetPrivateDataValidationParameter(collection string, key string) ([]byte, error) {
+	return nil, errors.New("no private data in the test stub")
+}
+func (stub *TestStub) GetPrivateDataByRange(collection string, startKey string, endKey string) (shim.StateQueryIteratorInterface, error) {
+	return nil, errors.New("no private data in the test stub")
+}
+func (stub *TestStub) GetPrivateDataByPartialCompositeKey(collection string, objectType string, keys []string) (shim.StateQueryIteratorInterface, error) {
+	return nil, errors.New("no private data in the test stub")
+}
+func (stub *TestStub) GetPrivateDataQueryResult(collection string, query string) (shim.StateQueryIteratorInterface, error) {
+	return nil, errors.New("no private data in the test stub")
+}
+
+// ----- Iterators ----- //
+type TestIterator struct {
+	stub *TestStub
+	kvs  []*queryresult.KV
+}
+
+func (iterator *TestIterator) HasNext() bool {
+	return len(iterator.kvs) > 0
+}
+
+func (iterator *TestIterator) Next() (*queryresult.KV, error) {
+	if len(iterator.kvs) == 0 {
+		return nil, errors.New("no more results")
+	}
+	kv := iterator.kvs[0]
+	iterator.kvs = iterator.kvs[1:]
+	iterator.stub.scanned++
+	return kv, nil
+}
+
+func (iterator *TestIterator) Close() error {
+	return nil
+}
+
+type TestHistoryIterator struct {
+	changes []*queryresult.KeyModification
+}
+
+func (iterator *TestHistoryIterator) HasNext() bool {
+	return len(iterator.changes) > 0
+}
+
+func (iterator *TestHistoryIterator) Next() (*queryresult.KeyModification, error) {
+	if len(iterator.changes) == 0 {
+		return nil, errors.New("no more results")
+	}
+	change := iterator.changes[0]
+	iterator.changes = iterator.changes[1:]
+	return change, nil
+}
+
+func (iterator *TestHistoryIterator) Close() error {
+	return nil
+}
+
+var _ shim.ChaincodeStubInterface = &TestStub{}
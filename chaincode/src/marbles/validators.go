@@ -0,0 +1,231 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/base32"
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ============================================================================================================================
+// Argument Validation
+//
+// Each argument in the function registry names a format, call_function() checks every argument against its
+// format before the handler runs. Empty values are only let through for arguments that allow them.
+// ============================================================================================================================
+const format_text = "text"                       //up to 256 printable characters
+const format_id = "id"                           //any marble, owner or offer id
+const format_marble_id = "marble_id"             //m + up to 63 letters/digits
+const format_owner_id = "owner_id"               //o + up to 63 letters/digits
+const format_offer_id = "offer_id"               //up to 28 letters/digits/_/-, it has to fit in a stellar text memo
+const format_company = "company"                 //up to 64 printable characters
+const format_username = "username"               //up to 64 printable characters
+const format_color = "color"                     //one of marble_colors
+const format_size = "size"                       //whole mm, min_marble_size to max_marble_size
+const format_price = "price"                     //whole units, 1 to max_price
+const format_min_price = "min_price"             //whole units, 0 to max_price
+const format_number = "number"                   //any whole number
+const format_timestamp = "timestamp"             //ms since epoch
+const format_offer_ttl = "offer_ttl"             //ms, 1 minute to max_offer_ttl_ms
+const format_page_size = "page_size"             //1 to max_page_size
+const format_bookmark = "bookmark"               //up to 4096 printable characters, composite key separators allowed
+const format_stellar_account = "stellar_account" //G... StrKey with a valid checksum
+const format_tx_hash = "tx_hash"                 //64 hex characters
+const format_json = "json"                       //JSON, up to 16KB
+const format_pem = "pem"                         //PEM block, up to 4096 characters
+
+const min_marble_size = 1
+const max_marble_size = 200
+const max_price = 1000000000 //keeps price * stroops_per_unit inside an int64
+
+// the colors the marbles UI can draw
+var marble_colors = []string{"white", "black", "red", "green", "blue", "purple", "pink", "orange", "yellow"}
+
+var marble_id_pattern = regexp.MustCompile(`^m[0-9A-Za-z]{1,63}$`)
+var owner_id_pattern = regexp.MustCompile(`^o[0-9A-Za-z]{1,63}$`)
+var offer_id_pattern = regexp.MustCompile(`^[0-9A-Za-z_-]{1,28}$`)
+var any_id_pattern = regexp.MustCompile(`^[0-9A-Za-z_-]{1,64}$`)
+var tx_hash_pattern = regexp.MustCompile(`^[0-9a-fA-F]{64}$`)
+var asset_code_pattern = regexp.MustCompile(`^[0-9A-Za-z]{1,12}$`)
+
+var arg_formats = map[string]func(string) error{
+	format_text:            text_check(256),
+	format_id:              pattern_check(any_id_pattern, "an id of up to 64 letters, digits, _ or -"),
+	format_marble_id:       pattern_check(marble_id_pattern, "'m' and up to 63 letters or digits"),
+	format_owner_id:        pattern_check(owner_id_pattern, "'o' and up to 63 letters or digits"),
+	format_offer_id:        pattern_check(offer_id_pattern, "up to 28 letters, digits, _ or -"),
+	format_company:         text_check(64),
+	format_username:        text_check(64),
+	format_color:           check_color,
+	format_size:            range_check(min_marble_size, max_marble_size),
+	format_price:           range_check(1, max_price),
+	format_min_price:       range_check(0, max_price),
+	format_number:          range_check(-1<<53, 1<<53),
+	format_timestamp:       range_check(0, 1<<53),
+	format_offer_ttl:       range_check(60*1000, max_offer_ttl_ms),
+	format_page_size:       range_check(1, max_page_size),
+	format_bookmark:        check_bookmark,
+	format_stellar_account: check_stellar_account,
+	format_tx_hash:         pattern_check(tx_hash_pattern, "64 hex characters"),
+	format_json:            check_json,
+	format_pem:             check_pem,
+}
+
+// ============================================================================================================================
+// Validate Arg - check one argument against its spec's format
+// ============================================================================================================================
+func validate_arg(spec ArgSpec, value string) error {
+	if len(value) == 0 {
+		if spec.AllowEmpty {
+			return nil
+		}
+		return new_error(code_invalid_argument, "Argument '"+spec.Name+"' must be a non-empty string")
+	}
+
+	check, ok := arg_formats[spec.Format]
+	if !ok {
+		check = arg_formats[format_text]
+	}
+	err := check(value)
+	if err != nil {
+		return new_error(code_invalid_argument, "Argument '"+spec.Name+"' must be "+err.Error())
+	}
+	return nil
+}
+
+// format errors finish the sentence "Argument 'x' must be ..."
+type format_error string
+
+func (e format_error) Error() string {
+	return string(e)
+}
+
+// ============================================================================================================================
+// Format Checks
+// ============================================================================================================================
+func text_check(max int) func(string) error {
+	return func(value string) error { return check_text(value, max) }
+}
+
+func pattern_check(pattern *regexp.Regexp, description string) func(string) error {
+	return func(value string) error { return check_pattern(value, pattern, description) }
+}
+
+func range_check(min int64, max int64) func(string) error {
+	return func(value string) error { return check_range(value, min, max) }
+}
+
+// bookmarks of composite key queries are composite keys, their attributes are separated by U+0000
+func check_bookmark(value string) error {
+	if len(value) > 4096 {
+		return format_error("<= 4096 characters")
+	}
+	return check_text(strings.Replace(value, "\x00", "", -1), 4096)
+}
+
+func check_text(value string, max int) error {
+	if len(value) > max {
+		return format_error("<= " + strconv.Itoa(max) + " characters")
+	}
+	for _, r := range value {
+		if unicode.IsControl(r) {
+			return format_error("printable text, no control characters")
+		}
+	}
+	return nil
+}
+
+func check_pattern(value string, pattern *regexp.Regexp, description string) error {
+	if !pattern.MatchString(value) {
+		return format_error(description)
+	}
+	return nil
+}
+
+func check_range(value string, min int64, max int64) error {
+	number, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || number < min || number > max {
+		return format_error("a whole number from " + strconv.FormatInt(min, 10) + " to " + strconv.FormatInt(max, 10))
+	}
+	return nil
+}
+
+func check_color(value string) error {
+	for _, color := range marble_colors {
+		if strings.ToLower(value) == color {
+			return nil
+		}
+	}
+	return format_error("one of " + strings.Join(marble_colors, ", "))
+}
+
+func check_json(value string) error {
+	if len(value) > 16384 || !json.Valid([]byte(value)) {
+		return format_error("valid JSON, up to 16KB")
+	}
+	return nil
+}
+
+func check_pem(value string) error {
+	if len(value) > 4096 || !strings.HasPrefix(strings.TrimSpace(value), "-----BEGIN ") {
+		return format_error("a PEM block, up to 4096 characters")
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// Check Stellar Account - a G... StrKey is base32 of version byte + 32 byte ed25519 key + CRC16-XModem checksum
+// ============================================================================================================================
+const strkey_version_account = 6 << 3 //'G'
+
+func check_stellar_account(value string) error {
+	invalid := format_error("a stellar account id, 56 characters starting with G")
+	if len(value) != 56 || value[0] != 'G' {
+		return invalid
+	}
+	decoded, err := base32.StdEncoding.DecodeString(value)
+	if err != nil || len(decoded) != 35 || decoded[0] != strkey_version_account {
+		return invalid
+	}
+	checksum := uint16(decoded[33]) | uint16(decoded[34])<<8 //little endian
+	if crc16_xmodem(decoded[:33]) != checksum {
+		return format_error("a stellar account id with a valid checksum")
+	}
+	return nil
+}
+
+func crc16_xmodem(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,94 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+)
+
+func TestBookmarkFormat(t *testing.T) {
+	stub := new_test_stub(t)
+	compositeKey, _ := stub.CreateCompositeKey("owner~marble", []string{"o1", "m1"})
+	for bookmark, ok := range map[string]bool{
+		"":                           true,
+		"m1":                         true,
+		compositeKey:                 true, //composite key queries page by key
+		"m1\n":                       false,
+		"\x01m1":                     false,
+		strings.Repeat("a", 4096):    true,
+		strings.Repeat("\x00", 4097): false,
+	} {
+		if err := check_bookmark(bookmark); ok != (err == nil) {
+			t.Errorf("Bookmark %q should be allowed: %v, got %v", bookmark, ok, err)
+		}
+	}
+}
+
+// a strkey with any version byte, payload and a valid checksum
+func test_strkey(version byte, payload []byte) string {
+	decoded := append([]byte{version}, payload...)
+	checksum := crc16_xmodem(decoded)
+	decoded = append(decoded, byte(checksum), byte(checksum>>8)) //little endian
+	return base32.StdEncoding.EncodeToString(decoded)
+}
+
+const base32_alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
+
+func TestStellarAccountFormat(t *testing.T) {
+	valid := "GA7QYNF7SOWQ3GLR2BGMZEHXAVIRZA4KVWLTJJFC7MGXUA74P7UJVSGZ"
+	if err := check_stellar_account(valid); err != nil {
+		t.Fatalf("%s is a valid account id, got %v", valid, err)
+	}
+	if err := check_stellar_account(test_account(1)); err != nil {
+		t.Fatalf("%s is a valid account id, got %v", test_account(1), err)
+	}
+
+	// the checksum catches any one character being changed
+	for i := range valid {
+		for _, c := range base32_alphabet {
+			if byte(c) == valid[i] {
+				continue
+			}
+			corrupt := valid[:i] + string(c) + valid[i+1:]
+			if check_stellar_account(corrupt) == nil {
+				t.Fatalf("%s has character %d changed and should be refused", corrupt, i)
+			}
+		}
+	}
+
+	payload := make([]byte, 32)
+	for _, invalid := range []string{
+		test_strkey(strkey_version_account+1, payload), //starts with a G too
+		test_strkey(18<<3, payload),                    //secret seed, S...
+		test_strkey(19<<3, payload),                    //pre-auth tx, T...
+		valid[:55],
+		valid + "A",
+		valid[:52] + "====",
+		test_strkey(strkey_version_account, payload[:31]), //56 characters with the padding, a byte short
+		strings.ToLower(valid),
+		"",
+	} {
+		if check_stellar_account(invalid) == nil {
+			t.Errorf("%s should be refused", invalid)
+		}
+	}
+}
@@ -30,10 +30,12 @@ import (
 )
 
 // ============================================================================================================================
-// write() - genric write variable into ledger
+// write() - genric write variable into ledger (admin only)
 //
 // Shows Off PutState() - writting a key/value into the ledger
 //
+// Only plain scratch keys can be written, see check_writable_key()
+//
 // Inputs - Array of strings
 //    0   ,    1
 //   key  ,  value
@@ -45,24 +47,56 @@ func write(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	fmt.Println("starting write")
 
 	if len(args) != 2 {
-		return shim.Error("Incorrect number of arguments. Expecting 2. key of the variable and value to set")
-	}
-
-	// input sanitation
-	err = sanitize_arguments(args)
-	if err != nil {
-		return shim.Error(err.Error())
+		return new_error_response(code_invalid_argument, "Incorrect number of arguments. Expecting 2. key of the variable and value to set")
 	}
 
 	key = args[0] //rename for funsies
 	value = args[1]
+	err = check_writable_key(stub, key)
+	if err != nil {
+		return error_response(err, code_not_authorized)
+	}
 	err = stub.PutState(key, []byte(value)) //write the variable into the ledger
 	if err != nil {
-		return shim.Error(err.Error())
+		return error_response(err, code_ledger_error)
 	}
 
 	fmt.Println("- end write")
-	return shim.Success(nil)
+	return success_response("Wrote " + key)
+}
+
+// ============================================================================================================================
+// Check Writable Key - error if write() would touch a setting, a document or a key only the chaincode may write
+//
+// Settings (auth mode, MSP companies, payment rail, stellar config, schema version) have their own admin functions,
+// documents and composite keys (offers, sales, oracles, payments, indexes) are only written by the chaincode itself.
+// Marble and owner ids are reserved too so nothing can be parked on an id before init_marble/init_owner uses it.
+// ============================================================================================================================
+func check_writable_key(stub shim.ChaincodeStubInterface, key string) error {
+	if strings.ContainsRune(key, 0) { //composite keys start with and separate their parts with U+0000
+		return new_error(code_not_authorized, "Composite keys can't be written with write()")
+	}
+	for _, setting := range settings_keys {
+		if key == setting {
+			return new_error(code_not_authorized, "The key '"+key+"' is a chaincode setting, use its own function to change it")
+		}
+	}
+	if marble_id_pattern.MatchString(key) || owner_id_pattern.MatchString(key) {
+		return new_error(code_not_authorized, "The key '"+key+"' is reserved for a marble or owner")
+	}
+
+	valAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return new_error(code_ledger_error, "Failed to get state for "+key)
+	}
+	var probe struct {
+		ObjectType string `json:"docType"`
+		Status     string `json:"status"`
+	}
+	if json.Unmarshal(valAsBytes, &probe) == nil && (len(probe.ObjectType) > 0 || len(probe.Status) > 0) {
+		return new_error(code_not_authorized, "The key '"+key+"' holds a chaincode document")
+	}
+	return nil
 }
 
 // ============================================================================================================================
@@ -79,13 +113,7 @@ func delete_marble(stub shim.ChaincodeStubInterface, args []string) pb.Response
 	fmt.Println("starting delete_marble")
 
 	if len(args) != 2 {
-		return shim.Error("Incorrect number of arguments. Expecting 2")
-	}
-
-	// input sanitation
-	err := sanitize_arguments(args)
-	if err != nil {
-		return shim.Error(err.Error())
+		return new_error_response(code_invalid_argument, "Incorrect number of arguments. Expecting 2")
 	}
 
 	id := args[0]
@@ -95,28 +123,50 @@ func delete_marble(stub shim.ChaincodeStubInterface, args []string) pb.Response
 	marble, err := get_marble(stub, id)
 	if err != nil {
 		fmt.Println("Failed to find marble by id " + id)
-		return shim.Error(err.Error())
+		return error_response(err, code_marble_not_found)
+	}
+
+	// check authorizing company (see get_caller_company() for how authed_by_company is treated)
+	err = check_company(stub, authed_by_company, marble.Owner.Company, "deletion")
+	if err != nil {
+		return error_response(err, code_not_authorized)
 	}
 
-	// check authorizing company (see note in set_owner() about how this is quirky)
-	if marble.Owner.Company != authed_by_company {
-		return shim.Error("The company '" + authed_by_company + "' cannot authorize deletion for '" + marble.Owner.Company + "'.")
+	// can't delete a marble while payment for it is in flight
+	err = check_not_in_escrow(marble)
+	if err != nil {
+		return error_response(err, code_marble_in_escrow)
 	}
 
 	// remove the marble
 	err = stub.DelState(id) //remove the key from chaincode state
 	if err != nil {
-		return shim.Error("Failed to delete state")
+		return new_error_response(code_ledger_error, "Failed to delete state")
+	}
+	err = remove_marble_indexes(stub, marble)
+	if err != nil {
+		return error_response(err, code_ledger_error)
+	}
+
+	// offers on a marble that is gone can't go through
+	err = close_open_offers(stub, marble.Id, marble.Owner.Id, "", offer_expired)
+	if err != nil {
+		return error_response(err, code_ledger_error)
+	}
+
+	err = emit_event(stub, MarbleEvent{Type: event_marble_deleted, MarbleId: id, OldOwner: marble.Owner.Id})
+	if err != nil {
+		return error_response(err, code_ledger_error)
 	}
 
 	fmt.Println("- end delete_marble")
-	return shim.Success(nil)
+	return success_response("Deleted marble " + id)
 }
 
 // ============================================================================================================================
 // Init Marble - create a new marble, store into chaincode state
 //
-// Shows off building a key's JSON value manually
+// Shows off building key's value from GoLang Structure
 //
 // Inputs - Array of strings
 //      0      ,    1  ,  2  ,      3          ,       4
@@ -128,13 +178,7 @@ func init_marble(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	fmt.Println("starting init_marble")
 
 	if len(args) != 5 {
-		return shim.Error("Incorrect number of arguments. Expecting 5")
-	}
-
-	//input sanitation
-	err = sanitize_arguments(args)
-	if err != nil {
-		return shim.Error(err.Error())
+		return new_error_response(code_invalid_argument, "Incorrect number of arguments. Expecting 5")
 	}
 
 	id := args[0]
@@ -143,48 +187,59 @@ func init_marble(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	authed_by_company := args[4]
 	size, err := strconv.Atoi(args[2])
 	if err != nil {
-		return shim.Error("3rd argument must be a numeric string")
+		return new_error_response(code_invalid_argument, "3rd argument must be a numeric string")
 	}
 
 	//check if new owner exists
 	owner, err := get_owner(stub, owner_id)
 	if err != nil {
 		fmt.Println("Failed to find owner - " + owner_id)
-		return shim.Error(err.Error())
+		return error_response(err, code_owner_not_found)
 	}
 
-	//check authorizing company (see note in set_owner() about how this is quirky)
-	if owner.Company != authed_by_company {
-		return shim.Error("The company '" + authed_by_company + "' cannot authorize creation for '" + owner.Company + "'.")
+	//check authorizing company (see get_caller_company() for how authed_by_company is treated)
+	err = check_company(stub, authed_by_company, owner.Company, "creation")
+	if err != nil {
+		return error_response(err, code_not_authorized)
 	}
 
 	//check if marble id already exists
-	marble, err := get_marble(stub, id)
+	_, err = get_marble(stub, id)
 	if err == nil {
 		fmt.Println("This marble already exists - " + id)
-		fmt.Println(marble)
-		return shim.Error("This marble already exists - " + id) //all stop a marble by this id exists
-	}
-
-	//build the marble json string manually
-	str := `{
-		"docType":"marble", 
-		"id": "` + id + `", 
-		"color": "` + color + `", 
-		"size": ` + strconv.Itoa(size) + `, 
-		"owner": {
-			"id": "` + owner_id + `", 
-			"username": "` + owner.Username + `", 
-			"company": "` + owner.Company + `"
-		}
-	}`
-	err = stub.PutState(id, []byte(str)) //store marble with id as key
+		return new_error_response(code_marble_exists, "This marble already exists - "+id) //all stop a marble by this id exists
+	}
+	if error_code(err) != code_marble_not_found { //something is there, don't write over it
+		return error_response(err, code_ledger_error)
+	}
+
+	//build the marble
+	var marble Marble
+	marble.ObjectType = "marble"
+	marble.Id = id
+	marble.Color = color
+	marble.Size = size
+	marble.Owner = OwnerRelation{Id: owner.Id, Username: owner.Username, Company: owner.Company}
+	marble.IsForSale = false
+	marble.MinPrice = 0
+	err = put_marble(stub, marble) //store marble with id as key
+	if err != nil {
+		return error_response(err, code_ledger_error)
+	}
+
+	//index the marble by owner, company and color
+	err = add_marble_indexes(stub, marble)
 	if err != nil {
-		return shim.Error(err.Error())
+		return error_response(err, code_ledger_error)
+	}
+
+	err = emit_event(stub, MarbleEvent{Type: event_marble_created, MarbleId: id, NewOwner: owner_id})
+	if err != nil {
+		return error_response(err, code_ledger_error)
 	}
 
 	fmt.Println("- end init_marble")
-	return shim.Success(nil)
+	return success_response("Created marble " + id)
 }
 
 // ============================================================================================================================
@@ -195,20 +250,14 @@ func init_marble(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 // Inputs - Array of Strings
 //           0     ,     1   ,   2             , 3
 //      owner id   , username, company         , stellar accountId
-// "o9999999999999",     bob", "united marbles" , erfaf6c5e4a0ddbd69f4592736986a7596b5b18dec6fde0658f12fb2e6900d81
+// "o9999999999999",     bob", "united marbles" , "GBUYUAI75XXWDZEKLY66CFYKQPET5JR4EENXZBUZ3YXZ7DS56Z4OKOFU"
 // ============================================================================================================================
 func init_owner(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	var err error
 	fmt.Println("starting init_owner")
 
 	if len(args) != 4 {
-		return shim.Error("Incorrect number of arguments. Expecting 3")
-	}
-
-	//input sanitation
-	err = sanitize_arguments(args)
-	if err != nil {
-		return shim.Error(err.Error())
+		return new_error_response(code_invalid_argument, "Incorrect number of arguments. Expecting 4")
 	}
 
 	var owner Owner
@@ -218,25 +267,37 @@ func init_owner(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	owner.Company = args[2]
 	owner.AccountId = args[3]
 	owner.Enabled = true
-	fmt.Println(owner)
+
+	//only the company itself can add its owners
+	err = check_company(stub, owner.Company, owner.Company, "new owners")
+	if err != nil {
+		return error_response(err, code_not_authorized)
+	}
 
 	//check if user already exists
 	_, err = get_owner(stub, owner.Id)
 	if err == nil {
 		fmt.Println("This owner already exists - " + owner.Id)
-		return shim.Error("This owner already exists - " + owner.Id)
+		return new_error_response(code_owner_exists, "This owner already exists - "+owner.Id)
+	}
+	if error_code(err) != code_owner_not_found { //something is there, don't write over it
+		return error_response(err, code_ledger_error)
 	}
 
 	//store user
-	ownerAsBytes, _ := json.Marshal(owner)      //convert to array of bytes
-	err = stub.PutState(owner.Id, ownerAsBytes) //store owner by its Id
+	err = put_owner(stub, owner) //store owner by its Id
 	if err != nil {
 		fmt.Println("Could not store user")
-		return shim.Error(err.Error())
+		return error_response(err, code_ledger_error)
+	}
+
+	err = emit_event(stub, MarbleEvent{Type: event_owner_created, OwnerId: owner.Id})
+	if err != nil {
+		return error_response(err, code_ledger_error)
 	}
 
 	fmt.Println("- end init_owner marble")
-	return shim.Success(nil)
+	return success_response("Created owner " + owner.Id)
 }
 
 // ============================================================================================================================
@@ -253,19 +314,8 @@ func set_owner(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	var err error
 	fmt.Println("starting set_owner")
 
-	// this is quirky
-	// todo - get the "company that authed the transfer" from the certificate instead of an argument
-	// should be possible since we can now add attributes to the enrollment cert
-	// as is.. this is a bit broken (security wise), but it's much much easier to demo! holding off for demos sake
-
 	if len(args) != 3 {
-		return shim.Error("Incorrect number of arguments. Expecting 3")
-	}
-
-	// input sanitation
-	err = sanitize_arguments(args)
-	if err != nil {
-		return shim.Error(err.Error())
+		return new_error_response(code_invalid_argument, "Incorrect number of arguments. Expecting 3")
 	}
 
 	var marble_id = args[0]
@@ -276,34 +326,58 @@ func set_owner(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	// check if user already exists
 	owner, err := get_owner(stub, new_owner_id)
 	if err != nil {
-		return shim.Error("This owner does not exist - " + new_owner_id)
+		return error_response(err, code_owner_not_found)
 	}
 
 	// get marble's current state
-	marbleAsBytes, err := stub.GetState(marble_id)
+	res, err := get_marble(stub, marble_id)
+	if err != nil {
+		return error_response(err, code_marble_not_found)
+	}
+
+	// check authorizing company, the company comes from the caller's certificate
+	err = check_company(stub, authed_by_company, res.Owner.Company, "transfers")
 	if err != nil {
-		return shim.Error("Failed to get marble")
+		return error_response(err, code_not_authorized)
 	}
-	res := Marble{}
-	json.Unmarshal(marbleAsBytes, &res) //un stringify it aka JSON.parse()
 
-	// check authorizing company
-	if res.Owner.Company != authed_by_company {
-		return shim.Error("The company '" + authed_by_company + "' cannot authorize transfers for '" + res.Owner.Company + "'.")
+	// can't hand over a marble that is promised to an accepted offer
+	err = check_not_in_escrow(res)
+	if err != nil {
+		return error_response(err, code_marble_in_escrow)
 	}
 
 	// transfer the marble
+	old_owner_id := res.Owner.Id
+	err = remove_marble_indexes(stub, res) //old owner's index entries go
+	if err != nil {
+		return error_response(err, code_ledger_error)
+	}
 	res.Owner.Id = new_owner_id //change the owner
 	res.Owner.Username = owner.Username
 	res.Owner.Company = owner.Company
-	jsonAsBytes, _ := json.Marshal(res)       //convert to array of bytes
-	err = stub.PutState(args[0], jsonAsBytes) //rewrite the marble with id as key
+	err = put_marble(stub, res) //rewrite the marble with id as key
+	if err != nil {
+		return error_response(err, code_ledger_error)
+	}
+	err = add_marble_indexes(stub, res)
+	if err != nil {
+		return error_response(err, code_ledger_error)
+	}
+
+	// the offers were made to the old owner
+	err = close_open_offers(stub, res.Id, old_owner_id, "", offer_rejected)
 	if err != nil {
-		return shim.Error(err.Error())
+		return error_response(err, code_ledger_error)
+	}
+
+	err = emit_event(stub, MarbleEvent{Type: event_marble_transferred, MarbleId: res.Id, OldOwner: old_owner_id, NewOwner: new_owner_id})
+	if err != nil {
+		return error_response(err, code_ledger_error)
 	}
 
 	fmt.Println("- end set owner")
-	return shim.Success(nil)
+	return success_response("Transferred marble " + marble_id + " to " + new_owner_id)
 }
 
 // ============================================================================================================================
@@ -320,19 +394,8 @@ func mark_for_sale(stub shim.ChaincodeStubInterface, args []string) pb.Response
 	var err error
 	fmt.Println("starting mark_for_sale")
 
-	// this is quirky
-	// todo - get the "company that authed the transfer" from the certificate instead of an argument
-	// should be possible since we can now add attributes to the enrollment cert
-	// as is.. this is a bit broken (security wise), but it's much much easier to demo! holding off for demos sake
-
 	if len(args) != 3 {
-		return shim.Error("Incorrect number of arguments. Expecting 3")
-	}
-
-	// input sanitation
-	err = sanitize_arguments(args)
-	if err != nil {
-		return shim.Error(err.Error())
+		return new_error_response(code_invalid_argument, "Incorrect number of arguments. Expecting 3")
 	}
 
 	var marble_id = args[0]
@@ -340,35 +403,44 @@ func mark_for_sale(stub shim.ChaincodeStubInterface, args []string) pb.Response
 	min_price, err2 := strconv.Atoi(args[2])
 
 	if err2 != nil {
-		return shim.Error("3rd argument must be a numeric string")
+		return new_error_response(code_invalid_argument, "3rd argument must be a numeric string")
 	}
 	fmt.Println(marble_id + "->" + strconv.Itoa(min_price) + " - |" + authed_by_company)
 
 	// get marble's current state
-	marbleAsBytes, err := stub.GetState(marble_id)
+	res, err := get_marble(stub, marble_id)
 	if err != nil {
-		return shim.Error("Failed to get marble")
+		return error_response(err, code_marble_not_found)
 	}
-	res := Marble{}
-	json.Unmarshal(marbleAsBytes, &res) //un stringify it aka JSON.parse()
 
-	// check authorizing company
-	if res.Owner.Company != authed_by_company {
-		return shim.Error("The company '" + authed_by_company + "' cannot authorize offer_for_sale for '" + res.Owner.Company + "'.")
+	// check authorizing company, the company comes from the caller's certificate
+	err = check_company(stub, authed_by_company, res.Owner.Company, "offer_for_sale")
+	if err != nil {
+		return error_response(err, code_not_authorized)
+	}
+
+	// can't reprice a marble that is promised to an accepted offer
+	err = check_not_in_escrow(res)
+	if err != nil {
+		return error_response(err, code_marble_in_escrow)
 	}
 
 	// mark the marble for sale
 	res.IsForSale = true     //set for Sale
 	res.MinPrice = min_price // set minPrice
 
-	jsonAsBytes, _ := json.Marshal(res)       //convert to array of bytes
-	err = stub.PutState(args[0], jsonAsBytes) //rewrite the marble with id as key
+	err = put_marble(stub, res) //rewrite the marble with id as key
+	if err != nil {
+		return error_response(err, code_ledger_error)
+	}
+
+	err = emit_event(stub, MarbleEvent{Type: event_marked_for_sale, MarbleId: res.Id, OwnerId: res.Owner.Id, Price: min_price})
 	if err != nil {
-		return shim.Error(err.Error())
+		return error_response(err, code_ledger_error)
 	}
 
 	fmt.Println("- end mark_for_sale")
-	return shim.Success(nil)
+	return success_response("Marked marble " + marble_id + " for sale")
 
 }
 
@@ -376,30 +448,21 @@ func mark_for_sale(stub shim.ChaincodeStubInterface, args []string) pb.Response
 // Buyer makes offer for a Marble on sale
 //
 //
+// The offer can be expired once its ttl has passed, 7 days unless the 6th argument says otherwise
+//
 // Inputs - Array of Strings
-//       0     ,   1,                      2      ,                         3            4
-//  marble id  ,  buyer_id         company that auth the transfer  ,   offerPrice      offerId
-// "m999999999",   o99999999,        "united_mables",                       200         offer99999999
+//       0     ,   1,                      2      ,                         3            4              5
+//  marble id  ,  buyer_id         company that auth the transfer  ,   offerPrice      offerId        ttl (ms, optional)
+// "m999999999",   o99999999,        "united_mables",                       200         offer99999999   "86400000"
 // ============================================================================================================================
 
 func make_offer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
 	var err error
-	fmt.Println("starting mark_for_sale")
-
-	// this is quirky
-	// todo - get the "company that authed the transfer" from the certificate instead of an argument
-	// should be possible since we can now add attributes to the enrollment cert
-	// as is.. this is a bit broken (security wise), but it's much much easier to demo! holding off for demos sake
-
-	if len(args) != 5 {
-		return shim.Error("Incorrect number of arguments. Expecting 3")
-	}
+	fmt.Println("starting make_offer")
 
-	// input sanitation
-	err = sanitize_arguments(args)
-	if err != nil {
-		return shim.Error(err.Error())
+	if len(args) != 5 && len(args) != 6 {
+		return new_error_response(code_invalid_argument, "Incorrect number of arguments. Expecting 5 or 6")
 	}
 
 	var marble_id = args[0]
@@ -408,39 +471,84 @@ func make_offer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	offer_price, err2 := strconv.Atoi(args[3])
 	var offer_id = args[4]
 
-	if err2 != nil {
-		return shim.Error("4th argument must be a numeric string")
+	if err2 != nil || offer_price <= 0 {
+		return new_error_response(code_invalid_argument, "4th argument must be a positive numeric string")
 	}
 	fmt.Println(marble_id + "->" + buyer_id + "->" + offer_id + "->" + strconv.Itoa(offer_price) + " - |" + authed_by_company)
 
 	// check if user already exists
 	buyer, err := get_owner(stub, buyer_id)
 	if err != nil {
-		return shim.Error("This buyer does not exist - " + buyer_id)
+		return new_error_response(code_owner_not_found, "This buyer does not exist - "+buyer_id)
+	}
+	if !buyer.Enabled {
+		return new_error_response(code_owner_disabled, "This buyer has been disabled - "+buyer_id)
+	}
+
+	// check authorizing company, the buyer's company has to make the offer
+	err = check_company(stub, authed_by_company, buyer.Company, "offers")
+	if err != nil {
+		return error_response(err, code_not_authorized)
 	}
 
 	marble, err := get_marble(stub, marble_id)
 	if err != nil {
-		return shim.Error("This marble does not exist -" + marble_id)
+		return new_error_response(code_marble_not_found, "This marble does not exist - "+marble_id)
+	}
+
+	// sale rules
+	if !marble.IsForSale {
+		return new_error_response(code_marble_not_for_sale, "This marble is not for sale - "+marble_id)
+	}
+	if offer_price < marble.MinPrice {
+		return new_error_response(code_price_below_minimum, "Offer price "+strconv.Itoa(offer_price)+" is below the minimum price "+strconv.Itoa(marble.MinPrice))
+	}
+	if marble.Owner.Id == buyer.Id {
+		return new_error_response(code_buyer_is_owner, "The buyer already owns this marble - "+marble_id)
+	}
+
+	// offer ids can't be reused, and can't shadow any other key
+	err = check_offer_id_unused(stub, offer_id)
+	if err != nil {
+		return error_response(err, code_ledger_error)
 	}
 
 	var offer Offer
+	offer.ObjectType = "marble_offer"
 	offer.Id = offer_id
 	offer.Buyer = buyer
 	offer.Marble = marble
 	offer.OfferPrice = offer_price
-	offer.Status = "PROPOSED"
+	offer.Asset, err = get_offer_asset(stub)
+	if err != nil {
+		return error_response(err, code_ledger_error)
+	}
+	err = transition_offer(stub, &offer, offer_proposed)
+	if err != nil {
+		return error_response(err, code_ledger_error)
+	}
+	if len(args) == 6 && len(args[5]) > 0 {
+		ttl, err := strconv.ParseInt(args[5], 10, 64)
+		if err != nil || ttl <= 0 {
+			return new_error_response(code_invalid_argument, "6th argument must be a positive numeric string")
+		}
+		offer.ExpiresAt = offer.UpdatedAt + ttl
+	}
 
-	//store user
-	offerAsBytes, _ := json.Marshal(offer)      //convert to array of bytes
-	err = stub.PutState(offer.Id, offerAsBytes) //store owner by its Id
+	//store offer
+	err = put_offer(stub, offer)
 	if err != nil {
 		fmt.Println("Could not store offer")
-		return shim.Error(err.Error())
+		return error_response(err, code_ledger_error)
+	}
+
+	err = emit_event(stub, MarbleEvent{Type: event_offer_made, MarbleId: marble.Id, OfferId: offer.Id, OldOwner: marble.Owner.Id, NewOwner: buyer.Id, Price: offer.OfferPrice})
+	if err != nil {
+		return error_response(err, code_ledger_error)
 	}
 
 	fmt.Println("- end make_offer")
-	return shim.Success(nil)
+	return success_response("Made offer " + offer_id)
 
 }
 
@@ -455,55 +563,275 @@ func make_offer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 // ============================================================================================================================
 func accept_offer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	var err error
-	fmt.Println("starting mark_for_sale")
+	fmt.Println("starting accept_offer")
+
+	if len(args) != 2 {
+		return new_error_response(code_invalid_argument, "Incorrect number of arguments. Expecting 2")
+	}
 
-	// this is quirky
-	// todo - get the "company that authed the transfer" from the certificate instead of an argument
-	// should be possible since we can now add attributes to the enrollment cert
-	// as is.. this is a bit broken (security wise), but it's much much easier to demo! holding off for demos sake
+	var offer_id = args[0]
+	var authed_by_company = args[1]
+
+	//check if offer exists and is authed by company to which owner of marble belongs.
+
+	fmt.Println(offer_id + " - |" + authed_by_company)
+
+	offer, err := get_offer(stub, offer_id)
+	if err != nil {
+		return error_response(err, code_offer_not_found)
+	}
+
+	// get the marble's current state, the copy on the offer may be stale
+	marble, err := get_marble(stub, offer.Marble.Id)
+	if err != nil {
+		return error_response(err, code_marble_not_found)
+	}
+
+	// check authorizing company, the company comes from the caller's certificate
+	err = check_company(stub, authed_by_company, marble.Owner.Company, "accepting offers")
+	if err != nil {
+		return error_response(err, code_not_authorized)
+	}
+
+	// the offer was made on the marble as it was then, it has to still be on sale by the same owner
+	if !marble.IsForSale {
+		return new_error_response(code_marble_not_for_sale, "This marble is not for sale anymore - "+marble.Id)
+	}
+	if marble.Owner.Id != offer.Marble.Owner.Id {
+		return new_error_response(code_offer_state_invalid, "Marble "+marble.Id+" changed owner since offer "+offer_id+" was made")
+	}
+
+	// an offer past its deadline can only be expired
+	timestamp, err := get_tx_timestamp(stub)
+	if err != nil {
+		return error_response(err, code_ledger_error)
+	}
+	if offer.Status == offer_proposed && offer_past_deadline(offer, timestamp) {
+		return new_error_response(code_offer_state_invalid, "Offer "+offer_id+" expired at "+strconv.FormatInt(offer.ExpiresAt, 10))
+	}
+
+	err = transition_offer(stub, &offer, offer_accepted)
+	if err != nil {
+		return error_response(err, code_offer_state_invalid)
+	}
+
+	// lock the marble until the offer is paid, withdrawn or expired
+	err = lock_marble(stub, &marble, offer)
+	if err != nil {
+		return error_response(err, code_marble_in_escrow)
+	}
+	err = put_marble(stub, marble)
+	if err != nil {
+		return error_response(err, code_ledger_error)
+	}
+
+	//store offer
+	err = put_offer(stub, offer)
+	if err != nil {
+		fmt.Println("Could not update offer")
+		return error_response(err, code_ledger_error)
+	}
+
+	err = emit_event(stub, offer_event(event_offer_accepted, offer, marble.Owner.Id))
+	if err != nil {
+		return error_response(err, code_ledger_error)
+	}
+
+	fmt.Println("- end accept offer")
+	return success_response("Accepted offer " + offer_id)
+
+}
+
+// ============================================================================================================================
+// Seller rejects offer for a Marble on sale
+//
+//
+// Inputs - Array of Strings
+//       0          ,                 1
+//    offer id      ,  company that auth the rejection
+// "offer999999999" ,         "united_mables"
+// ============================================================================================================================
+func reject_offer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting reject_offer")
 
 	if len(args) != 2 {
-		return shim.Error("Incorrect number of arguments. Expecting 3")
+		return new_error_response(code_invalid_argument, "Incorrect number of arguments. Expecting 2")
+	}
+
+	var offer_id = args[0]
+	var authed_by_company = args[1]
+	fmt.Println(offer_id + " - |" + authed_by_company)
+
+	offer, err := get_offer(stub, offer_id)
+	if err != nil {
+		return error_response(err, code_offer_not_found)
+	}
+
+	// only the seller's company can reject
+	marble, err := get_marble(stub, offer.Marble.Id)
+	if err != nil {
+		return error_response(err, code_marble_not_found)
+	}
+	err = check_company(stub, authed_by_company, marble.Owner.Company, "rejecting offers")
+	if err != nil {
+		return error_response(err, code_not_authorized)
+	}
+
+	err = transition_offer(stub, &offer, offer_rejected)
+	if err != nil {
+		return error_response(err, code_offer_state_invalid)
+	}
+	err = put_offer(stub, offer)
+	if err != nil {
+		return error_response(err, code_ledger_error)
 	}
 
-	// input sanitation
-	err = sanitize_arguments(args)
+	err = emit_event(stub, offer_event(event_offer_rejected, offer, marble.Owner.Id))
 	if err != nil {
-		return shim.Error(err.Error())
+		return error_response(err, code_ledger_error)
+	}
+
+	fmt.Println("- end reject_offer")
+	return success_response("Rejected offer " + offer_id)
+}
+
+// ============================================================================================================================
+// Buyer withdraws their offer for a Marble
+//
+//
+// Inputs - Array of Strings
+//       0          ,                 1
+//    offer id      ,  company that auth the withdrawal
+// "offer999999999" ,         "united_mables"
+// ============================================================================================================================
+func withdraw_offer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting withdraw_offer")
+
+	if len(args) != 2 {
+		return new_error_response(code_invalid_argument, "Incorrect number of arguments. Expecting 2")
 	}
 
 	var offer_id = args[0]
 	var authed_by_company = args[1]
+	fmt.Println(offer_id + " - |" + authed_by_company)
 
-	//check if offer exists and is authed by company to which owner of marble belongs.
+	offer, err := get_offer(stub, offer_id)
+	if err != nil {
+		return error_response(err, code_offer_not_found)
+	}
+
+	// only the buyer's company can withdraw
+	err = check_company(stub, authed_by_company, offer.Buyer.Company, "withdrawing offers")
+	if err != nil {
+		return error_response(err, code_not_authorized)
+	}
 
+	err = transition_offer(stub, &offer, offer_withdrawn)
+	if err != nil {
+		return error_response(err, code_offer_state_invalid)
+	}
+	err = put_offer(stub, offer)
+	if err != nil {
+		return error_response(err, code_ledger_error)
+	}
+
+	// give the marble back to the seller if this offer had it in escrow
+	err = release_marble(stub, offer)
+	if err != nil {
+		return error_response(err, code_ledger_error)
+	}
+
+	seller, err := get_offer_seller(stub, offer)
+	if err != nil {
+		return error_response(err, code_owner_not_found)
+	}
+	err = emit_event(stub, offer_event(event_offer_withdrawn, offer, seller.Id))
+	if err != nil {
+		return error_response(err, code_ledger_error)
+	}
+
+	fmt.Println("- end withdraw_offer")
+	return success_response("Withdrew offer " + offer_id)
+}
+
+// ============================================================================================================================
+// Buyer or seller marks an offer as expired
+//
+// Only once the tx timestamp has reached the offer's expiresAt. An accepted offer is the buyer's to expire, the
+// seller could otherwise pull the marble out of escrow while the buyer's payment is on its way. An admin can clear
+// an escrow the buyer abandoned.
+//
+// Inputs - Array of Strings
+//       0          ,                 1
+//    offer id      ,  company that auth the expiry
+// "offer999999999" ,         "united_mables"
+// ============================================================================================================================
+func expire_offer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting expire_offer")
+
+	if len(args) != 2 {
+		return new_error_response(code_invalid_argument, "Incorrect number of arguments. Expecting 2")
+	}
+
+	var offer_id = args[0]
+	var authed_by_company = args[1]
 	fmt.Println(offer_id + " - |" + authed_by_company)
 
-	offerAsBytes, err := stub.GetState(offer_id)
+	offer, err := get_offer(stub, offer_id)
 	if err != nil {
-		return shim.Error("This offer does not exist")
+		return error_response(err, code_offer_not_found)
 	}
 
-	offer := Offer{}
-	json.Unmarshal(offerAsBytes, &offer)
+	// either side of a proposed offer can expire it, only the buyer an accepted one
+	marble, err := get_marble(stub, offer.Marble.Id)
+	if err != nil {
+		return error_response(err, code_marble_not_found)
+	}
+	err = check_company(stub, authed_by_company, offer.Buyer.Company, "expiring offers")
+	if err != nil && offer.Status != offer_accepted {
+		err = check_company(stub, authed_by_company, marble.Owner.Company, "expiring offers")
+	}
+	if err != nil && check_role(stub, role_admin) != nil {
+		return error_response(err, code_not_authorized)
+	}
 
-	if offer.Marble.Owner.Company != authed_by_company {
-		return shim.Error("This user is not authorized to perform this operation")
+	timestamp, err := get_tx_timestamp(stub)
+	if err != nil {
+		return error_response(err, code_ledger_error)
+	}
+	if !offer_past_deadline(offer, timestamp) {
+		return new_error_response(code_offer_state_invalid, "Offer "+offer_id+" cannot be expired before "+strconv.FormatInt(offer.ExpiresAt, 10))
 	}
 
-	offer.Status = "ACCEPTED"
+	err = transition_offer(stub, &offer, offer_expired)
+	if err != nil {
+		return error_response(err, code_offer_state_invalid)
+	}
+	err = put_offer(stub, offer)
+	if err != nil {
+		return error_response(err, code_ledger_error)
+	}
 
-	//store user
-	updateOfferAsBytes, _ := json.Marshal(offer)      //convert to array of bytes
-	err = stub.PutState(offer.Id, updateOfferAsBytes) //store owner by its Id
+	// give the marble back to the seller if this offer had it in escrow
+	err = release_marble(stub, offer)
 	if err != nil {
-		fmt.Println("Could not update offer")
-		return shim.Error(err.Error())
+		return error_response(err, code_ledger_error)
 	}
 
-	fmt.Println("- end accept offer")
-	return shim.Success(nil)
+	seller, err := get_offer_seller(stub, offer)
+	if err != nil {
+		return error_response(err, code_owner_not_found)
+	}
+	err = emit_event(stub, offer_event(event_offer_expired, offer, seller.Id))
+	if err != nil {
+		return error_response(err, code_ledger_error)
+	}
 
+	fmt.Println("- end expire_offer")
+	return success_response("Expired offer " + offer_id)
 }
 
 // ============================================================================================================================
@@ -518,16 +846,10 @@ func accept_offer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
 func payment_complete_against_offer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	var err error
-	fmt.Println("starting mark_for_sale")
+	fmt.Println("starting payment_complete_against_offer")
 
 	if len(args) != 2 {
-		return shim.Error("Incorrect number of arguments. Expecting 3")
-	}
-
-	// input sanitation
-	err = sanitize_arguments(args)
-	if err != nil {
-		return shim.Error(err.Error())
+		return new_error_response(code_invalid_argument, "Incorrect number of arguments. Expecting 2")
 	}
 
 	var offer_id = args[0]
@@ -536,38 +858,105 @@ func payment_complete_against_offer(stub shim.ChaincodeStubInterface, args []str
 	fmt.Println(offer_id + "-> " + stellar_transaction_id)
 
 	//check if offer exists
-	offerAsBytes, err := stub.GetState(offer_id)
+	offer, err := get_offer(stub, offer_id)
 	if err != nil {
-		return shim.Error("This offer does not exist")
+		return error_response(err, code_offer_not_found)
 	}
 
-	offer := Offer{}
-	json.Unmarshal(offerAsBytes, &offer)
+	//only accepted offers can be paid
+	if !can_transition_offer(offer.Status, offer_paid) {
+		return new_error_response(code_offer_state_invalid, "Offer "+offer.Id+" is "+offer.Status+", only ACCEPTED offers can be paid")
+	}
 
-	owner, err := get_owner(stub, offer.Marble.Owner.Id)
+	owner, err := get_offer_seller(stub, offer)
 	if err != nil {
-		return shim.Error(" Transfer not done. Current Onwer not found")
+		return new_error_response(code_owner_not_found, "Transfer not done. Current owner not found")
 	}
 
-	paymentDone, err := is_payment_done_for_offer(&offer, owner.AccountId, stellar_transaction_id)
+	// a payment can only ever settle one offer
+	err = check_payment_not_consumed(stub, stellar_transaction_id)
+	if err != nil {
+		return error_response(err, code_payment_already_used)
+	}
 
+	// check the payment on whichever rail this channel is configured for
+	rail, verifier, err := get_payment_verifier(stub)
 	if err != nil {
-		return shim.Error("Unable to verify payment information from stellar. Please try again later")
+		return error_response(err, code_payment_rail_unavailable)
 	}
 
-	if paymentDone {
-		set_owner(stub, []string{offer.Buyer.Id}) // transfer the marble to Buyer
+	paymentDone, err := verifier.VerifyPayment(stub, &offer, owner.AccountId, stellar_transaction_id)
 
-		//TODO update offer to indicate completion of transfer.
+	if err != nil {
+		return new_error_response(code_payment_rail_unavailable, "Unable to verify payment information from "+rail+". Please try again later")
+	}
 
-		return shim.Success(nil)
+	if paymentDone {
+		err = settle_offer(stub, offer, stellar_transaction_id, rail)
+		if err != nil {
+			return error_response(err, code_ledger_error)
+		}
+		return success_response("Settled offer " + offer_id)
 
 	} else {
-		return shim.Error(" Payment not done in stellar or mismatch in payment information.  ")
+		return new_error_response(code_payment_not_verified, "Payment not done in "+rail+" or mismatch in payment information")
 	}
 
 }
 
+// ============================================================================================================================
+// Seller settles an offer with a payment attestation signed by a registered oracle
+//
+// Same as payment_complete_against_offer() but deterministic, no network calls are made during endorsement
+//
+// Inputs - Array of Strings
+//       0          ,                    1                     ,          2
+//    offer id      ,           attestation JSON               , signature (base64 DER)
+// "offer999999999" , {"oracleId":"oracle1","offerId":...}     , "MEUCIQD..."
+// ============================================================================================================================
+func payment_complete_with_attestation(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting payment_complete_with_attestation")
+
+	if len(args) != 3 {
+		return new_error_response(code_invalid_argument, "Incorrect number of arguments. Expecting 3")
+	}
+
+	var offer_id = args[0]
+	var attestation_json = args[1]
+	var signature = args[2]
+
+	//check if offer exists
+	offer, err := get_offer(stub, offer_id)
+	if err != nil {
+		return error_response(err, code_offer_not_found)
+	}
+
+	//only accepted offers can be paid
+	if !can_transition_offer(offer.Status, offer_paid) {
+		return new_error_response(code_offer_state_invalid, "Offer "+offer.Id+" is "+offer.Status+", only ACCEPTED offers can be paid")
+	}
+
+	owner, err := get_offer_seller(stub, offer)
+	if err != nil {
+		return new_error_response(code_owner_not_found, "Transfer not done. Current owner not found")
+	}
+
+	attestation, err := verify_payment_attestation(stub, &offer, owner.AccountId, attestation_json, signature)
+	if err != nil {
+		return error_response(err, code_attestation_invalid)
+	}
+	fmt.Println(offer_id + "-> " + attestation.StellarTxHash + " attested by " + attestation.OracleId)
+
+	err = settle_offer(stub, offer, attestation.StellarTxHash, "oracle")
+	if err != nil {
+		return error_response(err, code_ledger_error)
+	}
+
+	fmt.Println("- end payment_complete_with_attestation")
+	return success_response("Settled offer " + offer_id)
+}
+
 // ============================================================================================================================
 // Disable Marble Owner
 //
@@ -583,13 +972,7 @@ func disable_owner(stub shim.ChaincodeStubInterface, args []string) pb.Response
 	fmt.Println("starting disable_owner")
 
 	if len(args) != 2 {
-		return shim.Error("Incorrect number of arguments. Expecting 2")
-	}
-
-	// input sanitation
-	err = sanitize_arguments(args)
-	if err != nil {
-		return shim.Error(err.Error())
+		return new_error_response(code_invalid_argument, "Incorrect number of arguments. Expecting 2")
 	}
 
 	var owner_id = args[0]
@@ -598,22 +981,27 @@ func disable_owner(stub shim.ChaincodeStubInterface, args []string) pb.Response
 	// get the marble owner data
 	owner, err := get_owner(stub, owner_id)
 	if err != nil {
-		return shim.Error("This owner does not exist - " + owner_id)
+		return error_response(err, code_owner_not_found)
 	}
 
-	// check authorizing company
-	if owner.Company != authed_by_company {
-		return shim.Error("The company '" + authed_by_company + "' cannot change another companies marble owner")
+	// check authorizing company, the company comes from the caller's certificate
+	err = check_company(stub, authed_by_company, owner.Company, "owner changes")
+	if err != nil {
+		return error_response(err, code_not_authorized)
 	}
 
 	// disable the owner
 	owner.Enabled = false
-	jsonAsBytes, _ := json.Marshal(owner)     //convert to array of bytes
-	err = stub.PutState(args[0], jsonAsBytes) //rewrite the owner
+	err = put_owner(stub, owner) //rewrite the owner
+	if err != nil {
+		return error_response(err, code_ledger_error)
+	}
+
+	err = emit_event(stub, MarbleEvent{Type: event_owner_disabled, OwnerId: owner.Id})
 	if err != nil {
-		return shim.Error(err.Error())
+		return error_response(err, code_ledger_error)
 	}
 
 	fmt.Println("- end disable_owner")
-	return shim.Success(nil)
+	return success_response("Disabled owner " + owner_id)
 }